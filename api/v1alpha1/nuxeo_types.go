@@ -18,6 +18,8 @@ package v1alpha1
 
 import (
 	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -39,6 +41,48 @@ const (
 	NuxeoStorageNuxeoTmp = "NuxeoTmp"
 )
 
+// WorkloadType defines the kind of workload that the Operator generates from a NodeSet
+type WorkloadType string
+
+const (
+	// WorkloadDeployment generates a Deployment. This is the default.
+	WorkloadDeployment WorkloadType = "Deployment"
+	// WorkloadStatefulSet generates a StatefulSet with per-Pod storage and stable Pod identities
+	WorkloadStatefulSet WorkloadType = "StatefulSet"
+)
+
+// PvcReclaimPolicy defines what the Operator does if the PVC spec of a storage changes in a way that cannot be
+// applied to the existing PVC
+type PvcReclaimPolicy string
+
+const (
+	// PvcReclaimRetain leaves the existing PVC unchanged and reports the change as a StorageBound condition error.
+	// This is the default.
+	PvcReclaimRetain PvcReclaimPolicy = "Retain"
+	// PvcReclaimRecreate deletes the existing PVC and creates a new PVC from the changed spec. The data in the
+	// existing PVC is lost.
+	PvcReclaimRecreate PvcReclaimPolicy = "Recreate"
+)
+
+// SecurityProfile selects the default security context that the Operator applies to the Pods of a NodeSet
+type SecurityProfile string
+
+const (
+	// SecurityProfileRestricted complies with the Pod Security Standards 'restricted' profile
+	SecurityProfileRestricted SecurityProfile = "Restricted"
+)
+
+// RetentionPolicy defines what happens to a PVC generated by the Operator when its storage is removed from the
+// Nuxeo CR, or when the Nuxeo CR is deleted
+type RetentionPolicy string
+
+const (
+	// RetentionDelete deletes the PVC. It has to be specified explicitly.
+	RetentionDelete RetentionPolicy = "Delete"
+	// RetentionRetain keeps the PVC so the data can be used by a re-created Nuxeo CR. This is the default.
+	RetentionRetain RetentionPolicy = "Retain"
+)
+
 // By default, all filesystem access inside a Pod is ephemeral and data is lost when the Pod terminates. The
 // NuxeoStorageSpec enables definition of persistent storage. By default, the Nuxeo Operator will create a PVC
 // for each specified storage with volumeMode=Filesystem, accessMode=ReadWriteOnce, and no storage class.
@@ -62,6 +106,60 @@ type NuxeoStorageSpec struct {
 	// be used, for example, to define an EmptyDir volume source for testing/troubleshooting.
 	// +optional
 	VolumeSource corev1.VolumeSource `json:"volumeSource,omitempty"`
+
+	// Defines what the Operator does if the PVC for this storage changes in a way that cannot be applied to the
+	// existing PVC. An increased size is applied in place if the storage class of the PVC allows volume expansion.
+	// Any other change is refused unless this is 'Recreate', in which case the existing PVC is deleted - along with
+	// its data - and re-created from the changed spec. Default is 'Retain'.
+	// +kubebuilder:validation:Enum=Retain;Recreate
+	// +optional
+	Reclaim PvcReclaimPolicy `json:"reclaim,omitempty"`
+
+	// Defines what happens to the PVC for this storage when the Nuxeo CR is deleted. 'Retain' keeps the PVC, and
+	// a Nuxeo CR with the same name that is later created in the namespace re-adopts it. Overrides the Nuxeo CR
+	// 'retentionPolicy'. Not applicable to the volume claim templates of a StatefulSet NodeSet.
+	// +kubebuilder:validation:Enum=Retain;Delete
+	// +optional
+	RetentionPolicy RetentionPolicy `json:"retentionPolicy,omitempty"`
+}
+
+// BinaryStoreSpec configures an external binary store for all NodeSets in place of a filesystem Binaries storage
+type BinaryStoreSpec struct {
+	// Configures an S3-compatible object store - e.g. Amazon S3 or MinIO - as the binary store
+	S3 S3BinaryStoreSpec `json:"s3"`
+}
+
+// S3BinaryStoreSpec configures the Nuxeo amazon-s3-online-storage package to store binaries in an S3 bucket
+type S3BinaryStoreSpec struct {
+	// The name of the bucket. The bucket must already exist
+	Bucket string `json:"bucket"`
+
+	// A prefix for the binary object keys in the bucket. Should end with a slash. E.g.: 'nuxeo/'
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// The region of the bucket. E.g.: 'us-east-1'
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// The S3 endpoint. Required for S3-compatible stores other than Amazon S3. E.g.: 'http://minio.minio:9000'
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Use path-style bucket access rather than virtual-hosted-style access. Typically required for MinIO
+	// +optional
+	PathStyleAccess bool `json:"pathStyleAccess,omitempty"`
+
+	// The name of a Secret in the Nuxeo CR namespace with the S3 credentials in keys 'accessKeyId' and
+	// 'secretAccessKey'. If omitted, Nuxeo uses the AWS default credential provider chain - e.g. an IAM role
+	// +optional
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+
+	// The name of a Secret in the Nuxeo CR namespace with a PEM-encoded CA certificate bundle in key 'ca.crt'. The
+	// CA is added to the JVM trust store so Nuxeo can trust an S3 endpoint with a certificate signed by a private CA.
+	// Cannot be combined with a JVM PKI secret that defines a trust store
+	// +optional
+	CaBundleSecret string `json:"caBundleSecret,omitempty"`
 }
 
 // Contributions allow a configurer to add ad-hoc or persistent contributions to the Nuxeo server. Two scenarios are
@@ -103,6 +201,32 @@ type NodeSet struct {
 	// +kubebuilder:validation:Minimum=1
 	Replicas int32 `json:"replicas"`
 
+	// If true, the replica count of the Deployment generated by this NodeSet is managed outside of the Operator,
+	// e.g. by 'kubectl scale deployment' or by a HorizontalPodAutoscaler. The Operator populates the Deployment
+	// replicas from the NodeSet when it creates the Deployment, and thereafter leaves the Deployment replicas alone.
+	// +optional
+	Autoscaled bool `json:"autoscaled,omitempty"`
+
+	// The kind of workload the Operator generates from this NodeSet. The default is 'Deployment'. If 'StatefulSet',
+	// then each storage in this NodeSet that is not defined with an explicit 'volumeSource' becomes a volume claim
+	// template of the StatefulSet, so that each Pod gets its own PVC, and the Operator generates a headless
+	// governing Service for the StatefulSet. If clustering is enabled, the cluster node id of each Pod is the Pod
+	// name, which ends with the Pod ordinal, and is therefore stable across Pod restarts.
+	// +kubebuilder:validation:Enum=Deployment;StatefulSet
+	// +optional
+	WorkloadType WorkloadType `json:"workloadType,omitempty"`
+
+	// Causes the Operator to generate a HorizontalPodAutoscaler targeting the Deployment generated by this NodeSet.
+	// If specified, the Deployment replicas are managed by the HorizontalPodAutoscaler as described for the
+	// 'autoscaled' field.
+	// +optional
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+
+	// Causes the Operator to generate a PodDisruptionBudget for the Pods of this NodeSet, to limit the number of
+	// Pods that can be taken down at once by voluntary disruptions such as node drains
+	// +optional
+	DisruptionBudget *DisruptionBudgetSpec `json:"disruptionBudget,omitempty"`
+
 	// Indicates whether this NodeSet will be accessible outside the cluster. Default is 'false'. If 'true', then
 	// the Service created by the operator will be have its selectors defined such that it selects the Pods
 	// created by this NodeSet. Exactly one NodeSet must be configured for external access.
@@ -112,8 +236,8 @@ type NodeSet struct {
 	// Turns on repository clustering per https://doc.nuxeo.com/nxdoc/next/nuxeo-clustering-configuration/.
 	// Sets nuxeo.conf properties: repository.binary.store=/var/lib/nuxeo/binaries/binaries. Sets
 	// nuxeo.cluster.enabled=true and nuxeo.cluster.nodeid={env:POD_UID}. Sets POD_UID env var using the
-	// downward API. Requires the configurer to specify storage.storageType.Binaries and errors if this is not
-	// the configured.
+	// downward API. (For a StatefulSet NodeSet, POD_NAME is used instead of POD_UID.) Requires the configurer
+	// to specify storage.storageType.Binaries and errors if this is not the configured.
 	// +optional
 	ClusterEnabled bool `json:"clusterEnabled,omitempty"`
 
@@ -149,6 +273,135 @@ type NodeSet struct {
 	// Provides the ability to add custom or ad-hoc contributions directly into the Nuxeo server
 	// +optional
 	Contributions []Contribution `json:"contribs,omitempty"`
+
+	// Constrains the Pods of this NodeSet to nodes having the specified labels. Populates the 'nodeSelector'
+	// property of the Pod spec
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Defines the scheduling constraints for the Pods of this NodeSet. If not specified, and the NodeSet is
+	// clustered, then the Operator defines a preferred Pod anti-affinity so that the scheduler tries to place
+	// the Pods of the NodeSet on different hosts. If specified, the Operator uses this verbatim.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+
+	// Allows the Pods of this NodeSet to be scheduled onto nodes with matching taints. E.g. to run a worker
+	// NodeSet on a tainted pool of high-CPU nodes.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Describes how the Pods of this NodeSet are spread across topology domains such as zones
+	// +optional
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// The name of the PriorityClass for the Pods of this NodeSet
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// Defines how the Deployment generated by this NodeSet replaces existing Pods with new ones. Any field not
+	// specified here is taken from the Nuxeo CR 'strategy', and then from the Operator defaults. Not applicable
+	// to a StatefulSet.
+	// +optional
+	Strategy *StrategySpec `json:"strategy,omitempty"`
+
+	// Opts in to a default security context for the Pods of this NodeSet. 'Restricted' complies with the Pod
+	// Security Standards 'restricted' profile: the Pods run as non-root with the RuntimeDefault seccomp profile,
+	// and the containers that the Operator generates disallow privilege escalation and drop all capabilities.
+	// The Kubernetes API that the Operator is built against pre-dates the seccompProfile field, so the seccomp
+	// profile is configured with the seccomp Pod annotation, which only Kubernetes versions that translate the
+	// annotation to the field honour. 'podSecurityContext' and 'containerSecurityContext' override the profile.
+	// If not specified, the Operator applies no security context.
+	// +kubebuilder:validation:Enum=Restricted
+	// +optional
+	SecurityProfile SecurityProfile `json:"securityProfile,omitempty"`
+
+	// The security context for the Pods of this NodeSet. Overrides the Pod security context of the
+	// 'securityProfile'.
+	// +optional
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+
+	// The security context for the Nuxeo container, the Nginx sidecar, and the init containers that the Operator
+	// generates. Containers and init containers from the Nuxeo CR are not modified. Overrides the container
+	// security context of the 'securityProfile'. If readOnlyRootFilesystem is true, then the Operator mounts
+	// emptyDir volumes on the paths that these containers write to.
+	// +optional
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// Labels to add to the Pods of this NodeSet. These override the Nuxeo CR 'podLabels' with the same key.
+	// +optional
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+
+	// Annotations to add to the Pods of this NodeSet. These override the Nuxeo CR 'podAnnotations' with the
+	// same key.
+	// +optional
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+}
+
+// StrategySpec defines the update strategy of a NodeSet Deployment. The Operator defaults are a RollingUpdate
+// with 25% max surge and 25% max unavailable, and a progress deadline of 600 seconds.
+type StrategySpec struct {
+	// The type of update: 'RollingUpdate' or 'Recreate'. Use 'Recreate' if old and new Nuxeo versions must not
+	// run concurrently - e.g. during a repository schema migration
+	// +optional
+	// +kubebuilder:validation:Enum=RollingUpdate;Recreate
+	Type appsv1.DeploymentStrategyType `json:"type,omitempty"`
+
+	// The maximum number or percentage of Pods that can be created over the desired number of Pods during a
+	// rolling update. Ignored for a 'Recreate' update
+	// +optional
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
+
+	// The maximum number or percentage of Pods that can be unavailable during a rolling update. Ignored for
+	// a 'Recreate' update
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+
+	// The number of seconds a rollout can make no progress before it is considered stalled
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	ProgressDeadlineSeconds *int32 `json:"progressDeadlineSeconds,omitempty"`
+}
+
+// AutoscalingSpec defines the HorizontalPodAutoscaler that the Operator generates for a NodeSet. If no target is
+// specified, then the HorizontalPodAutoscaler defaults to a target average CPU utilization of 80%.
+type AutoscalingSpec struct {
+	// The lower limit for the number of replicas. If omitted, the NodeSet replicas are used, but not less than one
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+
+	// The upper limit for the number of replicas. Cannot be less than minReplicas, whether specified or defaulted
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// The target average CPU utilization across all Pods in the NodeSet, expressed as a percentage of the
+	// requested CPU
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+
+	// The target average memory utilization across all Pods in the NodeSet, expressed as a percentage of the
+	// requested memory
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	TargetMemoryUtilizationPercentage *int32 `json:"targetMemoryUtilizationPercentage,omitempty"`
+
+	// Additional metrics - e.g. Pods, Object, or External metrics served by a custom metrics adapter - that are
+	// included verbatim in the HorizontalPodAutoscaler metrics, after the CPU and memory targets
+	// +optional
+	Metrics []autoscalingv2beta2.MetricSpec `json:"metrics,omitempty"`
+}
+
+// DisruptionBudgetSpec defines the PodDisruptionBudget that the Operator generates for a NodeSet. Exactly one of
+// minAvailable or maxUnavailable must be specified.
+type DisruptionBudgetSpec struct {
+	// The number or percentage of NodeSet Pods that must remain available during an eviction
+	// +optional
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+
+	// The number or percentage of NodeSet Pods that can be unavailable during an eviction
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
 }
 
 // ServiceSpec provides the ability to minimally customize the the type of Service generated by the Operator.
@@ -206,7 +459,8 @@ type NginxRevProxySpec struct {
 	// +optional
 	Secret string `json:"secret"`
 
-	// Specifies the Nginx image. If not provided, defaults to "nginx:latest"
+	// Specifies the Nginx image. If not provided, defaults to the image from the Operator RELATED_IMAGE_NGINX
+	// environment variable, or "nginx:latest" if that is not set
 	// +optional
 	Image string `json:"image,omitempty"`
 
@@ -263,6 +517,15 @@ type OfflinePackage struct {
 	ValueFrom corev1.VolumeSource `json:"valueFrom,omitempty"`
 }
 
+// SecretProperty is a nuxeo.conf property whose value is obtained from a Secret
+type SecretProperty struct {
+	// The nuxeo.conf property key. E.g.: nuxeo.db.password
+	Key string `json:"key"`
+
+	// Selects the Secret key that holds the property value. The Secret must be in the namespace of the Nuxeo CR
+	SecretKeyRef corev1.SecretKeySelector `json:"secretKeyRef"`
+}
+
 // NuxeoConfig provides the ability to configure the Nuxeo server. These settings are added to each Deployment
 // generated from the NodeSet.
 type NuxeoConfig struct {
@@ -288,11 +551,29 @@ type NuxeoConfig struct {
 	// +optional
 	NuxeoName string `json:"nuxeoName,omitempty"`
 
-	// NuxeoConf specifies values to append to nuxeo.conf. Values can be provided inline, or from a Secret
-	// or ConfigMap
+	// NuxeoConf specifies values to append to nuxeo.conf. Values can be provided inline, and/or from a Secret
+	// or ConfigMap. The Operator reads the Secret or ConfigMap and merges it into the nuxeo.conf ConfigMap that it
+	// generates, with the inline values taking precedence. The nuxeo.conf key is used unless the volume source
+	// projects another key to the path nuxeo.conf. The Operator watches the Secret or ConfigMap, and rolls the
+	// NodeSet when it changes
 	// +optional
 	NuxeoConf NuxeoConfigSetting `json:"nuxeoConf,omitempty"`
 
+	// Properties specifies nuxeo.conf properties as key/value pairs. The Operator merges nuxeo.conf from - in
+	// ascending order of precedence - the settings it requires for clustering and TLS, the settings generated from
+	// backing services and the binary store, the inline nuxeo.conf, and these properties. Each key appears once in
+	// the generated nuxeo.conf, and properties that are set more than once with different values are reported in
+	// the NodeSet status
+	// +optional
+	Properties map[string]string `json:"properties,omitempty"`
+
+	// SecretProperties specifies nuxeo.conf properties whose values are obtained from Secrets, so the values are
+	// not written to the nuxeo.conf ConfigMap that the Operator generates. The Operator defines an environment
+	// variable in the Nuxeo container from each Secret key, and renders the property into nuxeo.conf as a reference
+	// to the environment variable. Secret properties take precedence over the properties
+	// +optional
+	SecretProperties []SecretProperty `json:"secretProperties,omitempty"`
+
 	// tlsSecret enables TLS termination by the Nuxeo Pod. The field specifies the name of a secret containing
 	// keys keystore.jks and keystorePass. As of Nuxeo 10.10, only JKS is supported. (This is a Nuxeo constraint.)
 	// +optional
@@ -302,7 +583,8 @@ type NuxeoConfig struct {
 	// for the Nuxeo container. The operator mounts the keystore and truststore files into the Nuxeo container, and
 	// sets environment variables which the Nuxeo loader passes through into the JVM. All of the following keys will
 	// be configured from the secret into JVM keystore/truststore properties: keyStore, keyStorePassword, keyStoreType,
-	// trustStore, trustStorePassword, and trustStoreType.
+	// trustStore, trustStorePassword, and trustStoreType. The passwords are passed to the container as environment
+	// variables from the secret, so they do not appear in the Deployment.
 	// +optional
 	JvmPKISecret string `json:"jvmPKISecret,omitempty"`
 
@@ -462,15 +744,11 @@ type BackingServiceResource struct {
 // mounted under /etc/nuxeo-operator/binding/<the name you assign>.
 //
 // Once the operator is finished configuring all of the backing service bindings, all of the nuxeo.conf entries are
-// concatenated and appended to the operator-managed nuxeo.conf ConfigMap. The Nuxeo CR offers the ability
-// to specify inline nuxeo.conf values in the Nuxeo CR. If these are specified, the backing service settings are
-// appended. The Nuxeo CR also offers the ability to define nuxeo.conf content in an externally provisioned ConfigMap
-// or Secret and to reference that in the Nuxeo CR. An externally provisioned nuxeo.conf ConfigMap or Secret is not
-// compatible with backing services and will result in a reconciliation error. Only inlined nuxeo.conf content is
-// supported with backing services - because the Operator has to have ownership of the cluster resource holding
-// the nuxeo.conf content and it can't do that if the resource is provisioned by the configurer. (Because as of
-// Nuxeo 10.10 only one nuxeo.conf can exist in /docker-entrypoint-initnuxeo.d to be processed by the Nuxeo
-// startup script.)
+// merged into the operator-managed nuxeo.conf ConfigMap. The Nuxeo CR offers the ability to specify nuxeo.conf
+// values inline, as properties, or in an externally provisioned ConfigMap or Secret. These are merged with the
+// backing service settings, and take precedence over them. (As of Nuxeo 10.10 only one nuxeo.conf can exist in
+// /docker-entrypoint-initnuxeo.d to be processed by the Nuxeo startup script, which is why the Operator merges
+// all nuxeo.conf content into the one ConfigMap.)
 type BackingService struct {
 	// The name of the backing service, as well as the directory under which to mount any files. Required
 	// if preConfigured is empty. If name is specified, then resources and nuxeoConf must also be specified,
@@ -504,8 +782,8 @@ type BackingService struct {
 // Defines the desired state of a Nuxeo cluster
 type NuxeoSpec struct {
 	// Overrides the default Nuxeo container image selected by the Operator. By default, the Operator
-	// uses 'nuxeo:latest' as the container image. To override that, include the image spec here. Any allowable
-	// form is supported.
+	// uses the image from its RELATED_IMAGE_NUXEO environment variable, or 'nuxeo:latest' if that is not set, as
+	// the container image. To override that, include the image spec here. Any allowable form is supported.
 	// +optional
 	NuxeoImage string `json:"nuxeoImage,omitempty"`
 
@@ -521,6 +799,23 @@ type NuxeoSpec struct {
 	// +optional
 	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
 
+	// Secrets in the namespace of the Nuxeo CR that hold the credentials to pull the images of the Nuxeo Pods
+	// from a private registry - the Nuxeo image, the Nginx image, and the images of any containers and init
+	// containers in the Nuxeo CR. These are configured in the Pod spec, and in the service account that the
+	// Operator generates for the Nuxeo Pods.
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// Labels to add to the Pods of all NodeSets, e.g. for cost allocation. The labels that the Operator applies
+	// to the Pods cannot be specified here.
+	// +optional
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+
+	// Annotations to add to the Pods of all NodeSets, e.g. for service mesh sidecar injection or Prometheus
+	// scraping. Annotations with the 'appzygy.net/' prefix are reserved for the Operator.
+	// +optional
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+
 	// Causes a reverse proxy to be included in the Nuxeo interactive deployment. The reverse proxy will
 	// receive traffic from the Route/Ingress object created by the Operator, and forward that traffic to the Nuxeo
 	// Service created by the operator, which in turn will forward traffic to the Nuxeo interactive Pods. Presently,
@@ -543,6 +838,30 @@ type NuxeoSpec struct {
 	// +kubebuilder:validation:MinItems=1
 	NodeSets []NodeSet `json:"nodeSets"`
 
+	// Overrides the replicas of the interactive NodeSet. This is the field exposed by the scale subresource of
+	// the Nuxeo CR, so that 'kubectl scale nuxeo', or a HorizontalPodAutoscaler targeting the Nuxeo CR, scales
+	// the interactive NodeSet. If omitted, the interactive NodeSet replicas are used.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Defines the default update strategy for all NodeSets. A NodeSet 'strategy' overrides this
+	// +optional
+	Strategy *StrategySpec `json:"strategy,omitempty"`
+
+	// Defines the default retention policy of the PVCs that the Operator generates. It applies to each storage
+	// that does not specify a 'retentionPolicy'. The PVC of a storage that is removed from the Nuxeo CR keeps the
+	// retention policy that was in effect when the PVC was last reconciled. Default is 'Retain': a PVC is only
+	// deleted if 'Delete' is specified explicitly.
+	// +kubebuilder:validation:Enum=Retain;Delete
+	// +optional
+	RetentionPolicy RetentionPolicy `json:"retentionPolicy,omitempty"`
+
+	// Configures an external binary store shared by all NodeSets. A clustered NodeSet does not need a Binaries
+	// storage if a binary store is configured
+	// +optional
+	BinaryStore *BinaryStoreSpec `json:"binaryStore,omitempty"`
+
 	// Nuxeo CLID. Must be formatted as it would be obtained from the Nuxeo registration site, with the double
 	// dash separator
 	// +optional
@@ -576,21 +895,142 @@ const (
 	StatusDegraded    StatusValue = "degraded"
 )
 
+// Condition types reported in the Nuxeo status
+const (
+	// Ready is true when all conditions below are true and all NodeSet replicas are available
+	ConditionReady = "Ready"
+	// BackingServicesResolved is true when all backing service resources were found and projected
+	ConditionBackingServicesResolved = "BackingServicesResolved"
+	// AccessReady is true when the Service and the Route/Ingress were reconciled
+	ConditionAccessReady = "AccessReady"
+	// StorageBound is true when all Operator-managed PVCs are bound
+	ConditionStorageBound = "StorageBound"
+	// ConfigRendered is true when nuxeo.conf, CLID, and contributions were reconciled
+	ConditionConfigRendered = "ConfigRendered"
+)
+
+// NuxeoCondition describes one aspect of the observed state of a Nuxeo cluster. This has the same shape as the
+// upstream metav1.Condition so that standard tooling like 'kubectl wait --for=condition=Ready' works
+type NuxeoCondition struct {
+	// Type of condition, e.g. Ready
+	Type string `json:"type"`
+
+	// Status of the condition, one of True, False, Unknown
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status metav1.ConditionStatus `json:"status"`
+
+	// The generation of the Nuxeo CR that the condition was set from
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// The last time the condition transitioned from one status to another
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+
+	// A CamelCase reason for the condition's last transition
+	Reason string `json:"reason"`
+
+	// A human readable message indicating details about the transition
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// RolloutState summarizes the rollout of a NodeSet's Deployment
+type RolloutState string
+
+const (
+	RolloutComplete    RolloutState = "Complete"
+	RolloutProgressing RolloutState = "Progressing"
+	RolloutStalled     RolloutState = "Stalled"
+)
+
+// NodeSetStatus defines the observed state of one NodeSet in a Nuxeo cluster
+type NodeSetStatus struct {
+	// The name of the NodeSet
+	Name string `json:"name"`
+
+	// The name of the Deployment or StatefulSet generated by the Operator from the NodeSet
+	DeploymentName string `json:"deploymentName"`
+
+	// The kind of workload generated by the Operator from the NodeSet
+	// +optional
+	WorkloadType WorkloadType `json:"workloadType,omitempty"`
+
+	// True if this is the interactive NodeSet
+	// +optional
+	Interactive bool `json:"interactive,omitempty"`
+
+	// The number of replicas specified in the NodeSet
+	DesiredReplicas int32 `json:"desiredReplicas"`
+
+	// The number of ready replicas in the Deployment
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// The number of replicas in the Deployment that have the current pod template
+	// +optional
+	UpdatedReplicas int32 `json:"updatedReplicas,omitempty"`
+
+	// The number of available replicas in the Deployment
+	// +optional
+	AvailableReplicas int32 `json:"availableReplicas,omitempty"`
+
+	// The hash of the Operator-managed nuxeo.conf currently in the Deployment pod template, if any
+	// +optional
+	NuxeoConfHash string `json:"nuxeoConfHash,omitempty"`
+
+	// The nuxeo.conf properties of the NodeSet that were set more than once with different values, and which
+	// source took precedence
+	// +optional
+	NuxeoConfConflicts []string `json:"nuxeoConfConflicts,omitempty"`
+
+	// The rollout state of the Deployment
+	// +optional
+	Rollout RolloutState `json:"rollout,omitempty"`
+
+	// The health of the NodeSet
+	// +optional
+	Status StatusValue `json:"status,omitempty"`
+}
+
 // NuxeoStatus defines the observed state of a Nuxeo cluster
 type NuxeoStatus struct {
 	DesiredNodes   int32       `json:"desiredNodes,omitempty"`
 	AvailableNodes int32       `json:"availableNodes,omitempty"`
 	Status         StatusValue `json:"status,omitempty"`
+
+	// The desired number of Pods in the interactive NodeSet. Supports the scale subresource
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// The label selector for the interactive NodeSet Pods. Supports the scale subresource
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// The observed state of each NodeSet. The top-level status is derived from these: if the interactive
+	// NodeSet is unavailable then the cluster is unavailable
+	// +optional
+	NodeSets []NodeSetStatus `json:"nodeSets,omitempty"`
+
+	// The generation of the Nuxeo CR most recently reconciled by the Operator
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describing the observed state of the Nuxeo cluster. These are populated even if
+	// reconciliation fails
+	// +optional
+	Conditions []NuxeoCondition `json:"conditions,omitempty"`
 }
 
 // Represents a Nuxeo Cluster
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:path=nuxeos,scope=Namespaced
 // +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
 // +kubebuilder:printcolumn:name="version",type="string",JSONPath=".spec.version"
 // +kubebuilder:printcolumn:name="health",type="string",JSONPath=".status.status"
 // +kubebuilder:printcolumn:name="available",type="integer",JSONPath=".status.availableNodes"
 // +kubebuilder:printcolumn:name="desired",type="integer",JSONPath=".status.desiredNodes"
+// +kubebuilder:printcolumn:name="ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
 type Nuxeo struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -20,6 +20,45 @@ const (
 	ClidHashAnnotation      = "appzygy.net/clid"
 	NuxeoConfHashAnnotation = "appzygy.net/nuxeo-conf"
 	BackingSvcAnnotation    = "appzygy.net/backing"
+	// marks a Deployment whose replica count is managed outside of the Operator
+	ExternalReplicasAnnotation = "appzygy.net/external-replicas"
+	// if "true" on a resource generated for a NodeSet, the Operator does not remove the resource when the NodeSet
+	// is removed from the Nuxeo CR. Set by the user, so not included in NuxeoAnnotations
+	OrphanProtectAnnotation = "appzygy.net/orphan-protect"
+	// the seccomp profile of a Pod. Applied by the Operator with the 'Restricted' security profile unless already
+	// specified in the Pod annotations. Since the value may come from elsewhere, not included in NuxeoAnnotations
+	SeccompAnnotation = "seccomp.security.alpha.kubernetes.io/pod"
+	// the image pull secrets that the Operator added to a service account
+	ImagePullSecretsAnnotation = "appzygy.net/image-pull-secrets"
+	// the keys of the Pod annotations from the Nuxeo CR that the Operator applied to a Pod template
+	PodAnnotationsAnnotation = "appzygy.net/pod-annotations"
+	// the nuxeo.conf properties that were set more than once with different values, on the nuxeo.conf ConfigMap
+	NuxeoConfConflictsAnnotation = "appzygy.net/nuxeo-conf-conflicts"
+	// the content hashes of the ConfigMaps and Secrets referenced by a NodeSet, on the Pod template
+	ReferencesAnnotation = "appzygy.net/references"
+	// the values that the defaulting webhook derived from other fields of a Nuxeo CR, on the Nuxeo CR. Not applied
+	// to generated resources, so not included in NuxeoAnnotations
+	DerivedDefaultsAnnotation = "appzygy.net/derived-defaults"
+	// the effective retention policy of a PVC generated by the Operator, recorded on the PVC so that it is honoured
+	// after the storage is removed from the Nuxeo CR
+	RetentionPolicyAnnotation = "appzygy.net/retention-policy"
 )
 
-var NuxeoAnnotations = []string{ClidHashAnnotation, NuxeoConfHashAnnotation, BackingSvcAnnotation}
+// releases the retained PVCs of a Nuxeo CR before the Nuxeo CR is deleted
+const PvcRetentionFinalizer = "appzygy.net/pvc-retention"
+
+const (
+	// identifies the Nuxeo CR that a resource was generated for
+	NuxeoCrLabel = "nuxeoCr"
+	// identifies the NodeSet that a resource was generated for
+	NodeSetLabel = "nodeSet"
+	// Kubernetes recommended labels
+	AppNameLabel      = "app.kubernetes.io/name"
+	AppInstanceLabel  = "app.kubernetes.io/instance"
+	AppComponentLabel = "app.kubernetes.io/component"
+	AppManagedByLabel = "app.kubernetes.io/managed-by"
+)
+
+var NuxeoAnnotations = []string{ClidHashAnnotation, NuxeoConfHashAnnotation, BackingSvcAnnotation,
+	ExternalReplicasAnnotation, ImagePullSecretsAnnotation, PodAnnotationsAnnotation,
+	NuxeoConfConflictsAnnotation, ReferencesAnnotation}
@@ -152,7 +152,8 @@ func (r *NuxeoReconciler) projectEnvVal(namespace string, resource v1alpha1.Back
 	if err != nil {
 		return err
 	} else if val == nil {
-		return fmt.Errorf("resource %v does not have value for path %v", resource.Name, projection.From)
+		return withCondition(v1alpha1.ConditionBackingServicesResolved, "BackingResourceNotFound",
+			fmt.Errorf("resource %v does not have value for path %v", resource.Name, projection.From))
 	}
 	env.Value = string(val)
 	if nuxeoContainer, err := GetNuxeoContainer(dep); err != nil {
@@ -490,7 +491,7 @@ func isConfigMap(resource v1alpha1.BackingServiceResource) bool {
 func (r *NuxeoReconciler) reconcileSecondary(instance *v1alpha1.Nuxeo, secondarySecret *corev1.Secret) error {
 	if len(secondarySecret.Data)+len(secondarySecret.StringData) != 0 {
 		// secondary secret has content so it should exist in the cluster
-		_, err := r.addOrUpdate(secondarySecret.Name, instance.Namespace, secondarySecret, &corev1.Secret{},
+		_, err := r.addOrUpdate(instance, secondarySecret.Name, instance.Namespace, secondarySecret, &corev1.Secret{},
 			util.SecretComparer)
 		return err
 	} else {
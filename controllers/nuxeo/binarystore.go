@@ -0,0 +1,214 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	s3Package              = "amazon-s3-online-storage"
+	s3Template             = "s3binaries"
+	s3AccessKeyIdKey       = "accessKeyId"
+	s3SecretAccessKeyKey   = "secretAccessKey"
+	s3CaBundleKey          = "ca.crt"
+	s3CaBundleVolumeName   = "s3-ca-bundle"
+	s3CaBundlePath         = "/etc/s3-ca"
+	s3TrustStoreVolumeName = "s3-truststore"
+	s3TrustStorePath       = "/etc/pki/s3"
+	// the JVM default trust store password. The trust store only holds public certificates
+	s3TrustStorePassword = "changeit"
+)
+
+// s3TrustStoreScript builds a JKS trust store from the JVM default trust store plus the S3 CA bundle. It runs in
+// an init container using the Nuxeo image so the JVM default trust store and keytool are available.
+var s3TrustStoreScript = `set -e
+for f in "$JAVA_HOME/lib/security/cacerts" "$JAVA_HOME/jre/lib/security/cacerts"; do
+  if [ -f "$f" ]; then cp "$f" ` + s3TrustStorePath + `/truststore.jks; break; fi
+done
+keytool -importcert -noprompt -alias s3-ca -file ` + s3CaBundlePath + "/" + s3CaBundleKey + ` \
+  -keystore ` + s3TrustStorePath + `/truststore.jks -storepass ` + s3TrustStorePassword + `
+`
+
+// configureBinaryStore configures the passed Deployment for the binary store defined in the passed Nuxeo CR, if
+// any. For an S3 binary store, the amazon-s3-online-storage package and the s3binaries template are added to the
+// Nuxeo container, the credentials are projected into the Nuxeo container as environment variables from the
+// credentials Secret, and if a CA bundle is specified, an init container builds a JVM trust store holding the
+// CA. Returns the nuxeo.conf entries for the binary store, or an empty string if no binary store is defined.
+func (r *NuxeoReconciler) configureBinaryStore(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment) (string, error) {
+	if instance.Spec.BinaryStore == nil {
+		return "", nil
+	}
+	s3 := instance.Spec.BinaryStore.S3
+	if s3.Bucket == "" {
+		return "", fmt.Errorf("binary store S3 bucket is required")
+	}
+	nuxeoContainer, err := GetNuxeoContainer(dep)
+	if err != nil {
+		return "", err
+	}
+	if err := util.MergeOrAddEnvVar(nuxeoContainer, corev1.EnvVar{Name: "NUXEO_PACKAGES", Value: s3Package},
+		" "); err != nil {
+		return "", err
+	}
+	if err := util.MergeOrAddEnvVar(nuxeoContainer, corev1.EnvVar{Name: "NUXEO_TEMPLATES", Value: s3Template},
+		","); err != nil {
+		return "", err
+	}
+	if s3.CredentialsSecret != "" {
+		if err := r.validateBinaryStoreSecret(instance, s3.CredentialsSecret, s3AccessKeyIdKey,
+			s3SecretAccessKeyKey); err != nil {
+			return "", err
+		}
+		for _, env := range [][]string{
+			{"AWS_ACCESS_KEY_ID", s3AccessKeyIdKey},
+			{"AWS_SECRET_ACCESS_KEY", s3SecretAccessKeyKey},
+		} {
+			if err := util.OnlyAddEnvVar(nuxeoContainer, corev1.EnvVar{
+				Name: env[0],
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: s3.CredentialsSecret},
+						Key:                  env[1],
+					},
+				},
+			}); err != nil {
+				return "", err
+			}
+		}
+	}
+	if s3.CaBundleSecret != "" {
+		if err := r.validateBinaryStoreSecret(instance, s3.CaBundleSecret, s3CaBundleKey); err != nil {
+			return "", err
+		}
+		if err := configureS3TrustStore(dep, nuxeoContainer, s3.CaBundleSecret); err != nil {
+			return "", err
+		}
+	}
+	return s3NuxeoConf(s3), nil
+}
+
+// s3NuxeoConf renders the nuxeo.s3storage.* nuxeo.conf entries for the passed S3 binary store
+func s3NuxeoConf(s3 v1alpha1.S3BinaryStoreSpec) string {
+	conf := "nuxeo.s3storage.bucket=" + s3.Bucket + "\n"
+	if s3.Prefix != "" {
+		conf += "nuxeo.s3storage.bucket_prefix=" + s3.Prefix + "\n"
+	}
+	if s3.Region != "" {
+		conf += "nuxeo.s3storage.region=" + s3.Region + "\n"
+	}
+	if s3.Endpoint != "" {
+		conf += "nuxeo.s3storage.endpoint=" + s3.Endpoint + "\n"
+	}
+	if s3.PathStyleAccess {
+		conf += "nuxeo.s3storage.pathstyleaccess=true\n"
+	}
+	if s3.CredentialsSecret != "" {
+		conf += "nuxeo.s3storage.awsid=${env:AWS_ACCESS_KEY_ID}\n" +
+			"nuxeo.s3storage.awssecret=${env:AWS_SECRET_ACCESS_KEY}\n"
+	}
+	return conf
+}
+
+// configureS3TrustStore adds an init container to the passed Deployment that builds a JVM trust store from the
+// JVM default trust store plus the CA bundle in the passed Secret, and configures the JVM in the passed Nuxeo
+// container to use that trust store. Since the JVM supports only one trust store, an error is returned if the
+// Nuxeo container JVM is already configured with a trust store - e.g. from a JVM PKI secret.
+func configureS3TrustStore(dep *appsv1.Deployment, nuxeoContainer *corev1.Container, caBundleSecret string) error {
+	if javaOpts := util.GetEnv(nuxeoContainer, "JAVA_OPTS"); javaOpts != nil &&
+		strings.Contains(javaOpts.Value, "-Djavax.net.ssl.trustStore=") {
+		return fmt.Errorf("binary store S3 CA bundle cannot be combined with a JVM PKI trust store")
+	}
+	vols := []corev1.Volume{{
+		Name: s3CaBundleVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  caBundleSecret,
+				DefaultMode: util.Int32Ptr(420),
+				Items: []corev1.KeyToPath{{
+					Key:  s3CaBundleKey,
+					Path: s3CaBundleKey,
+				}},
+			},
+		},
+	}, {
+		Name: s3TrustStoreVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	}}
+	for _, vol := range vols {
+		if err := util.OnlyAddVol(dep, vol); err != nil {
+			return err
+		}
+	}
+	trustStoreMnt := corev1.VolumeMount{
+		Name:      s3TrustStoreVolumeName,
+		ReadOnly:  true,
+		MountPath: s3TrustStorePath,
+	}
+	if err := util.OnlyAddVolMnt(nuxeoContainer, trustStoreMnt); err != nil {
+		return err
+	}
+	trustStoreMnt.ReadOnly = false
+	initContainer := corev1.Container{
+		Name:            s3TrustStoreVolumeName,
+		Image:           nuxeoContainer.Image,
+		ImagePullPolicy: nuxeoContainer.ImagePullPolicy,
+		Command:         []string{"/bin/sh", "-c", s3TrustStoreScript},
+		VolumeMounts: []corev1.VolumeMount{trustStoreMnt, {
+			Name:      s3CaBundleVolumeName,
+			ReadOnly:  true,
+			MountPath: s3CaBundlePath,
+		}},
+		TerminationMessagePath:   "/dev/termination-log",
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+	// copy so the init containers from the Nuxeo CR are not modified
+	dep.Spec.Template.Spec.InitContainers = append(append([]corev1.Container{},
+		dep.Spec.Template.Spec.InitContainers...), initContainer)
+	return util.MergeOrAddEnvVar(nuxeoContainer, corev1.EnvVar{
+		Name: "JAVA_OPTS",
+		Value: "-Djavax.net.ssl.trustStore=" + s3TrustStorePath + "/truststore.jks" +
+			" -Djavax.net.ssl.trustStoreType=JKS" +
+			" -Djavax.net.ssl.trustStorePassword=" + s3TrustStorePassword,
+	}, " ")
+}
+
+// validateBinaryStoreSecret returns an error if the passed binary store Secret does not exist in the namespace of
+// the passed Nuxeo CR, or does not contain all of the passed keys
+func (r *NuxeoReconciler) validateBinaryStoreSecret(instance *v1alpha1.Nuxeo, secretName string, keys ...string) error {
+	secret := corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: instance.Namespace},
+		&secret); err != nil {
+		return fmt.Errorf("unable to get binary store secret '%v': %v", secretName, err)
+	}
+	for _, key := range keys {
+		if _, ok := secret.Data[key]; !ok {
+			return fmt.Errorf("binary store secret '%v' does not contain key '%v'", secretName, key)
+		}
+	}
+	return nil
+}
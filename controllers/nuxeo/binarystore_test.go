@@ -0,0 +1,204 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestS3BinaryStore tests that an S3 binary store adds the S3 package and template, projects the credentials from
+// the credentials Secret, and renders the S3 nuxeo.conf entries
+func (suite *binaryStoreSuite) TestS3BinaryStore() {
+	nux := suite.binaryStoreSuiteNewNuxeo()
+	err := suite.createSecret(suite.credsSecret, map[string][]byte{
+		"accessKeyId":     []byte("minio"),
+		"secretAccessKey": []byte("minio123"),
+	})
+	require.Nil(suite.T(), err)
+	dep := genTestDeploymentForBinaryStoreSuite()
+	nuxeoConf, err := suite.r.configureBinaryStore(nux, &dep)
+	require.Nil(suite.T(), err, "configureBinaryStore failed")
+	nuxeoContainer, _ := GetNuxeoContainer(&dep)
+	require.Equal(suite.T(), "nuxeo-web-ui amazon-s3-online-storage", util.GetEnv(nuxeoContainer, "NUXEO_PACKAGES").Value)
+	require.Equal(suite.T(), "s3binaries", util.GetEnv(nuxeoContainer, "NUXEO_TEMPLATES").Value)
+	awsId := util.GetEnv(nuxeoContainer, "AWS_ACCESS_KEY_ID")
+	require.NotNil(suite.T(), awsId, "AWS_ACCESS_KEY_ID should have been defined")
+	require.Equal(suite.T(), suite.credsSecret, awsId.ValueFrom.SecretKeyRef.Name)
+	require.Equal(suite.T(), "accessKeyId", awsId.ValueFrom.SecretKeyRef.Key)
+	require.NotNil(suite.T(), util.GetEnv(nuxeoContainer, "AWS_SECRET_ACCESS_KEY"),
+		"AWS_SECRET_ACCESS_KEY should have been defined")
+	expected := "nuxeo.s3storage.bucket=nuxeo-binaries\n" +
+		"nuxeo.s3storage.bucket_prefix=nuxeo/\n" +
+		"nuxeo.s3storage.endpoint=http://minio.minio:9000\n" +
+		"nuxeo.s3storage.pathstyleaccess=true\n" +
+		"nuxeo.s3storage.awsid=${env:AWS_ACCESS_KEY_ID}\n" +
+		"nuxeo.s3storage.awssecret=${env:AWS_SECRET_ACCESS_KEY}\n"
+	require.Equal(suite.T(), expected, nuxeoConf)
+}
+
+// TestS3MissingSecret tests that a credentials Secret that does not exist, or that is missing a key, is an error
+func (suite *binaryStoreSuite) TestS3MissingSecret() {
+	nux := suite.binaryStoreSuiteNewNuxeo()
+	dep := genTestDeploymentForBinaryStoreSuite()
+	_, err := suite.r.configureBinaryStore(nux, &dep)
+	require.NotNil(suite.T(), err, "Missing credentials Secret should have been an error")
+	err = suite.createSecret(suite.credsSecret, map[string][]byte{"accessKeyId": []byte("minio")})
+	require.Nil(suite.T(), err)
+	dep = genTestDeploymentForBinaryStoreSuite()
+	_, err = suite.r.configureBinaryStore(nux, &dep)
+	require.NotNil(suite.T(), err, "Missing secretAccessKey should have been an error")
+}
+
+// TestS3CaBundle tests that a CA bundle adds the trust store init container and configures the JVM trust store,
+// and that a CA bundle cannot be combined with a JVM PKI trust store
+func (suite *binaryStoreSuite) TestS3CaBundle() {
+	nux := suite.binaryStoreSuiteNewNuxeo()
+	nux.Spec.BinaryStore.S3.CredentialsSecret = ""
+	nux.Spec.BinaryStore.S3.CaBundleSecret = "minio-ca"
+	err := suite.createSecret("minio-ca", map[string][]byte{"ca.crt": []byte("-----BEGIN CERTIFICATE-----")})
+	require.Nil(suite.T(), err)
+	dep := genTestDeploymentForBinaryStoreSuite()
+	_, err = suite.r.configureBinaryStore(nux, &dep)
+	require.Nil(suite.T(), err, "configureBinaryStore failed")
+	require.Equal(suite.T(), 1, len(dep.Spec.Template.Spec.InitContainers), "Init container not defined")
+	require.Equal(suite.T(), "nuxeo:LTS-2019", dep.Spec.Template.Spec.InitContainers[0].Image)
+	require.Equal(suite.T(), 2, len(dep.Spec.Template.Spec.Volumes), "Volumes not correctly defined")
+	nuxeoContainer, _ := GetNuxeoContainer(&dep)
+	require.True(suite.T(), strings.Contains(util.GetEnv(nuxeoContainer, "JAVA_OPTS").Value,
+		"-Djavax.net.ssl.trustStore=/etc/pki/s3/truststore.jks"), "JVM trust store not configured")
+	dep = genTestDeploymentForBinaryStoreSuite()
+	nuxeoContainer, _ = GetNuxeoContainer(&dep)
+	nuxeoContainer.Env = append(nuxeoContainer.Env, corev1.EnvVar{
+		Name:  "JAVA_OPTS",
+		Value: "-Djavax.net.ssl.trustStore=/etc/pki/jvm/truststore.p12",
+	})
+	_, err = suite.r.configureBinaryStore(nux, &dep)
+	require.NotNil(suite.T(), err, "CA bundle with a JVM PKI trust store should have been an error")
+}
+
+// TestClusteringWithS3 tests that a clustered NodeSet does not require a Binaries storage if an S3 binary store
+// is configured, and that the clustering nuxeo.conf does not configure a filesystem binary store
+func (suite *binaryStoreSuite) TestClusteringWithS3() {
+	nux := suite.binaryStoreSuiteNewNuxeo()
+	nodeSet := nux.Spec.NodeSets[0]
+	nodeSet.ClusterEnabled = true
+	dep := genTestDeploymentForBinaryStoreSuite()
+	err := configureClustering(nux, &dep, nodeSet)
+	require.Nil(suite.T(), err, "configureClustering should accept an S3 binary store")
+	cm := suite.r.defaultNuxeoConfCM(nux, nodeSet, "", "", "")
+	require.False(suite.T(), strings.Contains(cm.Data[nuxeoConfName], "repository.binary.store"),
+		"nuxeo.conf should not configure a filesystem binary store")
+	nux.Spec.BinaryStore = nil
+	err = configureClustering(nux, &dep, nodeSet)
+	require.NotNil(suite.T(), err, "configureClustering should require a Binaries storage")
+}
+
+// binaryStoreSuite is the binary store test suite structure
+type binaryStoreSuite struct {
+	suite.Suite
+	r           NuxeoReconciler
+	nuxeoName   string
+	namespace   string
+	credsSecret string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *binaryStoreSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+	suite.credsSecret = "minio-creds"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *binaryStoreSuite) AfterTest(_, _ string) {
+	obj := corev1.Secret{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+}
+
+// This function runs the binary store unit test suite. It is called by 'go test' and will call every
+// function in this file with a binaryStoreSuite receiver that begins with "Test..."
+func TestBinaryStoreUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(binaryStoreSuite))
+}
+
+// binaryStoreSuiteNewNuxeo creates a test Nuxeo struct with an S3 binary store for a local MinIO
+func (suite *binaryStoreSuite) binaryStoreSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:     "test",
+				Replicas: 1,
+			}},
+			BinaryStore: &v1alpha1.BinaryStoreSpec{
+				S3: v1alpha1.S3BinaryStoreSpec{
+					Bucket:            "nuxeo-binaries",
+					Prefix:            "nuxeo/",
+					Endpoint:          "http://minio.minio:9000",
+					PathStyleAccess:   true,
+					CredentialsSecret: suite.credsSecret,
+				},
+			},
+		},
+	}
+}
+
+// createSecret creates a Secret in the suite namespace with the passed name and data
+func (suite *binaryStoreSuite) createSecret(name string, data map[string][]byte) error {
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: suite.namespace,
+		},
+		Data: data,
+	}
+	return suite.r.Create(context.TODO(), &secret)
+}
+
+// genTestDeploymentForBinaryStoreSuite creates a Deployment with a Nuxeo container that has a package defined
+func genTestDeploymentForBinaryStoreSuite() appsv1.Deployment {
+	return appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "nuxeo",
+						Image: "nuxeo:LTS-2019",
+						Env: []corev1.EnvVar{{
+							Name:  "NUXEO_PACKAGES",
+							Value: "nuxeo-web-ui",
+						}},
+					}},
+				},
+			},
+		},
+	}
+}
@@ -30,6 +30,8 @@ import (
 )
 
 const (
+	// the name of the CLID ConfigMap generated by prior versions of the Operator, which is also used as the name
+	// of the CLID volume in the Nuxeo Pod
 	nuxeoClidConfigMapName = "nuxeo-clid"
 	clidKey                = "instance.clid"
 	clidSeparator          = "--"
@@ -37,8 +39,8 @@ const (
 
 // configureClid configures the passed Deployment with a Volume and VolumeMount to project the CLID into the
 // Nuxeo container at a hard-coded mount point: /var/lib/nuxeo/data/instance.clid. The volume references
-// a hard-coded ConfigMap name managed by the operator: "nuxeo-clid". See the reconcileClid() function
-// for the code that reconciles that actual ConfigMap.
+// a ConfigMap managed by the operator, named from the Nuxeo CR. E.g.: "my-nuxeo-clid". See the reconcileClid()
+// function for the code that reconciles that actual ConfigMap.
 func configureClid(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment) error {
 	if instance.Spec.Clid == "" {
 		return nil
@@ -60,7 +62,7 @@ func configureClid(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment) error {
 		}
 		vol.ConfigMap = &corev1.ConfigMapVolumeSource{
 			DefaultMode:          util.Int32Ptr(420),
-			LocalObjectReference: corev1.LocalObjectReference{Name: nuxeoClidConfigMapName},
+			LocalObjectReference: corev1.LocalObjectReference{Name: clidConfigMapName(instance)},
 			Items: []corev1.KeyToPath{{
 				Key:  clidKey,
 				Path: clidKey,
@@ -73,22 +75,31 @@ func configureClid(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment) error {
 
 // reconcileClid creates, updates, or deletes the CLID ConfigMap. If the Clid is specified in the CR, then the
 // corresponding CM is added/updated in the cluster. If Clid is not specified, then it is removed from the
-// cluster if present
+// cluster if present. In either case, if the legacy un-scoped CLID ConfigMap generated by a prior version of
+// the Operator is owned by the Nuxeo CR, it is removed.
 func (r *NuxeoReconciler) reconcileClid(instance *v1alpha1.Nuxeo) error {
+	cmName := clidConfigMapName(instance)
+	if cmName != nuxeoClidConfigMapName {
+		// a Nuxeo CR named 'nuxeo' generates the legacy name
+		if err := r.removeIfPresent(instance, nuxeoClidConfigMapName, instance.Namespace,
+			&corev1.ConfigMap{}); err != nil {
+			return err
+		}
+	}
 	if instance.Spec.Clid != "" {
 		if expected, err := r.defaultClidCM(instance, instance.Spec.Clid); err != nil {
 			return err
 		} else {
-			_, err := r.addOrUpdate(nuxeoClidConfigMapName, instance.Namespace, expected, &corev1.ConfigMap{},
+			_, err := r.addOrUpdate(instance, cmName, instance.Namespace, expected, &corev1.ConfigMap{},
 				util.ConfigMapComparer)
 			return err
 		}
 	} else {
-		return r.removeIfPresent(instance, nuxeoClidConfigMapName, instance.Namespace, &corev1.ConfigMap{})
+		return r.removeIfPresent(instance, cmName, instance.Namespace, &corev1.ConfigMap{})
 	}
 }
 
-// defaultClidCM creates and returns a ConfigMap struct named "nuxeo-clid" to hold the passed CLID string. The CLID
+// defaultClidCM creates and returns a ConfigMap struct named from the Nuxeo CR to hold the passed CLID string. The CLID
 // string has to conform to the format that you would get from the Nuxeo registration site. Specifically it has to
 // contain the double dash separator that Nuxeo uses to split the single CLID into two lines. This function will
 // split the clid and newline format it so it has the correct two-line format in the CLID file.
@@ -99,7 +110,7 @@ func (r *NuxeoReconciler) defaultClidCM(instance *v1alpha1.Nuxeo, clidValue stri
 	}
 	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      nuxeoClidConfigMapName,
+			Name:      clidConfigMapName(instance),
 			Namespace: instance.Namespace,
 		},
 		Data: map[string]string{clidKey: strings.Replace(clidValue, clidSeparator, "\n", 1)},
@@ -107,3 +118,9 @@ func (r *NuxeoReconciler) defaultClidCM(instance *v1alpha1.Nuxeo, clidValue stri
 	_ = controllerutil.SetControllerReference(instance, cm, r.Scheme)
 	return cm, nil
 }
+
+// clidConfigMapName generates the name of the CLID ConfigMap for the passed Nuxeo CR: the Nuxeo CR name + dash +
+// 'clid'. E.g.: 'my-nuxeo-clid'.
+func clidConfigMapName(instance *v1alpha1.Nuxeo) string {
+	return instance.Name + "-clid"
+}
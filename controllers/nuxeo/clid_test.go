@@ -61,12 +61,12 @@ func (suite *clidSuite) TestClidReconcile() {
 	err := suite.r.reconcileClid(nux)
 	require.Nil(suite.T(), err)
 	cm := &corev1.ConfigMap{}
-	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: nuxeoClidConfigMapName, Namespace: suite.namespace}, cm)
+	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: clidConfigMapName(nux), Namespace: suite.namespace}, cm)
 	require.Nil(suite.T(), err, "Should have created a CLID CM")
 	nux.Spec.Clid = ""
 	err = suite.r.reconcileClid(nux)
 	require.Nil(suite.T(), err)
-	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: nuxeoClidConfigMapName, Namespace: suite.namespace}, cm)
+	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: clidConfigMapName(nux), Namespace: suite.namespace}, cm)
 	require.True(suite.T(), apierrors.IsNotFound(err), "Should have removed the CLID CM")
 }
 
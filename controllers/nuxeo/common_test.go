@@ -23,6 +23,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
@@ -38,6 +39,8 @@ func initUnitTestReconcile() NuxeoReconciler {
 		Client: cl,
 		Scheme: s,
 		Log:    log.Log.WithName("controller_nuxeo"),
+		// a FakeRecorder with a nil Events channel discards events
+		Recorder: &record.FakeRecorder{},
 	}
 	if err := r.registerOpenShiftRoute(); err != nil {
 		log.Log.Error(err, "registerOpenShiftRoute failed")
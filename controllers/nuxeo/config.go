@@ -30,6 +30,11 @@ import (
 const (
 	nuxeoConfVolumeName = "nuxeo-conf"
 	nuxeoConfName       = "nuxeo.conf"
+	// the prefix of the environment variables that hold the values of nuxeo.conf secret properties
+	secretPropertyEnvPrefix = "NUXEO_CONF_"
+	// the environment variables that hold the JVM PKI key store and trust store passwords
+	jvmPkiKeyStorePasswordEnv   = "JVM_PKI_KEY_STORE_PASSWORD"
+	jvmPkiTrustStorePasswordEnv = "JVM_PKI_TRUST_STORE_PASSWORD"
 )
 
 // configureConfig examines the NuxeoConfig field of the passed NodeSet and configures the passed Deployment accordingly
@@ -63,6 +68,9 @@ func configureConfig(dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet, jvmPkiSec
 	if err := configureOfflinePackages(dep, nuxeoContainer, nodeSet); err != nil {
 		return err
 	}
+	if err := configureSecretProperties(nuxeoContainer, nodeSet); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -71,7 +79,7 @@ func configureConfig(dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet, jvmPkiSec
 func configureJavaOpts(nuxeoContainer *corev1.Container, nodeSet v1alpha1.NodeSet) error {
 	env := corev1.EnvVar{
 		Name:  "JAVA_OPTS",
-		Value: "-XX:+UnlockExperimentalVMOptions -XX:+UseCGroupMemoryLimitForHeap -XX:MaxRAMFraction=1",
+		Value: defaultJavaOpts,
 	}
 	if nodeSet.NuxeoConfig.JavaOpts != "" {
 		env.Value = nodeSet.NuxeoConfig.JavaOpts
@@ -132,22 +140,16 @@ func configureNuxeoEnvName(nuxeoContainer *corev1.Container, nodeSet v1alpha1.No
 }
 
 // configureNuxeoConf handles the nuxeo.conf configuration from the Nuxeo CR. The function initializes a
-// volume mount, and a config map volume to reference a cluster resource holding nuxeo.conf content. This function
-// only configures the volume and volume mount in the deployment. See the reconcileNuxeoConf function for the
-// code that reconciles the actual ConfigMap resource. If the nodeSet.NuxeoConfig.NuxeoConf.ValueFrom
-// field is initialized then the volume and mount are still initialized here, but the volume source is
-// expected to have been provided by the configurer, external to the operator.
+// volume mount, and a config map volume to reference the Operator-managed ConfigMap holding nuxeo.conf content.
+// This function only configures the volume and volume mount in the deployment. See the reconcileNuxeoConf function
+// for the code that reconciles the actual ConfigMap resource - including merging the content of an external
+// nuxeo.conf from the nodeSet.NuxeoConfig.NuxeoConf.ValueFrom field.
 func configureNuxeoConf(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet,
 	backingNuxeoConf string, tlsNuxeoConf string) error {
-	if !shouldReconNuxeoConf(nodeSet, backingNuxeoConf, tlsNuxeoConf) &&
-		nodeSet.NuxeoConfig.NuxeoConf.ValueFrom == (corev1.VolumeSource{}) {
+	if !shouldReconNuxeoConf(nodeSet, backingNuxeoConf, tlsNuxeoConf) {
 		// there is no nuxeo.conf configuration anywhere in the CR
 		return nil
 	}
-	if shouldReconNuxeoConf(nodeSet, backingNuxeoConf, tlsNuxeoConf) &&
-		nodeSet.NuxeoConfig.NuxeoConf.ValueFrom != (corev1.VolumeSource{}) {
-		return fmt.Errorf("external nuxeo.conf volume source clashes with operator-managed nuxeo.conf")
-	}
 	if nodeSet.NuxeoConfig.NuxeoConf.ValueFrom != (corev1.VolumeSource{}) &&
 		nodeSet.NuxeoConfig.NuxeoConf.ValueFrom.ConfigMap == nil &&
 		nodeSet.NuxeoConfig.NuxeoConf.ValueFrom.Secret == nil {
@@ -164,39 +166,77 @@ func configureNuxeoConf(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment, nodeSe
 	} else if err := addVolMnt(nuxeoContainer, volMnt); err != nil {
 		return err
 	}
-	vol := corev1.Volume{
-		Name: nuxeoConfVolumeName,
-	}
-	if shouldReconNuxeoConf(nodeSet, backingNuxeoConf, tlsNuxeoConf) {
-		cmName := nuxeoConfCMName(instance, nodeSet.Name)
-		vol.ConfigMap = &corev1.ConfigMapVolumeSource{
+	cmName := nuxeoConfCMName(instance, nodeSet.Name)
+	items := []corev1.KeyToPath{{
+		Key:  nuxeoConfName,
+		Path: nuxeoConfName,
+	}}
+	vol := corev1.Volume{Name: nuxeoConfVolumeName}
+	if nuxeoConfInSecret(nodeSet) {
+		vol.VolumeSource.Secret = &corev1.SecretVolumeSource{
+			DefaultMode: util.Int32Ptr(420),
+			SecretName:  cmName,
+			Items:       items,
+		}
+	} else {
+		vol.VolumeSource.ConfigMap = &corev1.ConfigMapVolumeSource{
 			DefaultMode:          util.Int32Ptr(420),
 			LocalObjectReference: corev1.LocalObjectReference{Name: cmName},
-			Items: []corev1.KeyToPath{{
-				Key:  nuxeoConfName,
-				Path: nuxeoConfName,
-			}},
+			Items:                items,
 		}
-	} else {
-		// configurer is responsible to ensure that nuxeo.conf key is present in the config map volume
-		// source or secret volume source.
-		vol.VolumeSource = nodeSet.NuxeoConfig.NuxeoConf.ValueFrom
 	}
 	return util.OnlyAddVol(dep, vol)
 }
 
+// configureSecretProperties defines an environment variable in the passed container for each secret property in
+// the passed NodeSet, that gets its value from the Secret key referenced by the property. The reconcileNuxeoConf
+// function renders each secret property into nuxeo.conf as a reference to its environment variable, so the value
+// is never written to the nuxeo.conf ConfigMap. The environment variable name is derived from the nuxeo.conf key,
+// and it is an error if the name is already defined in the container.
+func configureSecretProperties(nuxeoContainer *corev1.Container, nodeSet v1alpha1.NodeSet) error {
+	for _, prop := range nodeSet.NuxeoConfig.SecretProperties {
+		env := corev1.EnvVar{
+			Name: secretPropertyEnvVar(prop.Key),
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: prop.SecretKeyRef.DeepCopy(),
+			},
+		}
+		if err := util.OnlyAddEnvVar(nuxeoContainer, env); err != nil {
+			return fmt.Errorf("secret property %v: %v", prop.Key, err)
+		}
+	}
+	return nil
+}
+
+// secretPropertyEnvVar returns the name of the environment variable that holds the value of the secret property
+// with the passed nuxeo.conf key: the key in upper case with every character that is not valid in an environment
+// variable name replaced by an underscore, and prefixed. E.g.: 'nuxeo.db.password' -> 'NUXEO_CONF_NUXEO_DB_PASSWORD'
+func secretPropertyEnvVar(key string) string {
+	return secretPropertyEnvPrefix + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		} else if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
 // configureJvmPki adds a new - or appends to an existing - JAVA_OPTS env var in the passed container's env var
 // array based on the contents of the passed secret. The secret is expected to have been provided by the configurer.
 // The function looks at the following keys in the secret: keyStore, keyStoreType, keyStorePassword, trustStore,
 // trustStoreType and trustStorePassword and sets the corresponding -Djavax.net.ssl... variables accordingly. For
 // the keystore and truststore components of the secret, volumes and volume mounts are created like
 // /etc/pki/jvm/keystore.??? and /etc/pki/jvm/truststore.??? with extensions based on store type. If no store
-// type is populated in the secret then the store file will have no extension.
+// type is populated in the secret then the store file will have no extension. The store passwords are not
+// copied into the Deployment: each is defined as an environment variable from the secret with secretKeyRef, which
+// JAVA_OPTS references as $(VAR) so that Kubernetes substitutes the password when the container is started.
 func configureJvmPki(dep *appsv1.Deployment, nuxeoContainer *corev1.Container, jvmPkiSecret corev1.Secret) error {
 	if jvmPkiSecret.Name == "" {
 		return nil
 	}
 	optVal, keystoreType, truststoreType, trustStoreName, keyStoreName := "", "", "", "", ""
+	var passwordEnvs []corev1.EnvVar
 
 	// key store
 	if val, ok := jvmPkiSecret.Data["keyStoreType"]; ok {
@@ -207,8 +247,10 @@ func configureJvmPki(dep *appsv1.Deployment, nuxeoContainer *corev1.Container, j
 		keyStoreName = "keystore" + storeTypeToFileExtension(keystoreType)
 		optVal += " -Djavax.net.ssl.keyStore=/etc/pki/jvm/" + keyStoreName
 	}
-	if val, ok := jvmPkiSecret.Data["keyStorePassword"]; ok {
-		optVal += " -Djavax.net.ssl.keyStorePassword=" + string(val)
+	if _, ok := jvmPkiSecret.Data["keyStorePassword"]; ok {
+		optVal += " -Djavax.net.ssl.keyStorePassword=$(" + jvmPkiKeyStorePasswordEnv + ")"
+		passwordEnvs = append(passwordEnvs, jvmPkiPasswordEnvVar(jvmPkiKeyStorePasswordEnv, jvmPkiSecret.Name,
+			"keyStorePassword"))
 	}
 
 	// trust store
@@ -220,8 +262,10 @@ func configureJvmPki(dep *appsv1.Deployment, nuxeoContainer *corev1.Container, j
 		trustStoreName = "truststore" + storeTypeToFileExtension(truststoreType)
 		optVal += " -Djavax.net.ssl.trustStore=/etc/pki/jvm/" + trustStoreName
 	}
-	if val, ok := jvmPkiSecret.Data["trustStorePassword"]; ok {
-		optVal += " -Djavax.net.ssl.trustStorePassword=" + string(val)
+	if _, ok := jvmPkiSecret.Data["trustStorePassword"]; ok {
+		optVal += " -Djavax.net.ssl.trustStorePassword=$(" + jvmPkiTrustStorePasswordEnv + ")"
+		passwordEnvs = append(passwordEnvs, jvmPkiPasswordEnvVar(jvmPkiTrustStorePasswordEnv, jvmPkiSecret.Name,
+			"trustStorePassword"))
 	}
 	env := corev1.EnvVar{
 		Name:  "JAVA_OPTS",
@@ -230,6 +274,12 @@ func configureJvmPki(dep *appsv1.Deployment, nuxeoContainer *corev1.Container, j
 	if err := util.MergeOrAddEnvVar(nuxeoContainer, env, " "); err != nil {
 		return err
 	}
+	// the password env vars must precede JAVA_OPTS for Kubernetes to expand the $(VAR) references
+	for _, passwordEnv := range passwordEnvs {
+		if err := util.OnlyAddEnvVarBefore(nuxeoContainer, passwordEnv, "JAVA_OPTS"); err != nil {
+			return err
+		}
+	}
 	// create a volume and volume mount for the keystore/truststore if defined
 	if keyStoreName != "" || trustStoreName != "" {
 		jvmPkiVolMnt := corev1.VolumeMount{
@@ -267,6 +317,20 @@ func configureJvmPki(dep *appsv1.Deployment, nuxeoContainer *corev1.Container, j
 	return nil
 }
 
+// jvmPkiPasswordEnvVar returns an environment variable with the passed name whose value is the passed key of the
+// passed JVM PKI secret
+func jvmPkiPasswordEnvVar(name string, secretName string, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
+
 // Given "PKCS12" (or "pkcs12"), returns ".p12", else returns storeType in lower case prefixed with a period.
 // E.g. given "FOO", returns ".foo". Given "", returns "". Note that the file name of the store
 // is irrelevant to Java, but by convention, most folks would expect to see .p12 or .jks in the container.
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	appsv1 "k8s.io/api/apps/v1"
@@ -64,6 +65,54 @@ func (suite *nuxeoConfigSuite) TestBasicConfig() {
 		"Volumes not correctly defined")
 }
 
+// TestJvmPkiPasswords tests that the JVM PKI store passwords are referenced in JAVA_OPTS through environment
+// variables from the JVM PKI secret that are defined ahead of JAVA_OPTS, rather than copied into JAVA_OPTS
+func (suite *nuxeoConfigSuite) TestJvmPkiPasswords() {
+	nux := suite.nuxeoConfigSuiteNewNuxeo()
+	dep := genTestDeploymentForConfigSuite()
+	sec := genTestJvmPkiSecret()
+	err := configureConfig(&dep, nux.Spec.NodeSets[0], sec)
+	require.Nil(suite.T(), err, "configureConfig failed")
+	env := dep.Spec.Template.Spec.Containers[0].Env
+	require.Equal(suite.T(), jvmPkiKeyStorePasswordEnv, env[0].Name)
+	require.Equal(suite.T(), jvmPkiTrustStorePasswordEnv, env[1].Name)
+	require.Equal(suite.T(), "JAVA_OPTS", env[2].Name)
+	require.Equal(suite.T(), &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: sec.Name},
+		Key:                  "trustStorePassword",
+	}}, env[1].ValueFrom)
+	require.True(suite.T(), strings.Contains(env[2].Value,
+		"-Djavax.net.ssl.keyStorePassword=$("+jvmPkiKeyStorePasswordEnv+")"))
+	require.False(suite.T(), strings.Contains(env[2].Value, string(sec.Data["keyStorePassword"])),
+		"password should not be in JAVA_OPTS")
+}
+
+// TestSecretProperties tests that each secret property defines an environment variable from its Secret key, and
+// that secret properties whose keys map to the same environment variable are an error
+func (suite *nuxeoConfigSuite) TestSecretProperties() {
+	nux := suite.nuxeoConfigSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].NuxeoConfig.SecretProperties = []v1alpha1.SecretProperty{{
+		Key: "nuxeo.db.password",
+		SecretKeyRef: corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "db-secret"},
+			Key:                  "password",
+		},
+	}}
+	dep := genTestDeploymentForConfigSuite()
+	err := configureConfig(&dep, nux.Spec.NodeSets[0], corev1.Secret{})
+	require.Nil(suite.T(), err)
+	env := util.GetEnv(&dep.Spec.Template.Spec.Containers[0], "NUXEO_CONF_NUXEO_DB_PASSWORD")
+	require.NotNil(suite.T(), env, "Secret property environment variable not defined")
+	require.Equal(suite.T(), "", env.Value)
+	require.Equal(suite.T(), nux.Spec.NodeSets[0].NuxeoConfig.SecretProperties[0].SecretKeyRef,
+		*env.ValueFrom.SecretKeyRef)
+	nux.Spec.NodeSets[0].NuxeoConfig.SecretProperties = append(nux.Spec.NodeSets[0].NuxeoConfig.SecretProperties,
+		v1alpha1.SecretProperty{Key: "nuxeo.db-password"})
+	dep = genTestDeploymentForConfigSuite()
+	err = configureConfig(&dep, nux.Spec.NodeSets[0], corev1.Secret{})
+	require.NotNil(suite.T(), err, "Environment variable collision should have been an error")
+}
+
 // nuxeoConfigSuite is the NuxeoConfig test suite structure
 type nuxeoConfigSuite struct {
 	suite.Suite
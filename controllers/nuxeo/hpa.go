@@ -0,0 +1,126 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// the target CPU utilization the Kubernetes HPA controller uses if an HPA has no metrics. It's made explicit
+// here so that the HPA generated by the Operator matches the HPA that comes back from the cluster
+const defaultTargetCPUUtilization = 80
+
+// reconcileHpa reconciles the HorizontalPodAutoscaler for the passed NodeSet. If the NodeSet specifies
+// autoscaling then an HPA targeting the NodeSet Deployment is created or updated. Otherwise, any HPA
+// previously generated for the NodeSet is removed.
+func (r *NuxeoReconciler) reconcileHpa(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) error {
+	hpaName := hpaName(instance, nodeSet)
+	if nodeSet.Autoscaling == nil {
+		return r.removeIfPresent(instance, hpaName, instance.Namespace,
+			&autoscalingv2beta2.HorizontalPodAutoscaler{})
+	}
+	expected := r.defaultHpa(instance, hpaName, nodeSet)
+	_, err := r.addOrUpdate(instance, hpaName, instance.Namespace, expected,
+		&autoscalingv2beta2.HorizontalPodAutoscaler{}, util.HpaComparer)
+	return err
+}
+
+// hpaMinReplicas returns the minReplicas of the HPA for the passed autoscaled NodeSet: the autoscaling minReplicas
+// if specified, otherwise the NodeSet replicas but not less than one, which is the least that an HPA supports
+func hpaMinReplicas(nodeSet v1alpha1.NodeSet) int32 {
+	if nodeSet.Autoscaling.MinReplicas != nil {
+		return *nodeSet.Autoscaling.MinReplicas
+	}
+	if nodeSet.Replicas < 1 {
+		return 1
+	}
+	return nodeSet.Replicas
+}
+
+// defaultHpa generates an HPA targeting the Deployment (or StatefulSet) of the passed NodeSet from the autoscaling
+// configuration in the NodeSet. The CPU and memory targets are added as Resource metrics, followed by any additional
+// metrics in the NodeSet. If no metrics result, the Kubernetes default CPU target is used.
+func (r *NuxeoReconciler) defaultHpa(instance *v1alpha1.Nuxeo, hpaName string,
+	nodeSet v1alpha1.NodeSet) *autoscalingv2beta2.HorizontalPodAutoscaler {
+	autoscaling := nodeSet.Autoscaling
+	minReplicas := util.Int32Ptr(hpaMinReplicas(nodeSet))
+	var metrics []autoscalingv2beta2.MetricSpec
+	if autoscaling.TargetCPUUtilizationPercentage != nil {
+		metrics = append(metrics, resourceMetric(corev1.ResourceCPU, *autoscaling.TargetCPUUtilizationPercentage))
+	}
+	if autoscaling.TargetMemoryUtilizationPercentage != nil {
+		metrics = append(metrics, resourceMetric(corev1.ResourceMemory,
+			*autoscaling.TargetMemoryUtilizationPercentage))
+	}
+	for _, metric := range autoscaling.Metrics {
+		metrics = append(metrics, *metric.DeepCopy())
+	}
+	if len(metrics) == 0 {
+		metrics = append(metrics, resourceMetric(corev1.ResourceCPU, defaultTargetCPUUtilization))
+	}
+	hpa := &autoscalingv2beta2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hpaName,
+			Namespace: instance.Namespace,
+			Labels:    nodeSetLabels(instance, nodeSet),
+		},
+		Spec: autoscalingv2beta2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2beta2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       workloadKind(nodeSet),
+				Name:       deploymentName(instance, nodeSet),
+			},
+			MinReplicas: minReplicas,
+			MaxReplicas: autoscaling.MaxReplicas,
+			Metrics:     metrics,
+		},
+	}
+	_ = controllerutil.SetControllerReference(instance, hpa, r.Scheme)
+	return hpa
+}
+
+// resourceMetric returns a Resource metric with an average utilization target for the passed resource
+func resourceMetric(resource corev1.ResourceName, utilization int32) autoscalingv2beta2.MetricSpec {
+	return autoscalingv2beta2.MetricSpec{
+		Type: autoscalingv2beta2.ResourceMetricSourceType,
+		Resource: &autoscalingv2beta2.ResourceMetricSource{
+			Name: resource,
+			Target: autoscalingv2beta2.MetricTarget{
+				Type:               autoscalingv2beta2.UtilizationMetricType,
+				AverageUtilization: util.Int32Ptr(utilization),
+			},
+		},
+	}
+}
+
+// hpaName generates the HPA name for the passed NodeSet. It is the same as the name of the Deployment that the
+// HPA scales.
+func hpaName(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) string {
+	return deploymentName(instance, nodeSet)
+}
+
+// replicasManagedExternally returns true if the replicas of the Deployment generated from the passed NodeSet are
+// managed outside of the Operator - either because the NodeSet is explicitly marked as autoscaled, or because
+// the Operator generates an HPA for the NodeSet
+func replicasManagedExternally(nodeSet v1alpha1.NodeSet) bool {
+	return nodeSet.Autoscaled || nodeSet.Autoscaling != nil
+}
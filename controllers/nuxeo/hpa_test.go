@@ -0,0 +1,157 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TestHpaCreation tests that an HPA targeting the NodeSet Deployment is generated from the NodeSet autoscaling
+// configuration, and that the Deployment is marked as having externally managed replicas
+func (suite *hpaSuite) TestHpaCreation() {
+	nux := suite.hpaSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].Autoscaling.TargetMemoryUtilizationPercentage = util.Int32Ptr(70)
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	hpa := autoscalingv2beta2.HorizontalPodAutoscaler{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: hpaName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, &hpa)
+	require.Nil(suite.T(), err, "HPA was not created")
+	require.Equal(suite.T(), deploymentName(nux, nux.Spec.NodeSets[0]), hpa.Spec.ScaleTargetRef.Name)
+	require.Equal(suite.T(), "Deployment", hpa.Spec.ScaleTargetRef.Kind)
+	require.Equal(suite.T(), int32(2), *hpa.Spec.MinReplicas)
+	require.Equal(suite.T(), int32(10), hpa.Spec.MaxReplicas)
+	require.Equal(suite.T(), 2, len(hpa.Spec.Metrics))
+	require.Equal(suite.T(), corev1.ResourceCPU, hpa.Spec.Metrics[0].Resource.Name)
+	require.Equal(suite.T(), int32(60), *hpa.Spec.Metrics[0].Resource.Target.AverageUtilization)
+	require.Equal(suite.T(), corev1.ResourceMemory, hpa.Spec.Metrics[1].Resource.Name)
+	dep := appsv1.Deployment{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, &dep)
+	require.Equal(suite.T(), "true", dep.Annotations[common.ExternalReplicasAnnotation])
+}
+
+// TestHpaDefaultMetric tests that the Kubernetes default CPU target is used if no metrics are specified
+func (suite *hpaSuite) TestHpaDefaultMetric() {
+	nux := suite.hpaSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].Autoscaling.TargetCPUUtilizationPercentage = nil
+	nux.Spec.NodeSets[0].Autoscaling.MinReplicas = nil
+	hpa := suite.r.defaultHpa(nux, hpaName(nux, nux.Spec.NodeSets[0]), nux.Spec.NodeSets[0])
+	require.Equal(suite.T(), nux.Spec.NodeSets[0].Replicas, *hpa.Spec.MinReplicas)
+	require.Equal(suite.T(), 1, len(hpa.Spec.Metrics))
+	require.Equal(suite.T(), int32(defaultTargetCPUUtilization), *hpa.Spec.Metrics[0].Resource.Target.AverageUtilization)
+}
+
+// TestHpaMinReplicasValidated tests that the minReplicas defaulted from the NodeSet replicas is validated against
+// maxReplicas, so an HPA that the API server would reject is never generated
+func (suite *hpaSuite) TestHpaMinReplicasValidated() {
+	nux := suite.hpaSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].Interactive = true
+	nux.Spec.NodeSets[0].Autoscaling.MinReplicas = nil
+	nux.Spec.NodeSets[0].Autoscaling.MaxReplicas = 2
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 1, len(errs))
+	require.Equal(suite.T(), "spec.nodeSets[0].autoscaling.maxReplicas", errs[0].Field)
+	nux.Spec.NodeSets[0].Autoscaling.MaxReplicas = 3
+	require.Equal(suite.T(), 0, len(validateNuxeo(nux)))
+	nux.Spec.NodeSets[0].Replicas = 0
+	require.Equal(suite.T(), int32(1), hpaMinReplicas(nux.Spec.NodeSets[0]))
+}
+
+// TestHpaUpdatedAndRemoved tests that the HPA is updated when the autoscaling configuration changes, and
+// removed when autoscaling is removed from the NodeSet
+func (suite *hpaSuite) TestHpaUpdatedAndRemoved() {
+	nux := suite.hpaSuiteNewNuxeo()
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	nux.Spec.NodeSets[0].Autoscaling.MaxReplicas = 20
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	hpa := autoscalingv2beta2.HorizontalPodAutoscaler{}
+	name := types.NamespacedName{Name: hpaName(nux, nux.Spec.NodeSets[0]), Namespace: suite.namespace}
+	_ = suite.r.Get(context.TODO(), name, &hpa)
+	require.Equal(suite.T(), int32(20), hpa.Spec.MaxReplicas)
+	nux.Spec.NodeSets[0].Autoscaling = nil
+	_, err = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	err = suite.r.Get(context.TODO(), name, &hpa)
+	require.True(suite.T(), apierrors.IsNotFound(err), "HPA should have been removed")
+}
+
+// hpaSuite is the HorizontalPodAutoscaler test suite structure
+type hpaSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *hpaSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *hpaSuite) AfterTest(_, _ string) {
+	obj := autoscalingv2beta2.HorizontalPodAutoscaler{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	objDep := appsv1.Deployment{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &objDep)
+}
+
+// This function runs the HPA unit test suite. It is called by 'go test' and will call every
+// function in this file with a hpaSuite receiver that begins with "Test..."
+func TestHpaUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(hpaSuite))
+}
+
+// hpaSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
+func (suite *hpaSuite) hpaSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+			// the fake client doesn't assign a UID - and the owner UID is needed to remove the HPA
+			UID: "12345678-1234-1234-1234-123456789012",
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:     "worker",
+				Replicas: 3,
+				Autoscaling: &v1alpha1.AutoscalingSpec{
+					MinReplicas:                    util.Int32Ptr(2),
+					MaxReplicas:                    10,
+					TargetCPUUtilizationPercentage: util.Int32Ptr(60),
+				},
+			}},
+		},
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// the Nuxeo image used if the Nuxeo CR does not specify one, and the Operator is not configured with one. This
+	// is what the Operator has always defaulted to, so a Nuxeo CR that does not specify an image is not rolled onto
+	// a different image by an Operator upgrade. Pinning the default images to digests is opt-in, with the
+	// RELATED_IMAGE_ env vars
+	defaultNuxeoImage = "nuxeo:latest"
+	// the Nginx image used if the Nuxeo CR does not specify one, and the Operator is not configured with one
+	defaultNginxImage = "nginx:latest"
+	// the registry of image references that don't specify one
+	dockerHubRegistry = "docker.io"
+)
+
+// RegistryRewrite replaces the registry prefix 'From' of an image reference with 'To'. A prefix is a registry,
+// optionally followed by one or more path components. E.g.: 'docker.io' or 'docker.io/library'.
+type RegistryRewrite struct {
+	From string
+	To   string
+}
+
+// ImageConfig is the Operator-wide configuration of the images in the Pods that the Operator generates. It is
+// configured once on startup by ConfigureImages.
+type ImageConfig struct {
+	// the Nuxeo image if the Nuxeo CR does not specify one. Can be pinned to a digest
+	NuxeoImage string
+	// the Nginx image if the Nuxeo CR does not specify one. Can be pinned to a digest
+	NginxImage string
+	// registry rewrites applied to the Nuxeo image, the Nginx image, and to the init containers that the Operator
+	// generates from those
+	RegistryRewrites []RegistryRewrite
+	// if true, the registry rewrites also apply to the containers and init containers from the Nuxeo CR
+	RewriteCrImages bool
+}
+
+// imageConfig holds the Operator-wide image configuration
+var imageConfig = ImageConfig{
+	NuxeoImage: defaultNuxeoImage,
+	NginxImage: defaultNginxImage,
+}
+
+// ConfigureImages sets the Operator-wide image configuration. Empty default images in the passed config are
+// replaced with the Operator built-in defaults. Must be called before the manager is started.
+func ConfigureImages(config ImageConfig) {
+	if config.NuxeoImage == "" {
+		config.NuxeoImage = defaultNuxeoImage
+	}
+	if config.NginxImage == "" {
+		config.NginxImage = defaultNginxImage
+	}
+	imageConfig = config
+}
+
+// DigestPinned returns true if the passed image reference is pinned to a digest. E.g.: 'nginx@sha256:...' or
+// 'nginx:1.19.2@sha256:...'
+func DigestPinned(image string) bool {
+	return strings.Contains(image, "@sha256:")
+}
+
+// ParseRegistryRewrites parses the passed comma-separated list of 'from=to' registry prefix rewrites. E.g.:
+// 'docker.io=mirror.example.com/docker,quay.io=mirror.example.com/quay'
+func ParseRegistryRewrites(rewrites string) ([]RegistryRewrite, error) {
+	var parsed []RegistryRewrite
+	for _, rewrite := range strings.Split(rewrites, ",") {
+		rewrite = strings.TrimSpace(rewrite)
+		if rewrite == "" {
+			continue
+		}
+		fromTo := strings.Split(rewrite, "=")
+		if len(fromTo) != 2 || fromTo[0] == "" || fromTo[1] == "" {
+			return nil, fmt.Errorf("invalid registry rewrite '%v': expected 'from=to'", rewrite)
+		}
+		parsed = append(parsed, RegistryRewrite{
+			From: strings.TrimSuffix(fromTo[0], "/"),
+			To:   strings.TrimSuffix(fromTo[1], "/"),
+		})
+	}
+	return parsed, nil
+}
+
+// rewriteImage applies the registry rewrite with the longest matching prefix to the passed image reference. The
+// prefixes are matched against the fully-qualified reference, so 'nuxeo:10.10' is matched as
+// 'docker.io/library/nuxeo:10.10'. If no rewrite matches, then the image reference is returned unchanged.
+func rewriteImage(image string) string {
+	qualified := qualifyImage(image)
+	var match *RegistryRewrite
+	for i, rewrite := range imageConfig.RegistryRewrites {
+		if (qualified == rewrite.From || strings.HasPrefix(qualified, rewrite.From+"/")) &&
+			(match == nil || len(rewrite.From) > len(match.From)) {
+			match = &imageConfig.RegistryRewrites[i]
+		}
+	}
+	if match == nil {
+		return image
+	}
+	return match.To + strings.TrimPrefix(qualified, match.From)
+}
+
+// qualifyImage returns the passed image reference with the Docker Hub registry and the 'library' repository
+// made explicit if the reference doesn't specify a registry. As with the Docker CLI, the first component of the
+// reference is a registry if it contains a dot or a colon, or if it is 'localhost'.
+func qualifyImage(image string) string {
+	components := strings.SplitN(image, "/", 2)
+	if len(components) == 2 && (strings.ContainsAny(components[0], ".:") || components[0] == "localhost") {
+		return image
+	}
+	if len(components) == 1 {
+		return dockerHubRegistry + "/library/" + image
+	}
+	return dockerHubRegistry + "/" + image
+}
+
+// rewriteCrContainers returns the passed containers from the Nuxeo CR with the registry rewrites applied to their
+// images, if the Operator is configured to rewrite Nuxeo CR images. Otherwise the passed containers are returned
+// as is. The containers in the Nuxeo CR are not modified.
+func rewriteCrContainers(containers []corev1.Container) []corev1.Container {
+	if !imageConfig.RewriteCrImages || len(containers) == 0 {
+		return containers
+	}
+	rewritten := make([]corev1.Container, len(containers))
+	for i := range containers {
+		containers[i].DeepCopyInto(&rewritten[i])
+		rewritten[i].Image = rewriteImage(rewritten[i].Image)
+	}
+	return rewritten
+}
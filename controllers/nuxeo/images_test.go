@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestParseRegistryRewrites tests parsing of the registry rewrites configuration
+func (suite *imagesSuite) TestParseRegistryRewrites() {
+	rewrites, err := ParseRegistryRewrites("docker.io=mirror.example.com/docker/, quay.io=mirror.example.com/quay")
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), []RegistryRewrite{
+		{From: "docker.io", To: "mirror.example.com/docker"},
+		{From: "quay.io", To: "mirror.example.com/quay"},
+	}, rewrites)
+	rewrites, err = ParseRegistryRewrites("")
+	require.Nil(suite.T(), err)
+	require.Nil(suite.T(), rewrites)
+	_, err = ParseRegistryRewrites("docker.io")
+	require.NotNil(suite.T(), err, "Rewrite without a target should have been an error")
+}
+
+// TestRewriteImage tests that the rewrite with the longest matching prefix is applied to the fully-qualified image
+// reference, and that an image that matches no rewrite is not changed
+func (suite *imagesSuite) TestRewriteImage() {
+	ConfigureImages(ImageConfig{RegistryRewrites: []RegistryRewrite{
+		{From: "docker.io", To: "mirror.example.com/docker"},
+		{From: "docker.io/library", To: "mirror.example.com/official"},
+		{From: "localhost:5000", To: "mirror.example.com/local"},
+	}})
+	for image, expected := range map[string]string{
+		"nuxeo:10.10":                   "mirror.example.com/official/nuxeo:10.10",
+		"nuxeo@sha256:0123456789abcdef": "mirror.example.com/official/nuxeo@sha256:0123456789abcdef",
+		"bitnami/nginx:1.19":            "mirror.example.com/docker/bitnami/nginx:1.19",
+		"docker.io/library/nginx":       "mirror.example.com/official/nginx",
+		"localhost:5000/nuxeo:custom":   "mirror.example.com/local/nuxeo:custom",
+		"quay.io/acme/nuxeo:1.0":        "quay.io/acme/nuxeo:1.0",
+		"docker.iox/acme/nuxeo:1.0":     "docker.iox/acme/nuxeo:1.0",
+	} {
+		require.Equal(suite.T(), expected, rewriteImage(image))
+	}
+}
+
+// TestDefaultImages tests that the configured default images are used if the Nuxeo CR does not specify images,
+// that the rewrites are applied to the Nuxeo and Nginx images, and that the rewrites are only applied to the
+// containers from the Nuxeo CR if configured
+func (suite *imagesSuite) TestDefaultImages() {
+	ConfigureImages(ImageConfig{
+		NuxeoImage:       "nuxeo@sha256:0123456789abcdef",
+		RegistryRewrites: []RegistryRewrite{{From: "docker.io", To: "mirror.example.com"}},
+	})
+	nux := suite.imagesSuiteNewNuxeo()
+	dep, _ := suite.r.defaultDeployment(nux, "test", nux.Spec.NodeSets[0])
+	require.Equal(suite.T(), "mirror.example.com/library/nuxeo@sha256:0123456789abcdef",
+		dep.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(suite.T(), corev1.PullIfNotPresent, dep.Spec.Template.Spec.Containers[0].ImagePullPolicy)
+	require.Equal(suite.T(), "mirror.example.com/library/nginx:latest",
+		defaultNginxContainer(v1alpha1.NginxRevProxySpec{}).Image)
+	_ = configureContainers(nux, dep)
+	require.Equal(suite.T(), "busybox", dep.Spec.Template.Spec.Containers[1].Image)
+	imageConfig.RewriteCrImages = true
+	dep, _ = suite.r.defaultDeployment(nux, "test", nux.Spec.NodeSets[0])
+	_ = configureContainers(nux, dep)
+	require.Equal(suite.T(), "mirror.example.com/library/busybox", dep.Spec.Template.Spec.Containers[1].Image)
+	require.Equal(suite.T(), "busybox", nux.Spec.Containers[0].Image, "Nuxeo CR should not have been modified")
+}
+
+// TestBuiltInDefaultImages tests that the Operator built-in default images are the images the Operator has always
+// defaulted to, so an Operator upgrade does not change the image of a Nuxeo CR that does not specify one, and that
+// digest pinning is detected
+func (suite *imagesSuite) TestBuiltInDefaultImages() {
+	nux := suite.imagesSuiteNewNuxeo()
+	dep, _ := suite.r.defaultDeployment(nux, "test", nux.Spec.NodeSets[0])
+	require.Equal(suite.T(), "nuxeo:latest", dep.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(suite.T(), corev1.PullAlways, dep.Spec.Template.Spec.Containers[0].ImagePullPolicy)
+	nginx := defaultNginxContainer(v1alpha1.NginxRevProxySpec{})
+	require.Equal(suite.T(), "nginx:latest", nginx.Image)
+	require.Equal(suite.T(), corev1.PullAlways, nginx.ImagePullPolicy)
+	require.False(suite.T(), DigestPinned(defaultNuxeoImage))
+	require.True(suite.T(), DigestPinned("nginx:1.19.2@sha256:0123456789abcdef"))
+	require.True(suite.T(), DigestPinned("nginx@sha256:0123456789abcdef"))
+}
+
+// imagesSuite is the image configuration test suite structure
+type imagesSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *imagesSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest restores the Operator default image configuration after each test
+func (suite *imagesSuite) AfterTest(_, _ string) {
+	ConfigureImages(ImageConfig{})
+}
+
+// This function runs the image configuration unit test suite. It is called by 'go test' and will call every
+// function in this file with an imagesSuite receiver that begins with "Test..."
+func TestImagesUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(imagesSuite))
+}
+
+// imagesSuiteNewNuxeo creates a test Nuxeo struct with a sidecar, and without a Nuxeo image
+func (suite *imagesSuite) imagesSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:     "test",
+				Replicas: 1,
+			}},
+			Containers: []corev1.Container{{
+				Name:  "sidecar",
+				Image: "busybox",
+			}},
+		},
+	}
+}
@@ -36,7 +36,7 @@ func (r *NuxeoReconciler) reconcileIngress(access v1alpha1.NuxeoAccess, forcePas
 		if expected, err := r.defaultIngress(instance, access, forcePassthrough, ingressName, nodeSet); err != nil {
 			return err
 		} else {
-			_, err = r.addOrUpdate(ingressName, instance.Namespace, expected, &v1beta1.Ingress{}, util.IngressComparer)
+			_, err = r.addOrUpdate(instance, ingressName, instance.Namespace, expected, &v1beta1.Ingress{}, util.IngressComparer)
 			return err
 		}
 	} else {
@@ -61,6 +61,7 @@ func (r *NuxeoReconciler) defaultIngress(instance *v1alpha1.Nuxeo, access v1alph
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      ingressName,
 			Namespace: instance.Namespace,
+			Labels:    nodeSetLabels(instance, nodeSet),
 		},
 		Spec: v1beta1.IngressSpec{
 			Rules: []v1beta1.IngressRule{{
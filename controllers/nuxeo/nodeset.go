@@ -19,7 +19,6 @@ package nuxeo
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
 	"github.com/aceeric/nuxeo-operator/controllers/common"
@@ -28,7 +27,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
@@ -36,7 +34,8 @@ import (
 // corresponding in-cluster Deployment. If no Deployment exists, a Deployment is created from the NodeSet. If a
 // Deployment exists and its state differs from the NodeSet, the Deployment is conformed to the NodeSet.
 // Otherwise, the fall-through case is that a Deployment exists that matches the NodeSet and so in this
-// case - cluster state is not modified.
+// case - cluster state is not modified. If the NodeSet workload type is StatefulSet, then the Deployment is
+// generated in the same way, and then converted to a StatefulSet which is reconciled instead.
 //
 // Returns:
 //   requeue true to requeue, else false (true means success but requeue to update status)
@@ -51,13 +50,38 @@ func (r *NuxeoReconciler) reconcileNodeSet(nodeSet v1alpha1.NodeSet, instance *v
 	if err := r.configureDeploymentFromNuxeo(nodeSet, expected, instance); err != nil {
 		return false, err
 	}
-	if op, err := r.addOrUpdate(depName, instance.Namespace, expected, &appsv1.Deployment{},
-		util.DeploymentComparer); err != nil {
+	var op reconOp
+	if isStatefulSet(nodeSet) {
+		op, err = r.reconcileStatefulSet(instance, nodeSet, expected)
+	} else {
+		op, err = r.reconcileDeployment(instance, nodeSet, expected)
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := r.reconcileHpa(instance, nodeSet); err != nil {
+		return false, err
+	}
+	if err := r.reconcilePdb(instance, nodeSet); err != nil {
 		return false, err
-	} else if op == Created {
-		return true, nil
 	}
-	return false, nil
+	return op == Created, nil
+}
+
+// reconcileDeployment reconciles the passed expected Deployment for the passed NodeSet with the cluster. Since the
+// NodeSet could previously have been configured as a StatefulSet, any StatefulSet and headless Service generated
+// for the NodeSet are removed.
+func (r *NuxeoReconciler) reconcileDeployment(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet,
+	expected *appsv1.Deployment) (reconOp, error) {
+	if err := r.removeIfPresent(instance, expected.Name, instance.Namespace, &appsv1.StatefulSet{}); err != nil {
+		return NA, err
+	}
+	if err := r.removeIfPresent(instance, headlessServiceName(instance, nodeSet), instance.Namespace,
+		&corev1.Service{}); err != nil {
+		return NA, err
+	}
+	return r.addOrUpdate(instance, expected.Name, instance.Namespace, expected, &appsv1.Deployment{},
+		util.DeploymentComparer)
 }
 
 // configureDeploymentFromNuxeo applies the various Nuxeo CR configurations to the passed 'expected' deployment
@@ -72,36 +96,43 @@ func (r *NuxeoReconciler) configureDeploymentFromNuxeo(nodeSet v1alpha1.NodeSet,
 	if err := configureProbes(expected, nodeSet); err != nil {
 		return err
 	}
-	if err := configureStorage(expected, nodeSet); err != nil {
-		return err
+	if err := r.configureStorage(instance, expected, nodeSet); err != nil {
+		return withCondition(v1alpha1.ConditionStorageBound, "InvalidStorage", err)
 	}
 	jvmPkiSecret := corev1.Secret{}
 	if nodeSet.NuxeoConfig.JvmPKISecret != "" {
 		if err := r.Get(context.TODO(), types.NamespacedName{Name: nodeSet.NuxeoConfig.JvmPKISecret,
 			Namespace: instance.ObjectMeta.Namespace}, &jvmPkiSecret); err != nil {
-			return fmt.Errorf("configuration specifies JVM PKI secret that does not exist: %v",
-				nodeSet.NuxeoConfig.JvmPKISecret)
+			return withCondition(v1alpha1.ConditionConfigRendered, "JvmPkiSecretNotFound",
+				fmt.Errorf("configuration specifies JVM PKI secret that does not exist: %v",
+					nodeSet.NuxeoConfig.JvmPKISecret))
 		}
 	}
 	if err := configureContainers(instance, expected); err != nil {
 		return err
 	}
 	if err := configureConfig(expected, nodeSet, jvmPkiSecret); err != nil {
-		return err
+		return withCondition(v1alpha1.ConditionConfigRendered, "InvalidConfig", err)
 	}
 	if err := configureClid(instance, expected); err != nil {
 		return err
 	}
-	if err := configureClustering(expected, nodeSet); err != nil {
-		return err
+	if tmp, err := r.configureBinaryStore(instance, expected); err != nil {
+		return withCondition(v1alpha1.ConditionStorageBound, "InvalidBinaryStore", err)
+	} else {
+		backingNuxeoConf = tmp
 	}
+	if err := configureClustering(instance, expected, nodeSet); err != nil {
+		return withCondition(v1alpha1.ConditionStorageBound, "InvalidClusterStorage", err)
+	}
+	configureScheduling(instance, expected, nodeSet)
 	if err := r.configureContributions(instance, expected, nodeSet); err != nil {
-		return err
+		return withCondition(v1alpha1.ConditionConfigRendered, "InvalidContribution", err)
 	}
 	if tmp, err := r.configureBackingServices(instance, expected); err != nil {
-		return err
+		return withCondition(v1alpha1.ConditionBackingServicesResolved, "BackingServiceError", err)
 	} else {
-		backingNuxeoConf = tmp
+		backingNuxeoConf = joinCompact("\n", backingNuxeoConf, tmp)
 	}
 	if nodeSet.Interactive {
 		revProxy := instance.Spec.RevProxy
@@ -130,14 +161,20 @@ func (r *NuxeoReconciler) configureDeploymentFromNuxeo(nodeSet v1alpha1.NodeSet,
 			return err
 		}
 	}
-	if err := configureNuxeoConf(instance, expected, nodeSet, backingNuxeoConf, tlsNuxeoConf); err != nil {
+	if err := configureSecurityContext(instance, expected, nodeSet); err != nil {
 		return err
 	}
+	if err := configureNuxeoConf(instance, expected, nodeSet, backingNuxeoConf, tlsNuxeoConf); err != nil {
+		return withCondition(v1alpha1.ConditionConfigRendered, "NuxeoConfError", err)
+	}
 	if nxconfHash, err := r.reconcileNuxeoConf(instance, nodeSet, backingNuxeoConf, tlsNuxeoConf); err != nil {
-		return err
+		return withCondition(v1alpha1.ConditionConfigRendered, "NuxeoConfError", err)
 	} else if nxconfHash != "" {
 		util.AnnotateTemplate(expected, common.NuxeoConfHashAnnotation, nxconfHash)
 	}
+	if err := r.annotateReferences(instance, expected, nodeSet); err != nil {
+		return withCondition(v1alpha1.ConditionConfigRendered, "ReferenceError", err)
+	}
 	return nil
 }
 
@@ -147,58 +184,43 @@ func (r *NuxeoReconciler) configureDeploymentFromNuxeo(nodeSet v1alpha1.NodeSet,
 // Nuxeo CR. The deployment always contains one container named "nuxeo".
 func (r *NuxeoReconciler) defaultDeployment(instance *v1alpha1.Nuxeo, depName string,
 	nodeSet v1alpha1.NodeSet) (*appsv1.Deployment, error) {
-	nuxeoImage := "nuxeo:latest"
+	nuxeoImage := imageConfig.NuxeoImage
 	if instance.Spec.NuxeoImage != "" {
 		nuxeoImage = instance.Spec.NuxeoImage
 	}
-	var pullPolicy = corev1.PullIfNotPresent
-	if instance.Spec.ImagePullPolicy == "" {
-		if strings.HasSuffix(nuxeoImage, ":latest") {
-			pullPolicy = corev1.PullAlways
-		}
-	} else {
+	var pullPolicy = defaultImagePullPolicy(nuxeoImage)
+	if instance.Spec.ImagePullPolicy != "" {
 		pullPolicy = instance.Spec.ImagePullPolicy
 	}
 	dep := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      depName,
 			Namespace: instance.Namespace,
+			Labels:    nodeSetLabels(instance, nodeSet),
 		},
 		Spec: appsv1.DeploymentSpec{
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labelsForNuxeo(instance, nodeSet.Interactive),
 			},
-			Replicas:                util.Int32Ptr(nodeSet.Replicas),
-			ProgressDeadlineSeconds: util.Int32Ptr(600),
-			RevisionHistoryLimit:    util.Int32Ptr(10),
-			Strategy: appsv1.DeploymentStrategy{
-				Type: appsv1.RollingUpdateDeploymentStrategyType,
-				RollingUpdate: &appsv1.RollingUpdateDeployment{
-					MaxUnavailable: &intstr.IntOrString{
-						Type:   intstr.String,
-						StrVal: "25%",
-					},
-					MaxSurge: &intstr.IntOrString{
-						Type:   intstr.String,
-						StrVal: "25%",
-					},
-				},
-			},
+			Replicas:             util.Int32Ptr(nodeSetReplicas(instance, nodeSet)),
+			RevisionHistoryLimit: util.Int32Ptr(10),
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: labelsForNuxeo(instance, nodeSet.Interactive),
+					Labels:      podLabels(instance, nodeSet),
+					Annotations: podAnnotations(instance, nodeSet),
 				},
 				Spec: corev1.PodSpec{
 					// comes back from the cluster anyway:
-					DeprecatedServiceAccount:      NuxeoServiceAccountName,
-					ServiceAccountName:            NuxeoServiceAccountName,
+					DeprecatedServiceAccount:      serviceAccountName(instance),
+					ServiceAccountName:            serviceAccountName(instance),
 					TerminationGracePeriodSeconds: util.Int64Ptr(30),
 					DNSPolicy:                     corev1.DNSClusterFirst,
 					RestartPolicy:                 corev1.RestartPolicyAlways,
 					SchedulerName:                 corev1.DefaultSchedulerName,
 					SecurityContext:               &corev1.PodSecurityContext{},
+					ImagePullSecrets:              instance.Spec.ImagePullSecrets,
 					Containers: []corev1.Container{{
-						Image:           nuxeoImage,
+						Image:           rewriteImage(nuxeoImage),
 						ImagePullPolicy: pullPolicy,
 						Name:            "nuxeo",
 						Ports: []corev1.ContainerPort{{
@@ -216,10 +238,24 @@ func (r *NuxeoReconciler) defaultDeployment(instance *v1alpha1.Nuxeo, depName st
 			},
 		},
 	}
+	configureStrategy(instance, dep, nodeSet)
+	if replicasManagedExternally(nodeSet) {
+		dep.Annotations = map[string]string{common.ExternalReplicasAnnotation: "true"}
+	}
 	_ = controllerutil.SetControllerReference(instance, dep, r.Scheme)
 	return dep, nil
 }
 
+// nodeSetReplicas returns the desired replicas for the passed NodeSet. If the Nuxeo CR specifies top-level
+// replicas - e.g. because it was scaled via the scale subresource - then that value overrides the replicas of
+// the interactive NodeSet.
+func nodeSetReplicas(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) int32 {
+	if nodeSet.Interactive && instance.Spec.Replicas != nil {
+		return *instance.Spec.Replicas
+	}
+	return nodeSet.Replicas
+}
+
 // deploymentName generates a deployment name from the passed Nuxeo CR, and the passed NodeSet. The generated
 // name consists of the passed Nuxeo CR name + dash + the passed 'nodeSet' name. E.g. if 'instance.Name' is 'my-nuxeo'
 // and 'nodeSet.Name' is 'cluster' then the function returns 'my-nuxeo-cluster'.
@@ -227,9 +263,30 @@ func deploymentName(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) string {
 	return instance.Name + "-" + nodeSet.Name
 }
 
+// nodeSetLabels returns the labels that identify the resources that the Operator generates for the passed NodeSet,
+// so that the resources generated for a NodeSet that is later removed from the Nuxeo CR can be found and removed.
+// The NodeSet is also the app.kubernetes.io/component of the resources.
+func nodeSetLabels(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) map[string]string {
+	return map[string]string{
+		common.NuxeoCrLabel:      instance.Name,
+		common.NodeSetLabel:      nodeSet.Name,
+		common.AppComponentLabel: nodeSet.Name,
+	}
+}
+
+// nodeSetSelector returns the labels that select the Pods of the passed NodeSet and no other Pods: the Deployment
+// selector labels plus the component label, which podLabels sets to the NodeSet name. The Deployment selector
+// alone selects the Pods of every non-interactive NodeSet of the Nuxeo CR, so resources that must only select
+// the Pods of one NodeSet - e.g. a PodDisruptionBudget - use this selector.
+func nodeSetSelector(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) map[string]string {
+	return mergeMaps(labelsForNuxeo(instance, nodeSet.Interactive),
+		map[string]string{common.AppComponentLabel: nodeSet.Name})
+}
+
 // labelsForNuxeo returns a map of labels that are intended for the following specific purposes 1) a
 // Deployment's match labels / pod template labels, and 2) a Service's selectors that enable the service to
-// select a Nuxeo pod for TCP/IP traffic routing
+// select a Nuxeo pod for TCP/IP traffic routing. Since a Deployment selector is immutable, these labels must not
+// change - other Pod labels are added by podLabels.
 func labelsForNuxeo(instance *v1alpha1.Nuxeo, interactive bool) map[string]string {
 	m := map[string]string{
 		"app":     "nuxeo",
@@ -246,27 +303,30 @@ func labelsForNuxeo(instance *v1alpha1.Nuxeo, interactive bool) map[string]strin
 // the defaultNuxeoConfCM() function to build a ConfigMap of nuxeo.conf properties to project into the Nuxeo Pod.
 // The CM built by that function has a variable 'nuxeo.cluster.nodeid=${env:POD_UID}' referencing the env var.
 // If the POD_UID environment variable is already present in the Nuxeo container then the function returns an error.
+// For a StatefulSet NodeSet, POD_NAME is used instead, so that the node id survives Pod restarts.
 //
 // The function also verifies that the passed NodeSet defines a binary storage type. The is necessary because in
 // clustered mode, the binary store must be shared by all nodes in the cluster. The binary storage type must be
 // supplied by the configurer since it references cluster storage and will therefore be site-specific. If a binary
-// storage is not defined, then an error is returned.
-func configureClustering(dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet) error {
+// storage is not defined, then an error is returned - unless the passed Nuxeo CR defines a binary store, such as
+// S3, which is shared by all nodes by definition.
+func configureClustering(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet) error {
 	if !nodeSet.ClusterEnabled {
 		return nil
 	}
-	if !binaryStorageIsDefined(nodeSet) {
-		return fmt.Errorf("configuration must define a Binaries storage in storageType")
+	if !binaryStorageIsDefined(nodeSet) && instance.Spec.BinaryStore == nil {
+		return fmt.Errorf("configuration must define a Binaries storage in storageType, or a binaryStore")
 	}
 	if nuxeoContainer, err := GetNuxeoContainer(dep); err != nil {
 		return err
 	} else {
+		envVarName, fieldPath := clusterNodeIdSource(nodeSet)
 		return util.OnlyAddEnvVar(nuxeoContainer, corev1.EnvVar{
-			Name: "POD_UID",
+			Name: envVarName,
 			ValueFrom: &corev1.EnvVarSource{
 				FieldRef: &corev1.ObjectFieldSelector{
 					APIVersion: "v1",
-					FieldPath:  "metadata.uid",
+					FieldPath:  fieldPath,
 				},
 			},
 		})
@@ -286,14 +346,16 @@ func binaryStorageIsDefined(nodeSet v1alpha1.NodeSet) bool {
 
 // configureContainers copies the InitContainers and Containers arrays from the passed Nuxeo struct into
 // the passed deployment struct. The Containers array is first checked to ensure that it does not define a
-// container named "nuxeo", since this container name is reserved by the Operator.
+// container named "nuxeo", since this container name is reserved by the Operator. If the Operator is configured
+// to rewrite the images of the Nuxeo CR, then the registry rewrites are applied to the copied containers.
 func configureContainers(instance *v1alpha1.Nuxeo, expected *appsv1.Deployment) error {
 	for idx, container := range instance.Spec.Containers {
 		if container.Name == "nuxeo" {
 			return fmt.Errorf("container at ordinal position %v uses reserved 'nuxeo' name", idx)
 		}
 	}
-	expected.Spec.Template.Spec.InitContainers = instance.Spec.InitContainers
-	expected.Spec.Template.Spec.Containers = append(expected.Spec.Template.Spec.Containers, instance.Spec.Containers...)
+	expected.Spec.Template.Spec.InitContainers = rewriteCrContainers(instance.Spec.InitContainers)
+	expected.Spec.Template.Spec.Containers = append(expected.Spec.Template.Spec.Containers,
+		rewriteCrContainers(instance.Spec.Containers)...)
 	return nil
 }
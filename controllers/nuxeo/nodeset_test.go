@@ -23,6 +23,8 @@ import (
 	"testing"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	appsv1 "k8s.io/api/apps/v1"
@@ -60,6 +62,56 @@ func (suite *nodeSetSuite) TestDeploymentUpdated() {
 		"Deployment has incorrect replica count")
 }
 
+// TestDeploymentScaledFromCR verifies that top-level replicas in the Nuxeo CR - which are set by the scale
+// subresource - override the replicas of the interactive NodeSet
+func (suite *nodeSetSuite) TestDeploymentScaledFromCR() {
+	nux := suite.nodeSetSuiteNewNuxeo()
+	nux.Spec.Replicas = util.Int32Ptr(5)
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	found := &appsv1.Deployment{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, found)
+	require.Equal(suite.T(), int32(5), *found.Spec.Replicas, "Deployment has incorrect replica count")
+}
+
+// TestDeploymentAutoscaled verifies that the Operator sets the replicas of an autoscaled NodeSet when it creates
+// the Deployment, but does not overwrite replicas that were subsequently changed outside of the Operator
+func (suite *nodeSetSuite) TestDeploymentAutoscaled() {
+	nux := suite.nodeSetSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].Autoscaled = true
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	found := &appsv1.Deployment{}
+	depName := types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]), Namespace: suite.namespace}
+	_ = suite.r.Get(context.TODO(), depName, found)
+	require.Equal(suite.T(), nux.Spec.NodeSets[0].Replicas, *found.Spec.Replicas)
+	require.Equal(suite.T(), "true", found.Annotations[common.ExternalReplicasAnnotation])
+	// simulate kubectl scale / HPA
+	found.Spec.Replicas = util.Int32Ptr(7)
+	_ = suite.r.Update(context.TODO(), found)
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	_ = suite.r.Get(context.TODO(), depName, found)
+	require.Equal(suite.T(), int32(7), *found.Spec.Replicas, "Operator overwrote externally managed replicas")
+	// no longer autoscaled: the Operator takes the replicas back
+	nux.Spec.NodeSets[0].Autoscaled = false
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	found = &appsv1.Deployment{}
+	_ = suite.r.Get(context.TODO(), depName, found)
+	require.Equal(suite.T(), nux.Spec.NodeSets[0].Replicas, *found.Spec.Replicas)
+	_, ok := found.Annotations[common.ExternalReplicasAnnotation]
+	require.False(suite.T(), ok, "External replicas annotation should have been removed")
+}
+
+// TestDeploymentPullSecrets verifies that the image pull secrets from the Nuxeo CR are configured in the pod spec
+func (suite *nodeSetSuite) TestDeploymentPullSecrets() {
+	nux := suite.nodeSetSuiteNewNuxeo()
+	nux.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "registry-creds"}}
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	found := &appsv1.Deployment{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, found)
+	require.Equal(suite.T(), nux.Spec.ImagePullSecrets, found.Spec.Template.Spec.ImagePullSecrets)
+}
+
 // TestDeploymentClustering tests the clustering configuration. If defines clustering as enabled, and also defines
 // an inline nuxeo.conf. The operator code under test should create a nuxeo.conf ConfigMap from the inlined
 // content and and append to that content specific values for clustering configuration.
@@ -187,8 +239,10 @@ func (suite *nodeSetSuite) TestJvmPkiSecret() {
 	require.Nil(suite.T(), err)
 	// the Operator should have defined JAVA_OPTS with system props for SSL, as well as a volume and volume mount
 	// for the JVM properties
-	require.Equal(suite.T(), "JAVA_OPTS", dep.Spec.Template.Spec.Containers[0].Env[0].Name)
-	require.True(suite.T(), strings.Contains(dep.Spec.Template.Spec.Containers[0].Env[0].Value, "-Djavax.net.ssl.keyStoreType"))
+	javaOpts := util.GetEnv(&dep.Spec.Template.Spec.Containers[0], "JAVA_OPTS")
+	require.NotNil(suite.T(), javaOpts)
+	require.True(suite.T(), strings.Contains(javaOpts.Value, "-Djavax.net.ssl.keyStoreType"))
+	require.False(suite.T(), strings.Contains(javaOpts.Value, storePassEncoded), "password should not be in the spec")
 	require.Equal(suite.T(), 1, len(dep.Spec.Template.Spec.Volumes))
 	require.Equal(suite.T(), 1, len(dep.Spec.Template.Spec.Containers[0].VolumeMounts))
 }
@@ -17,66 +17,324 @@ limitations under the License.
 package nuxeo
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
 	"github.com/aceeric/nuxeo-operator/controllers/util"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
-// reconcileNuxeoConf inspects the Nuxeo CR to see if it contains an inline nuxeo.conf, or, clustering is
-// enabled, or, if the passed backing service-generated nuxeo.conf entries contains anything. If any of these
-// are true, then the function creates a ConfigMap struct to hold all nuxeo.conf entries. The content is placed
-// into the ConfigMap identified by the key 'nuxeo.conf'. The function then reconciles this with the cluster.
-// The caller must have defined a Volume and VolumeMount elsewhere to  reference the ConfigMap. (See the
+// nuxeoConfSource identifies the origin of a nuxeo.conf property. The sources are declared in ascending order of
+// precedence: a property from a source overrides the same property from any preceding source.
+type nuxeoConfSource int
+
+const (
+	// settings that the Operator requires, e.g. clustering and TLS
+	operatorSource nuxeoConfSource = iota
+	// settings generated from backing services and the binary store
+	backingSource
+	// settings from the Nuxeo CR: the external nuxeo.conf, then the inline nuxeo.conf, then the properties map, then
+	// the secret properties
+	userSource
+)
+
+func (s nuxeoConfSource) String() string {
+	switch s {
+	case operatorSource:
+		return "operator"
+	case backingSource:
+		return "backing services"
+	default:
+		return "user"
+	}
+}
+
+// nuxeoConfProperty is one nuxeo.conf property and the source that set it
+type nuxeoConfProperty struct {
+	key    string
+	value  string
+	source nuxeoConfSource
+}
+
+// nuxeoConf models nuxeo.conf as an ordered set of properties so that each key appears exactly once in the
+// rendered file. Properties are rendered in the order in which their keys were first set, so the same inputs
+// always render the same content - and the same hash.
+type nuxeoConf struct {
+	properties []nuxeoConfProperty
+	// describes each property that was set more than once with different values
+	conflicts []string
+}
+
+// set sets the passed property from the passed source. If the key is already set by a source with the same or a
+// lower precedence then the value is replaced, otherwise the value is ignored. Either way if the values differ the
+// conflict is recorded. Values are not recorded in the conflict since they could be sensitive.
+func (c *nuxeoConf) set(key string, value string, source nuxeoConfSource) {
+	for i := range c.properties {
+		prop := &c.properties[i]
+		if prop.key != key {
+			continue
+		}
+		if prop.value != value {
+			if source == prop.source {
+				c.conflicts = append(c.conflicts, fmt.Sprintf("%v: set more than once by %v", key, source))
+			} else if source > prop.source {
+				c.conflicts = append(c.conflicts, fmt.Sprintf("%v: %v overrides %v", key, source, prop.source))
+			} else {
+				c.conflicts = append(c.conflicts, fmt.Sprintf("%v: %v overrides %v", key, prop.source, source))
+			}
+		}
+		if source >= prop.source {
+			prop.value, prop.source = value, source
+		}
+		return
+	}
+	c.properties = append(c.properties, nuxeoConfProperty{key: key, value: value, source: source})
+}
+
+// setAll parses the passed nuxeo.conf text and sets each property in it from the passed source. Parsing follows
+// the Java properties file format that Nuxeo reads nuxeo.conf with: blank lines and comments starting with '#' or
+// '!' are skipped, a trailing backslash continues a line, and the key is separated from the value by '=', ':', or
+// whitespace.
+func (c *nuxeoConf) setAll(text string, source nuxeoConfSource) {
+	logical := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimLeft(line, " \t\r")
+		if logical == "" && (line == "" || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+		line = strings.TrimRight(line, "\r")
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			logical += strings.TrimSuffix(line, "\\")
+			continue
+		}
+		key, value := splitProperty(logical + line)
+		c.set(key, value, source)
+		logical = ""
+	}
+	if logical != "" {
+		key, value := splitProperty(logical)
+		c.set(key, value, source)
+	}
+}
+
+// splitProperty splits the passed logical line from a properties file into a key and a value. As in a Java
+// properties file, a separator character that is escaped with a backslash - e.g. 'a\=b' - is part of the key. The
+// key is returned as written, escapes included, so that it is rendered back into nuxeo.conf unchanged.
+func splitProperty(line string) (string, string) {
+	end := -1
+	for i := 0; i < len(line) && end == -1; i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '=', ':', ' ', '\t':
+			end = i
+		}
+	}
+	if end == -1 {
+		return line, ""
+	}
+	value := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(value, "=") || strings.HasPrefix(value, ":") {
+		value = value[1:]
+	}
+	return line[:end], strings.TrimLeft(value, " \t")
+}
+
+// setMap sets each property in the passed map from the passed source in key order, so the rendered content does
+// not depend on map iteration order
+func (c *nuxeoConf) setMap(properties map[string]string, source nuxeoConfSource) {
+	for _, key := range sortedKeys(properties) {
+		c.set(key, properties[key], source)
+	}
+}
+
+// sortedKeys returns the keys of the passed map in ascending order
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// render returns the nuxeo.conf file content, with one 'key=value' line per property
+func (c *nuxeoConf) render() string {
+	rendered := ""
+	for _, prop := range c.properties {
+		rendered += prop.key + "=" + prop.value + "\n"
+	}
+	return rendered
+}
+
+// reconcileNuxeoConf inspects the Nuxeo CR to see if it contains an inline nuxeo.conf, nuxeo.conf properties, or a
+// reference to an external nuxeo.conf, or, clustering is enabled, or, if the passed backing service-generated
+// nuxeo.conf entries contains anything. If any of these are true, then the function creates a ConfigMap struct to
+// hold all nuxeo.conf entries. The content
+// is placed into the ConfigMap identified by the key 'nuxeo.conf'. The function then reconciles this with the
+// cluster. The caller must have defined a Volume and VolumeMount elsewhere to  reference the ConfigMap. (See the
 // configureConfig function for details.) If the Nuxeo CR indicates that an inline nuxeo.conf should not exist,
 // then the function makes sure a ConfigMap does not exist in the cluster. The ConfigMap is given a hard-coded
 // name: nuxeo cluster name + "-" + node set name + "-nuxeo-conf". E.g.: 'my-nuxeo-cluster-nuxeo-conf'.
 func (r *NuxeoReconciler) reconcileNuxeoConf(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet, backingNuxeoConf string,
 	tlsNuxeoConf string) (string, error) {
 	if shouldReconNuxeoConf(nodeSet, backingNuxeoConf, tlsNuxeoConf) {
-		expected := r.defaultNuxeoConfCM(instance, nodeSet.Name, nodeSet.NuxeoConfig.NuxeoConf.Inline,
-			nodeSet.ClusterEnabled, backingNuxeoConf, tlsNuxeoConf)
-		_, err := r.addOrUpdate(expected.Name, instance.Namespace, expected, &corev1.ConfigMap{},
-			util.ConfigMapComparer)
-		return util.CRC(expected.Data[nuxeoConfName]), err
+		externalNuxeoConf, err := r.getExternalNuxeoConf(instance, nodeSet.NuxeoConfig.NuxeoConf.ValueFrom)
+		if err != nil {
+			return "", err
+		}
+		expected := r.defaultNuxeoConfCM(instance, nodeSet, externalNuxeoConf, backingNuxeoConf, tlsNuxeoConf)
+		if nuxeoConfInSecret(nodeSet) {
+			if err = r.removeIfPresent(instance, expected.Name, instance.Namespace, &corev1.ConfigMap{}); err != nil {
+				return "", err
+			}
+			_, err = r.addOrUpdate(instance, expected.Name, instance.Namespace, nuxeoConfSecret(expected),
+				&corev1.Secret{}, util.SecretComparer)
+		} else {
+			if err = r.removeIfPresent(instance, expected.Name, instance.Namespace, &corev1.Secret{}); err != nil {
+				return "", err
+			}
+			_, err = r.addOrUpdate(instance, expected.Name, instance.Namespace, expected, &corev1.ConfigMap{},
+				util.ConfigMapComparer)
+		}
+		return util.SHA256([]byte(expected.Data[nuxeoConfName])), err
 	} else {
 		cmName := nuxeoConfCMName(instance, nodeSet.Name)
-		return "", r.removeIfPresent(instance, cmName, instance.Namespace, &corev1.ConfigMap{})
+		if err := r.removeIfPresent(instance, cmName, instance.Namespace, &corev1.ConfigMap{}); err != nil {
+			return "", err
+		}
+		return "", r.removeIfPresent(instance, cmName, instance.Namespace, &corev1.Secret{})
+	}
+}
+
+// nuxeoConfInSecret returns true if the generated nuxeo.conf of the passed NodeSet is held in a Secret rather than
+// a ConfigMap. This is the case if the external nuxeo.conf is in a Secret, so that its content - which may include
+// credentials - is not copied into a ConfigMap. The Secret has the same name as the ConfigMap would have.
+func nuxeoConfInSecret(nodeSet v1alpha1.NodeSet) bool {
+	return nodeSet.NuxeoConfig.NuxeoConf.ValueFrom.Secret != nil
+}
+
+// nuxeoConfSecret returns a Secret struct holding the nuxeo.conf from the passed ConfigMap struct generated by
+// defaultNuxeoConfCM, with the same metadata - including the conflicts annotation and the owner reference
+func nuxeoConfSecret(cm *corev1.ConfigMap) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: *cm.ObjectMeta.DeepCopy(),
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{nuxeoConfName: []byte(cm.Data[nuxeoConfName])},
 	}
 }
 
 // Returns true if the Operator should reconcile a nuxeo.conf ConfigMap or Secret to hold nuxeo.conf settings
 func shouldReconNuxeoConf(nodeSet v1alpha1.NodeSet, backingNuxeoConf string, tlsNuxeoConf string) bool {
-	return nodeSet.NuxeoConfig.NuxeoConf.Inline != "" || nodeSet.ClusterEnabled || backingNuxeoConf != "" ||
-		tlsNuxeoConf != ""
-}
-
-// defaultNuxeoConfCM generates a ConfigMap struct in a standard internally-defined form to hold the passed
-// inline nuxeo conf string data, and/or clustering config settings. The generated struct is configured to be
-// owned by the passed 'nux'. A ref to the generated struct is returned.
-func (r *NuxeoReconciler) defaultNuxeoConfCM(instance *v1alpha1.Nuxeo, nodeSetName string,
-	inlineNuxeoConf string, clusterEnabled bool, bindingNuxeoConf string, tlsNuxeoConf string) *corev1.ConfigMap {
-	cmName := nuxeoConfCMName(instance, nodeSetName)
-	clusterNuxeoConf := ""
-	if clusterEnabled {
-		// configureClustering() creates POD_UID. configureClustering will also ensure that a binary
-		// storage is configured. The binary storage will create env var NUXEO_BINARY_STORE.
+	return nodeSet.NuxeoConfig.NuxeoConf.Inline != "" || len(nodeSet.NuxeoConfig.Properties) != 0 ||
+		len(nodeSet.NuxeoConfig.SecretProperties) != 0 ||
+		nodeSet.NuxeoConfig.NuxeoConf.ValueFrom != (corev1.VolumeSource{}) || nodeSet.ClusterEnabled ||
+		backingNuxeoConf != "" || tlsNuxeoConf != ""
+}
+
+// getExternalNuxeoConf gets the content of the external nuxeo.conf from the ConfigMap or Secret referenced by the
+// passed volume source. As with mounting the volume source, the content is the key that is projected to the path
+// 'nuxeo.conf' if the volume source has items, otherwise the 'nuxeo.conf' key. Returns an empty string if the volume
+// source is empty, or if it is optional and the ConfigMap or Secret - or the key - does not exist.
+func (r *NuxeoReconciler) getExternalNuxeoConf(instance *v1alpha1.Nuxeo, valueFrom corev1.VolumeSource) (string,
+	error) {
+	var name string
+	var items []corev1.KeyToPath
+	var optional *bool
+	var obj runtime.Object
+	if valueFrom.ConfigMap != nil {
+		name, items, optional = valueFrom.ConfigMap.Name, valueFrom.ConfigMap.Items, valueFrom.ConfigMap.Optional
+		obj = &corev1.ConfigMap{}
+	} else if valueFrom.Secret != nil {
+		name, items, optional = valueFrom.Secret.SecretName, valueFrom.Secret.Items, valueFrom.Secret.Optional
+		obj = &corev1.Secret{}
+	} else {
+		return "", nil
+	}
+	isOptional := optional != nil && *optional
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: instance.Namespace},
+		obj); err != nil {
+		if apierrors.IsNotFound(err) && isOptional {
+			return "", nil
+		}
+		return "", fmt.Errorf("unable to get external nuxeo.conf resource '%v': %v", name, err)
+	}
+	key := nuxeoConfName
+	for _, item := range items {
+		if item.Path == nuxeoConfName {
+			key = item.Key
+		}
+	}
+	var content string
+	var ok bool
+	if cm, isCm := obj.(*corev1.ConfigMap); isCm {
+		content, ok = cm.Data[key]
+	} else {
+		var data []byte
+		data, ok = obj.(*corev1.Secret).Data[key]
+		content = string(data)
+	}
+	if !ok && !isOptional {
+		return "", fmt.Errorf("external nuxeo.conf resource '%v' does not contain key '%v'", name, key)
+	}
+	return content, nil
+}
+
+// defaultNuxeoConfCM generates a ConfigMap struct in a standard internally-defined form to hold the nuxeo.conf
+// properties for the passed NodeSet. The properties are merged from - in ascending order of precedence - the
+// settings the Operator requires for clustering and TLS, the passed backing service settings, and the passed
+// external nuxeo.conf, the inline nuxeo.conf, the properties map, and the secret properties from the NodeSet. A
+// secret property is rendered as a reference to the environment variable defined by configureSecretProperties.
+// Properties that are set more than once with different values are recorded in an annotation on the ConfigMap, from
+// which they are reported in the NodeSet status. The generated struct is configured to be owned by the passed 'nux'.
+// A ref to the generated struct is returned.
+func (r *NuxeoReconciler) defaultNuxeoConfCM(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet,
+	externalNuxeoConf string, bindingNuxeoConf string, tlsNuxeoConf string) *corev1.ConfigMap {
+	cmName := nuxeoConfCMName(instance, nodeSet.Name)
+	// the properties are set in the order in which the nuxeo.conf sources have always been laid out, so a property
+	// keeps its position relative to the others. Precedence is determined by the source, not the order. Since the
+	// rendered nuxeo.conf has one 'key=value' line per property, without the comments and blank lines of the
+	// sources, it can differ from - and hash differently than - a nuxeo.conf that was concatenated from the sources
+	conf := nuxeoConf{}
+	conf.setAll(externalNuxeoConf, userSource)
+	conf.setAll(nodeSet.NuxeoConfig.NuxeoConf.Inline, userSource)
+	if nodeSet.ClusterEnabled {
+		// configureClustering() creates POD_UID - or POD_NAME for a StatefulSet. configureClustering will also
+		// ensure that a binary storage is configured. The binary storage will create env var NUXEO_BINARY_STORE.
 		// See storage.go
-		clusterNuxeoConf =
-			"repository.binary.store=${env:NUXEO_BINARY_STORE}\n" +
-				"nuxeo.cluster.enabled=true\n" +
-				"nuxeo.cluster.nodeid=${env:POD_UID}\n"
+		// With a binary store such as S3, the binary store is configured by the binary store nuxeo.conf entries.
+		nodeIdEnvVar, _ := clusterNodeIdSource(nodeSet)
+		if instance.Spec.BinaryStore == nil {
+			conf.set("repository.binary.store", "${env:NUXEO_BINARY_STORE}", operatorSource)
+		}
+		conf.set("nuxeo.cluster.enabled", "true", operatorSource)
+		conf.set("nuxeo.cluster.nodeid", "${env:"+nodeIdEnvVar+"}", operatorSource)
+	}
+	conf.setAll(bindingNuxeoConf, backingSource)
+	conf.setAll(tlsNuxeoConf, operatorSource)
+	conf.setMap(nodeSet.NuxeoConfig.Properties, userSource)
+	for _, prop := range nodeSet.NuxeoConfig.SecretProperties {
+		conf.set(prop.Key, "${env:"+secretPropertyEnvVar(prop.Key)+"}", userSource)
 	}
-	allNuxeoConf := joinCompact("\n", inlineNuxeoConf, clusterNuxeoConf, bindingNuxeoConf, tlsNuxeoConf)
 	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cmName,
 			Namespace: instance.Namespace,
+			Labels:    nodeSetLabels(instance, nodeSet),
 		},
-		Data: map[string]string{nuxeoConfName: allNuxeoConf},
+		Data: map[string]string{nuxeoConfName: conf.render()},
+	}
+	if len(conf.conflicts) != 0 {
+		cm.Annotations = map[string]string{common.NuxeoConfConflictsAnnotation: strings.Join(conf.conflicts, "\n")}
 	}
 	_ = controllerutil.SetControllerReference(instance, cm, r.Scheme)
 	return cm
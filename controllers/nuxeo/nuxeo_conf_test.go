@@ -21,19 +21,22 @@ import (
 	"testing"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
 // Tests the basic functionality to create a nuxeo.conf ConfigMap from inlined data in the Nuxeo CR. Defines
 // a Nuxeo CR with inline nuxeo.conf and calls the config map reconciliation. Verifies that a ConfigMap was
-// created that contains the matching nuxeo.conf content.
+// created that contains the matching nuxeo.conf content, and that the returned hash is the SHA-256 of the content.
 func (suite *nuxeoConfSuite) TestBasicInlineNuxeoConf() {
 	nux := suite.nuxeoConfSuiteNewNuxeo()
-	_, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	hash, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
 	require.Nil(suite.T(), err, "reconcileNuxeoConf failed")
 	found := &corev1.ConfigMap{}
 	cmName := nuxeoConfCMName(nux, nux.Spec.NodeSets[0].Name)
@@ -41,6 +44,101 @@ func (suite *nuxeoConfSuite) TestBasicInlineNuxeoConf() {
 	require.Nil(suite.T(), err, "Nuxeo conf ConfigMap creation failed")
 	require.Equal(suite.T(), suite.nuxeoConfContent, found.Data[suite.nuxeoConfKey],
 		"ConfigMap has incorrect nuxeo.conf content")
+	require.Equal(suite.T(), util.SHA256([]byte(found.Data[suite.nuxeoConfKey])), hash,
+		"nuxeo.conf hash should be the SHA-256 of the content")
+}
+
+// TestNuxeoConfPrecedence tests that nuxeo.conf is merged from the Operator settings, the backing service settings,
+// the inline nuxeo.conf, and the properties map with each key appearing once, that the user settings take
+// precedence, and that the conflicts are reported in the NodeSet status
+func (suite *nuxeoConfSuite) TestNuxeoConfPrecedence() {
+	nux := suite.nuxeoConfSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].ClusterEnabled = true
+	nux.Spec.NodeSets[0].NuxeoConfig.NuxeoConf.Inline = "test.test.test=100\nnuxeo.cluster.enabled=false\n"
+	nux.Spec.NodeSets[0].NuxeoConfig.Properties = map[string]string{"test.test.test": "200", "a.b": "c"}
+	backingNuxeoConf := "nuxeo.db.name=nuxeo\nnuxeo.cluster.nodeid=node1\n"
+	_, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], backingNuxeoConf, "")
+	require.Nil(suite.T(), err)
+	cm := suite.getNuxeoConfCM(nux)
+	require.Equal(suite.T(), "test.test.test=200\n"+
+		"nuxeo.cluster.enabled=false\n"+
+		"repository.binary.store=${env:NUXEO_BINARY_STORE}\n"+
+		"nuxeo.cluster.nodeid=node1\n"+
+		"nuxeo.db.name=nuxeo\n"+
+		"a.b=c\n", cm.Data[suite.nuxeoConfKey])
+	expectedConflicts := []string{
+		"nuxeo.cluster.enabled: user overrides operator",
+		"nuxeo.cluster.nodeid: backing services overrides operator",
+		"test.test.test: set more than once by user",
+	}
+	conflicts, err := suite.r.nuxeoConfConflicts(nux, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), expectedConflicts, conflicts)
+}
+
+// TestSecretPropertiesNuxeoConf tests that a secret property is rendered into nuxeo.conf as a reference to its
+// environment variable, and that it overrides a property with the same key
+func (suite *nuxeoConfSuite) TestSecretPropertiesNuxeoConf() {
+	nux := suite.nuxeoConfSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].NuxeoConfig.Properties = map[string]string{"nuxeo.db.user": "nuxeo"}
+	nux.Spec.NodeSets[0].NuxeoConfig.SecretProperties = []v1alpha1.SecretProperty{{
+		Key: "nuxeo.db.password",
+		SecretKeyRef: corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "db-secret"},
+			Key:                  "password",
+		},
+	}, {
+		Key: "nuxeo.db.user",
+		SecretKeyRef: corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "db-secret"},
+			Key:                  "user",
+		},
+	}}
+	_, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), "test.test.test=100\n"+
+		"nuxeo.db.user=${env:NUXEO_CONF_NUXEO_DB_USER}\n"+
+		"nuxeo.db.password=${env:NUXEO_CONF_NUXEO_DB_PASSWORD}\n", suite.getNuxeoConfCM(nux).Data[suite.nuxeoConfKey])
+}
+
+// TestNuxeoConfDeterministic tests that the same nuxeo.conf properties always generate the same hash, and that
+// the conflicts are removed from the ConfigMap when they are resolved
+func (suite *nuxeoConfSuite) TestNuxeoConfDeterministic() {
+	nux := suite.nuxeoConfSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].NuxeoConfig.Properties = map[string]string{"c": "3", "b": "2", "a": "1",
+		"test.test.test": "200"}
+	hash, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	for i := 0; i < 10; i++ {
+		next, _ := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+		require.Equal(suite.T(), hash, next, "nuxeo.conf hash should not have changed")
+	}
+	require.NotEmpty(suite.T(), suite.getNuxeoConfCM(nux).Annotations[common.NuxeoConfConflictsAnnotation])
+	delete(nux.Spec.NodeSets[0].NuxeoConfig.Properties, "test.test.test")
+	_, err = suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	cm := suite.getNuxeoConfCM(nux)
+	require.Equal(suite.T(), "test.test.test=100\na=1\nb=2\nc=3\n", cm.Data[suite.nuxeoConfKey])
+	_, ok := cm.Annotations[common.NuxeoConfConflictsAnnotation]
+	require.False(suite.T(), ok, "Resolved conflicts should have been removed")
+}
+
+// TestParseNuxeoConf tests parsing nuxeo.conf text in the Java properties file format
+func (suite *nuxeoConfSuite) TestParseNuxeoConf() {
+	conf := nuxeoConf{}
+	conf.setAll("# a comment\n! another comment\n\n  a.b = 1\nc.d:2\ne.f 3\ng.h=x=y\n"+
+		"JAVA_OPTS=-Xms1g \\\n    -Xmx2g\nflag\n", userSource)
+	require.Equal(suite.T(), "a.b=1\nc.d=2\ne.f=3\ng.h=x=y\nJAVA_OPTS=-Xms1g -Xmx2g\nflag=\n", conf.render())
+	require.Empty(suite.T(), conf.conflicts)
+}
+
+// TestParseEscapedSeparators tests that a separator escaped with a backslash is part of the key, that the key is
+// rendered with its escapes, and that a key with an escaped separator doesn't collide with its unescaped prefix
+func (suite *nuxeoConfSuite) TestParseEscapedSeparators() {
+	conf := nuxeoConf{}
+	conf.setAll("a\\=b=1\nc\\:d:2\ne\\ f 3\ng\\\\=4\na=5\n", userSource)
+	require.Equal(suite.T(), "a\\=b=1\nc\\:d=2\ne\\ f=3\ng\\\\=4\na=5\n", conf.render())
+	require.Empty(suite.T(), conf.conflicts)
 }
 
 // joinCompact is used to build the combined nuxeo.conf ConfigMap
@@ -57,23 +155,90 @@ func (suite *nuxeoConfSuite) TestJoinCompact() {
 	require.Equal(suite.T(), exp, act, "joinCompact Failed")
 }
 
-// TestExternalNuxeoConf tests when an external source for nuxeo conf is defined by the configurer and another
-// Nuxeo CR setting is configured that requires the operator to own nuxeo.conf - these are incompatible together
+// TestExternalNuxeoConf tests that an external nuxeo.conf from a ConfigMap is merged with the inline nuxeo.conf and
+// the Operator settings into the Operator-managed ConfigMap, that the Deployment mounts the Operator-managed
+// ConfigMap, and that the hash changes when the external nuxeo.conf changes
 func (suite *nuxeoConfSuite) TestExternalNuxeoConf() {
 	nux := suite.nuxeoConfSuiteNewNuxeo()
-	// this indicates that the operator should own a nuxeo.conf ConfigMap
 	nux.Spec.NodeSets[0].ClusterEnabled = true
-	// this indicates that the configurer is mounting an externally provisioned nuxeo.conf source (in this
-	// case a dummy empty dir) which is in conflict with operator-managed nuxeo.conf above
-	nux.Spec.NodeSets[0].NuxeoConfig.NuxeoConf = v1alpha1.NuxeoConfigSetting{
-		ValueFrom: corev1.VolumeSource{
-			EmptyDir: &corev1.EmptyDirVolumeSource{
-				Medium: corev1.StorageMediumDefault,
-			},
+	nux.Spec.NodeSets[0].NuxeoConfig.NuxeoConf.ValueFrom = corev1.VolumeSource{
+		ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "external-nuxeo-conf"},
 		},
 	}
-	err := configureNuxeoConf(nux, nil, nux.Spec.NodeSets[0], "", "")
-	require.NotNil(suite.T(), err, "nuxeo.conf conflict not detected")
+	external := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "external-nuxeo-conf", Namespace: suite.namespace},
+		Data:       map[string]string{"nuxeo.conf": "external.setting=1\ntest.test.test=50\n"},
+	}
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), external))
+	hash, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), "external.setting=1\ntest.test.test=100\n"+
+		"repository.binary.store=${env:NUXEO_BINARY_STORE}\nnuxeo.cluster.enabled=true\n"+
+		"nuxeo.cluster.nodeid=${env:POD_UID}\n", suite.getNuxeoConfCM(nux).Data[suite.nuxeoConfKey])
+	dep := genTestDeploymentForConfigSuite()
+	err = configureNuxeoConf(nux, &dep, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), nuxeoConfCMName(nux, nux.Spec.NodeSets[0].Name),
+		dep.Spec.Template.Spec.Volumes[0].ConfigMap.Name, "Operator-managed nuxeo.conf should have been mounted")
+	external.Data["nuxeo.conf"] = "external.setting=2\n"
+	require.Nil(suite.T(), suite.r.Update(context.TODO(), external))
+	newHash, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	require.NotEqual(suite.T(), hash, newHash, "nuxeo.conf hash should have changed with the external nuxeo.conf")
+}
+
+// TestExternalNuxeoConfSecret tests an external nuxeo.conf from a Secret key that is projected to nuxeo.conf, that
+// a missing external nuxeo.conf is an error unless it is optional, and that the generated nuxeo.conf is held in a
+// Secret rather than a ConfigMap so the content of the external Secret is not copied into a ConfigMap
+func (suite *nuxeoConfSuite) TestExternalNuxeoConfSecret() {
+	nux := suite.nuxeoConfSuiteNewNuxeo()
+	secretSource := &corev1.SecretVolumeSource{
+		SecretName: "external-nuxeo-conf",
+		Items:      []corev1.KeyToPath{{Key: "custom.conf", Path: "nuxeo.conf"}},
+	}
+	nux.Spec.NodeSets[0].NuxeoConfig.NuxeoConf.ValueFrom = corev1.VolumeSource{Secret: secretSource}
+	_, err := suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.NotNil(suite.T(), err, "Missing external nuxeo.conf should have been an error")
+	secretSource.Optional = util.BoolPtr(true)
+	_, err = suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err, "Missing optional external nuxeo.conf should not have been an error")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "external-nuxeo-conf", Namespace: suite.namespace},
+		Data:       map[string][]byte{"custom.conf": []byte("external.setting=1\n")},
+	}
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), secret))
+	nux.Spec.NodeSets[0].NuxeoConfig.Properties = map[string]string{"external.setting": "2"}
+	_, err = suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	cmName := nuxeoConfCMName(nux, nux.Spec.NodeSets[0].Name)
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: cmName, Namespace: suite.namespace},
+		&corev1.ConfigMap{})
+	require.True(suite.T(), apierrors.IsNotFound(err), "nuxeo.conf from a Secret should not be in a ConfigMap")
+	generated := &corev1.Secret{}
+	require.Nil(suite.T(), suite.r.Get(context.TODO(), types.NamespacedName{Name: cmName,
+		Namespace: suite.namespace}, generated))
+	require.Equal(suite.T(), "external.setting=2\ntest.test.test=100\n",
+		string(generated.Data[suite.nuxeoConfKey]))
+	require.True(suite.T(), nux.IsOwner(generated.ObjectMeta))
+	conflicts, err := suite.r.nuxeoConfConflicts(nux, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), []string{"external.setting: set more than once by user"}, conflicts)
+	dep := genTestDeploymentForConfigSuite()
+	err = configureNuxeoConf(nux, &dep, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	require.Nil(suite.T(), dep.Spec.Template.Spec.Volumes[0].ConfigMap)
+	require.Equal(suite.T(), cmName, dep.Spec.Template.Spec.Volumes[0].Secret.SecretName,
+		"Operator-managed nuxeo.conf Secret should have been mounted")
+	// switching to a ConfigMap source moves the generated nuxeo.conf back to a ConfigMap
+	nux.Spec.NodeSets[0].NuxeoConfig.NuxeoConf.ValueFrom = corev1.VolumeSource{}
+	_, err = suite.r.reconcileNuxeoConf(nux, nux.Spec.NodeSets[0], "", "")
+	require.Nil(suite.T(), err)
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: cmName, Namespace: suite.namespace},
+		&corev1.Secret{})
+	require.True(suite.T(), apierrors.IsNotFound(err), "Generated nuxeo.conf Secret should have been removed")
+	require.Equal(suite.T(), "test.test.test=100\nexternal.setting=2\n",
+		suite.getNuxeoConfCM(nux).Data[suite.nuxeoConfKey])
 }
 
 // nuxeoConfSuite is the NuxeoConf test suite structure
@@ -101,6 +266,8 @@ func (suite *nuxeoConfSuite) SetupSuite() {
 func (suite *nuxeoConfSuite) AfterTest(_, _ string) {
 	obj := corev1.ConfigMap{}
 	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	secret := corev1.Secret{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &secret)
 }
 
 // This function runs the NuxeoConf unit test suite. It is called by 'go test' and will call every
@@ -109,6 +276,14 @@ func TestNuxeoConfUnitTestSuite(t *testing.T) {
 	suite.Run(t, new(nuxeoConfSuite))
 }
 
+// getNuxeoConfCM gets the nuxeo.conf ConfigMap generated for the first NodeSet of the passed Nuxeo CR
+func (suite *nuxeoConfSuite) getNuxeoConfCM(nux *v1alpha1.Nuxeo) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: nuxeoConfCMName(nux, nux.Spec.NodeSets[0].Name),
+		Namespace: suite.namespace}, cm)
+	return cm
+}
+
 // nuxeoConfSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
 func (suite *nuxeoConfSuite) nuxeoConfSuiteNewNuxeo() *v1alpha1.Nuxeo {
 	return &v1alpha1.Nuxeo{
@@ -21,9 +21,12 @@ import (
 	"github.com/go-logr/logr"
 	routev1 "github.com/openshift/api/route/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/api/networking/v1beta1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -33,12 +36,18 @@ import (
 // NuxeoReconciler reconciles a Nuxeo object
 type NuxeoReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 // +kubebuilder:rbac:groups=appzygy.net,resources=nuxeos,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=appzygy.net,resources=nuxeos/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
 func (r *NuxeoReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	return r.doReconcile(req)
 }
@@ -50,14 +59,20 @@ func (r *NuxeoReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	ctrllr := ctrl.NewControllerManagedBy(mgr).
 		For(&nuxeov1alpha1.Nuxeo{}).
 		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
 		Owns(&corev1.Service{}).
 		Owns(&corev1.ServiceAccount{}).
 		Owns(&corev1.ConfigMap{}).
-		Owns(&corev1.Secret{})
+		Owns(&corev1.Secret{}).
+		Owns(&autoscalingv2beta2.HorizontalPodAutoscaler{}).
+		Owns(&policyv1beta1.PodDisruptionBudget{})
 	if util.IsOpenShift() {
 		ctrllr = ctrllr.Owns(&routev1.Route{})
 	} else {
 		ctrllr = ctrllr.Owns(&v1beta1.Ingress{})
 	}
+	if err := r.watchReferences(mgr, ctrllr); err != nil {
+		return err
+	}
 	return ctrllr.Complete(r)
 }
@@ -22,6 +22,7 @@ import (
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
@@ -40,31 +41,49 @@ func (r *NuxeoReconciler) doReconcile(request reconcile.Request) (reconcile.Resu
 		}
 		return reconcile.Result{Requeue: true}, err
 	}
+	if deleting, err := r.reconcileFinalizer(instance); err != nil {
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionStorageBound, "RetentionError", err)
+	} else if deleting {
+		r.Log.Info("nuxeo resource is being deleted", kv...)
+		return emptyResult, nil
+	}
 	// only configure service/ingress/route for the interactive NodeSet
 	var interactiveNodeSet v1alpha1.NodeSet
 	if interactiveNodeSet, err = getInteractiveNodeSet(instance.Spec.NodeSets); err != nil {
-		return emptyResult, err
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionReady, "InvalidSpec", err)
 	}
 	if err = r.reconcileService(instance.Spec.Service, interactiveNodeSet, instance); err != nil {
-		return emptyResult, err
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionAccessReady, "ServiceError", err)
 	}
 	if err = r.reconcileAccess(instance.Spec.Access, interactiveNodeSet, instance); err != nil {
-		return emptyResult, err
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionAccessReady, "AccessError", err)
 	}
+	setCondition(instance, v1alpha1.ConditionAccessReady, metav1.ConditionTrue, "Reconciled",
+		"the Service and Route/Ingress were reconciled")
 	if err = r.reconcileServiceAccount(instance); err != nil {
-		return emptyResult, err
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionReady, "ServiceAccountError", err)
 	}
 	if err = r.reconcilePvc(instance); err != nil {
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionStorageBound, "StorageError", err)
+	}
+	if err = r.setStorageCondition(instance); err != nil {
 		return emptyResult, err
 	}
 	if err = r.reconcileClid(instance); err != nil {
-		return emptyResult, err
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionConfigRendered, "ClidError", err)
 	}
 	if requeue, err := r.reconcileNodeSets(instance); err != nil {
-		return emptyResult, err
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionReady, "NodeSetError", err)
 	} else if requeue {
 		return reconcile.Result{Requeue: true}, nil
 	}
+	if err = r.pruneNodeSets(instance); err != nil {
+		return emptyResult, r.reconcileFailed(instance, v1alpha1.ConditionReady, "PruneError", err)
+	}
+	setCondition(instance, v1alpha1.ConditionConfigRendered, metav1.ConditionTrue, "Rendered",
+		"the CLID, contributions, and nuxeo.conf were reconciled")
+	setCondition(instance, v1alpha1.ConditionBackingServicesResolved, metav1.ConditionTrue, "Resolved",
+		fmt.Sprintf("%v backing service(s) resolved", len(instance.Spec.BackingServices)))
 	if err := r.updateNuxeoStatus(instance); err != nil {
 		return emptyResult, err
 	}
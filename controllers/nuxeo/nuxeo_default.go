@@ -0,0 +1,159 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// the JAVA_OPTS used if a NodeSet does not specify any
+	defaultJavaOpts = "-XX:+UnlockExperimentalVMOptions -XX:+UseCGroupMemoryLimitForHeap -XX:MaxRAMFraction=1"
+)
+
+// defaultNuxeo materializes the operator defaults into the passed Nuxeo CR so that the CR shows what will run. Only
+// fields that are not already specified are defaulted. This is called by the mutating admission webhook.
+//
+// The Nuxeo image is defaulted from the Operator configuration once, and is not re-derived. So a later change to the
+// Operator default image - e.g. pinning it to a digest - does not roll an existing Nuxeo CR. The NodeSet JAVA_OPTS,
+// the timings of a specified probe, and the Service type do not depend on anything else.
+//
+// The image pull policy, the probes, and the Service ports are derived from other fields: the pull policy from the
+// image, the probes and the Service ports from the TLS configuration. These are recorded in an annotation on the CR
+// when they are defaulted, and re-derived on each create or update as long as they still have the recorded value.
+// Otherwise a value defaulted into the CR would become stale when its inputs change - e.g. HTTP probes would remain
+// after TLS is enabled. A value that differs from the recorded value was specified by the user, and is left alone.
+func defaultNuxeo(instance *v1alpha1.Nuxeo) {
+	defaults := newDerivedDefaults(instance)
+	if instance.Spec.NuxeoImage == "" {
+		instance.Spec.NuxeoImage = imageConfig.NuxeoImage
+	}
+	pullPolicy := defaultImagePullPolicy(instance.Spec.NuxeoImage)
+	defaults.derive("imagePullPolicy", instance.Spec.ImagePullPolicy != "", instance.Spec.ImagePullPolicy,
+		pullPolicy, func() { instance.Spec.ImagePullPolicy = pullPolicy })
+	isTLS := false
+	for i := range instance.Spec.NodeSets {
+		nodeSet := &instance.Spec.NodeSets[i]
+		if nodeSet.NuxeoConfig.JavaOpts == "" {
+			nodeSet.NuxeoConfig.JavaOpts = defaultJavaOpts
+		}
+		useHttps := nodeSet.NuxeoConfig.TlsSecret != ""
+		if nodeSet.Interactive {
+			isTLS = useHttps
+		}
+		liveness, readiness := defaultProbe(useHttps), defaultProbe(useHttps)
+		defaults.derive("nodeSets."+nodeSet.Name+".livenessProbe", nodeSet.LivenessProbe != nil,
+			nodeSet.LivenessProbe, liveness, func() { nodeSet.LivenessProbe = liveness })
+		defaults.derive("nodeSets."+nodeSet.Name+".readinessProbe", nodeSet.ReadinessProbe != nil,
+			nodeSet.ReadinessProbe, readiness, func() { nodeSet.ReadinessProbe = readiness })
+		setProbeDefaults(nodeSet.LivenessProbe)
+		setProbeDefaults(nodeSet.ReadinessProbe)
+	}
+	svc := &instance.Spec.Service
+	if svc.Type == "" {
+		svc.Type = corev1.ServiceTypeClusterIP
+	}
+	ports := defaultServiceSpec(instance, v1alpha1.ServiceSpec{}, isTLS)
+	defaults.derive("service.port", svc.Port != 0, svc.Port, ports.Port, func() { svc.Port = ports.Port })
+	defaults.derive("service.targetPort", svc.TargetPort != 0, svc.TargetPort, ports.TargetPort,
+		func() { svc.TargetPort = ports.TargetPort })
+	defaults.record(instance)
+}
+
+// derivedDefaults tracks the values that defaultNuxeo derives from other fields of a Nuxeo CR. The values are
+// recorded as JSON by field path in the DerivedDefaultsAnnotation of the CR. 'recorded' holds the values from the
+// previous defaulting pass, and 'derived' the values of the current pass.
+type derivedDefaults struct {
+	recorded map[string]string
+	derived  map[string]string
+}
+
+// newDerivedDefaults returns a derivedDefaults struct with the values recorded in the annotation of the passed CR
+func newDerivedDefaults(instance *v1alpha1.Nuxeo) derivedDefaults {
+	defaults := derivedDefaults{recorded: map[string]string{}, derived: map[string]string{}}
+	if recorded, ok := instance.Annotations[common.DerivedDefaultsAnnotation]; ok {
+		// an annotation that can't be parsed is treated as empty, so every value is considered user-specified
+		_ = json.Unmarshal([]byte(recorded), &defaults.recorded)
+	}
+	return defaults
+}
+
+// derive sets the field with the passed path to the passed derived value - by calling 'set' - and records the value,
+// unless the field was specified by the user. That is the case if the field is set, and its current value differs
+// from the value that was recorded when it was last derived.
+func (d derivedDefaults) derive(path string, isSet bool, current interface{}, derived interface{}, set func()) {
+	if isSet && d.recorded[path] != toJson(current) {
+		return
+	}
+	set()
+	d.derived[path] = toJson(derived)
+}
+
+// record replaces the annotation of the passed CR with the values derived in the current defaulting pass. The
+// annotation is removed if no value was derived.
+func (d derivedDefaults) record(instance *v1alpha1.Nuxeo) {
+	if len(d.derived) == 0 {
+		delete(instance.Annotations, common.DerivedDefaultsAnnotation)
+		return
+	}
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[common.DerivedDefaultsAnnotation] = toJson(d.derived)
+}
+
+// toJson returns the JSON representation of the passed value. Map keys are sorted, so the representation is stable
+func toJson(val interface{}) string {
+	b, _ := json.Marshal(val)
+	return string(b)
+}
+
+// defaultImagePullPolicy returns the pull policy for the passed image if the Nuxeo CR does not specify one:
+// Always for a ':latest' image, otherwise IfNotPresent
+func defaultImagePullPolicy(image string) corev1.PullPolicy {
+	if strings.HasSuffix(image, ":latest") {
+		return corev1.PullAlways
+	}
+	return corev1.PullIfNotPresent
+}
+
+// defaultServiceSpec returns a copy of the passed ServiceSpec with any unspecified fields defaulted. The type
+// defaults to ClusterIP. The ports default to 80 -> 8080, or, 443 -> 8443 if either Nuxeo or the reverse proxy
+// is terminating TLS.
+func defaultServiceSpec(instance *v1alpha1.Nuxeo, svc v1alpha1.ServiceSpec, isTLS bool) v1alpha1.ServiceSpec {
+	var port int32 = 80
+	var targetPort int32 = 8080
+	if isTLS || instance.Spec.RevProxy != (v1alpha1.RevProxySpec{}) {
+		port = 443
+		targetPort = 8443
+	}
+	if svc.Type == "" {
+		svc.Type = corev1.ServiceTypeClusterIP
+	}
+	if svc.Port == 0 {
+		svc.Port = port
+	}
+	if svc.TargetPort == 0 {
+		svc.TargetPort = targetPort
+	}
+	return svc
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Tests that an empty CR is defaulted with the values the reconciler would otherwise derive
+func (suite *nuxeoDefaultSuite) TestDefaultNuxeo() {
+	nux := suite.nuxeoDefaultSuiteNewNuxeo()
+	defaultNuxeo(nux)
+	require.Equal(suite.T(), defaultNuxeoImage, nux.Spec.NuxeoImage)
+	require.Equal(suite.T(), corev1.PullAlways, nux.Spec.ImagePullPolicy)
+	require.Equal(suite.T(), defaultJavaOpts, nux.Spec.NodeSets[0].NuxeoConfig.JavaOpts)
+	require.Equal(suite.T(), defaultProbe(false), nux.Spec.NodeSets[0].LivenessProbe)
+	require.Equal(suite.T(), defaultProbe(false), nux.Spec.NodeSets[0].ReadinessProbe)
+	require.Equal(suite.T(), v1alpha1.ServiceSpec{Type: corev1.ServiceTypeClusterIP, Port: 80, TargetPort: 8080},
+		nux.Spec.Service)
+	require.NotEmpty(suite.T(), nux.Annotations[common.DerivedDefaultsAnnotation])
+	// defaulting a defaulted CR is a no-op
+	defaulted := nux.DeepCopy()
+	defaultNuxeo(nux)
+	require.Equal(suite.T(), defaulted, nux)
+}
+
+// Tests that explicitly specified values are not overwritten by defaulting, and that the timings of a specified
+// probe are defaulted
+func (suite *nuxeoDefaultSuite) TestDefaultNuxeoPreservesExplicit() {
+	nux := suite.nuxeoDefaultSuiteNewNuxeo()
+	nux.Spec.NuxeoImage = "nuxeo:10.10"
+	nux.Spec.NodeSets[0].NuxeoConfig.JavaOpts = "-Xms1g"
+	nux.Spec.NodeSets[0].LivenessProbe = &corev1.Probe{InitialDelaySeconds: 100}
+	nux.Spec.Service.Type = corev1.ServiceTypeNodePort
+	nux.Spec.Service.Port = 8888
+	defaultNuxeo(nux)
+	require.Equal(suite.T(), "nuxeo:10.10", nux.Spec.NuxeoImage)
+	require.Equal(suite.T(), corev1.PullIfNotPresent, nux.Spec.ImagePullPolicy)
+	require.Equal(suite.T(), "-Xms1g", nux.Spec.NodeSets[0].NuxeoConfig.JavaOpts)
+	require.Equal(suite.T(), int32(100), nux.Spec.NodeSets[0].LivenessProbe.InitialDelaySeconds)
+	require.Equal(suite.T(), int32(3), nux.Spec.NodeSets[0].LivenessProbe.FailureThreshold)
+	require.Nil(suite.T(), nux.Spec.NodeSets[0].LivenessProbe.HTTPGet)
+	require.Equal(suite.T(), corev1.ServiceTypeNodePort, nux.Spec.Service.Type)
+	require.Equal(suite.T(), int32(8888), nux.Spec.Service.Port)
+	require.Equal(suite.T(), int32(8080), nux.Spec.Service.TargetPort)
+}
+
+// Tests that the defaults derived from other fields follow a change to those fields in a defaulted CR, rather than
+// being frozen into the CR when it was defaulted, and that a derived value changed by the user is no longer derived
+func (suite *nuxeoDefaultSuite) TestDefaultNuxeoNotFrozen() {
+	nux := suite.nuxeoDefaultSuiteNewNuxeo()
+	defaultNuxeo(nux)
+	nux.Spec.NodeSets[0].NuxeoConfig.TlsSecret = "tls-secret"
+	nux.Spec.NuxeoImage = "nuxeo:10.10"
+	defaultNuxeo(nux)
+	require.Equal(suite.T(), defaultProbe(true), nux.Spec.NodeSets[0].LivenessProbe)
+	require.Equal(suite.T(), defaultProbe(true), nux.Spec.NodeSets[0].ReadinessProbe)
+	require.Equal(suite.T(), int32(443), nux.Spec.Service.Port)
+	require.Equal(suite.T(), int32(8443), nux.Spec.Service.TargetPort)
+	require.Equal(suite.T(), corev1.PullIfNotPresent, nux.Spec.ImagePullPolicy)
+	// the user takes ownership of a derived value by changing it
+	nux.Spec.ImagePullPolicy = corev1.PullAlways
+	nux.Spec.NodeSets[0].ReadinessProbe.InitialDelaySeconds = 60
+	nux.Spec.NodeSets[0].NuxeoConfig.TlsSecret = ""
+	defaultNuxeo(nux)
+	require.Equal(suite.T(), corev1.PullAlways, nux.Spec.ImagePullPolicy)
+	require.Equal(suite.T(), int32(60), nux.Spec.NodeSets[0].ReadinessProbe.InitialDelaySeconds)
+	require.Equal(suite.T(), corev1.URISchemeHTTPS, nux.Spec.NodeSets[0].ReadinessProbe.HTTPGet.Scheme)
+	require.Equal(suite.T(), defaultProbe(false), nux.Spec.NodeSets[0].LivenessProbe)
+	require.Equal(suite.T(), int32(80), nux.Spec.Service.Port)
+}
+
+// Tests that the Nuxeo image is defaulted once, so a change to the Operator default image does not change the image
+// of a defaulted CR
+func (suite *nuxeoDefaultSuite) TestDefaultNuxeoImageNotRederived() {
+	nux := suite.nuxeoDefaultSuiteNewNuxeo()
+	defaultNuxeo(nux)
+	ConfigureImages(ImageConfig{NuxeoImage: "nuxeo@sha256:0123456789abcdef"})
+	defer ConfigureImages(ImageConfig{})
+	defaultNuxeo(nux)
+	require.Equal(suite.T(), defaultNuxeoImage, nux.Spec.NuxeoImage)
+	require.Equal(suite.T(), corev1.PullAlways, nux.Spec.ImagePullPolicy)
+}
+
+// Tests that the mutating webhook handler returns a patch for an un-defaulted CR
+func (suite *nuxeoDefaultSuite) TestDefaulterHandler() {
+	s := runtime.NewScheme()
+	require.Nil(suite.T(), v1alpha1.AddToScheme(s))
+	decoder, err := admission.NewDecoder(s)
+	require.Nil(suite.T(), err)
+	d := &NuxeoDefaulter{}
+	require.Nil(suite.T(), d.InjectDecoder(decoder))
+	nux := suite.nuxeoDefaultSuiteNewNuxeo()
+	raw, _ := json.Marshal(nux)
+	resp := d.Handle(context.TODO(), admission.Request{
+		AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	require.True(suite.T(), resp.Allowed)
+	require.NotEqual(suite.T(), 0, len(resp.Patches), "Expected defaulting patches")
+}
+
+// nuxeoDefaultSuite is the defaulting test suite structure
+type nuxeoDefaultSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *nuxeoDefaultSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *nuxeoDefaultSuite) AfterTest(_, _ string) {
+	// nop
+}
+
+// This function runs the defaulting unit test suite. It is called by 'go test' and will call every
+// function in this file with a nuxeoDefaultSuite receiver that begins with "Test..."
+func TestNuxeoDefaultUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(nuxeoDefaultSuite))
+}
+
+// nuxeoDefaultSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
+func (suite *nuxeoDefaultSuite) nuxeoDefaultSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "Nuxeo",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:        "test",
+				Replicas:    1,
+				Interactive: true,
+			}},
+		},
+	}
+}
@@ -18,44 +18,348 @@ package nuxeo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// updateNuxeoStatus updates the status field in the Nuxeo CR being watched by the operator
-func (r *NuxeoReconciler) updateNuxeoStatus(instance *v1alpha1.Nuxeo) error {
-	deployments := appsv1.DeploymentList{}
-	opts := []client.ListOption{
-		client.InNamespace(instance.Namespace),
+// conditionError associates a reconciliation error with the status condition that the error falsifies, so that
+// errors raised deep in the reconciliation can be reported against the correct condition by the reconciler
+type conditionError struct {
+	condType string
+	reason   string
+	err      error
+}
+
+func (e *conditionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *conditionError) Unwrap() error {
+	return e.err
+}
+
+// withCondition wraps the passed error in a conditionError. If the passed error is nil then nil is returned. If
+// the passed error already carries a condition then it is returned as is, so the most specific condition wins.
+func withCondition(condType string, reason string, err error) error {
+	var condErr *conditionError
+	if err == nil {
+		return nil
+	} else if errors.As(err, &condErr) {
+		return err
 	}
-	desiredNodes := int32(0)
+	return &conditionError{condType: condType, reason: reason, err: err}
+}
+
+// updateNuxeoStatus updates the status field in the Nuxeo CR being watched by the operator. The status of each
+// NodeSet is obtained from the NodeSet's Deployment or StatefulSet, and the top-level status is derived from the
+// NodeSet statuses. The interactive NodeSet is critical: if it is unavailable then the cluster is unavailable,
+// regardless of the state of the other NodeSets.
+func (r *NuxeoReconciler) updateNuxeoStatus(instance *v1alpha1.Nuxeo) error {
+	desiredNodes, availableNodes := int32(0), int32(0)
+	var nodeSetStatuses []v1alpha1.NodeSetStatus
 	for _, nodeSet := range instance.Spec.NodeSets {
-		desiredNodes += nodeSet.Replicas
+		nodeSetStatus, err := r.nodeSetStatus(instance, nodeSet)
+		if err != nil {
+			return err
+		}
+		nodeSetStatuses = append(nodeSetStatuses, nodeSetStatus)
+		desiredNodes += nodeSetStatus.DesiredReplicas
+		availableNodes += nodeSetStatus.AvailableReplicas
+	}
+	instance.Status.NodeSets = nodeSetStatuses
+	instance.Status.DesiredNodes = desiredNodes
+	instance.Status.AvailableNodes = availableNodes
+	instance.Status.Status = clusterHealth(nodeSetStatuses)
+	instance.Status.Replicas = 0
+	for _, nodeSetStatus := range nodeSetStatuses {
+		if nodeSetStatus.Interactive {
+			instance.Status.Replicas = nodeSetStatus.DesiredReplicas
+		}
 	}
-	availableNodes := int32(0)
-	if err := r.List(context.TODO(), &deployments, opts...); err != nil {
+	instance.Status.Selector = labels.SelectorFromSet(labelsForNuxeo(instance, true)).String()
+	setReadyCondition(instance)
+	instance.Status.ObservedGeneration = instance.Generation
+	if err := r.Status().Update(context.TODO(), instance); err != nil {
 		return err
+	}
+	return nil
+}
+
+// nodeSetStatus gets the Deployment - or StatefulSet - for the passed NodeSet and returns a NodeSetStatus struct
+// describing it. If the workload does not exist - or is not owned by the passed Nuxeo CR - then the NodeSet is
+// reported unavailable. If the NodeSet replicas are managed outside of the Operator then the desired replicas are
+// taken from the workload. The nuxeo.conf conflicts are obtained from the NodeSet's nuxeo.conf ConfigMap.
+func (r *NuxeoReconciler) nodeSetStatus(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) (v1alpha1.NodeSetStatus,
+	error) {
+	nodeSetStatus := v1alpha1.NodeSetStatus{
+		Name:            nodeSet.Name,
+		DeploymentName:  deploymentName(instance, nodeSet),
+		WorkloadType:    v1alpha1.WorkloadType(workloadKind(nodeSet)),
+		Interactive:     nodeSet.Interactive,
+		DesiredReplicas: nodeSetReplicas(instance, nodeSet),
+		Rollout:         v1alpha1.RolloutProgressing,
+		Status:          v1alpha1.StatusUnavailable,
+	}
+	var found bool
+	var err error
+	if nodeSetStatus.NuxeoConfConflicts, err = r.nuxeoConfConflicts(instance, nodeSet); err != nil {
+		return nodeSetStatus, err
+	}
+	if isStatefulSet(nodeSet) {
+		found, err = r.statefulSetStatus(instance, nodeSet, &nodeSetStatus)
 	} else {
-		for _, dep := range deployments.Items {
-			if instance.IsOwner(dep.ObjectMeta) {
-				availableNodes += dep.Status.AvailableReplicas
-			}
+		found, err = r.deploymentStatus(instance, nodeSet, &nodeSetStatus)
+	}
+	if err != nil || !found {
+		return nodeSetStatus, err
+	}
+	switch {
+	case nodeSetStatus.AvailableReplicas == 0:
+		nodeSetStatus.Status = v1alpha1.StatusUnavailable
+	case nodeSetStatus.AvailableReplicas >= nodeSetStatus.DesiredReplicas:
+		nodeSetStatus.Status = v1alpha1.StatusHealthy
+	default:
+		nodeSetStatus.Status = v1alpha1.StatusDegraded
+	}
+	return nodeSetStatus, nil
+}
+
+// deploymentStatus populates the passed NodeSetStatus from the Deployment of the passed NodeSet. Returns false if
+// the Deployment does not exist or is not owned by the passed Nuxeo CR.
+func (r *NuxeoReconciler) deploymentStatus(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet,
+	nodeSetStatus *v1alpha1.NodeSetStatus) (bool, error) {
+	dep := appsv1.Deployment{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: nodeSetStatus.DeploymentName,
+		Namespace: instance.Namespace}, &dep); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	} else if !instance.IsOwner(dep.ObjectMeta) {
+		return false, nil
+	}
+	if replicasManagedExternally(nodeSet) && dep.Spec.Replicas != nil {
+		nodeSetStatus.DesiredReplicas = *dep.Spec.Replicas
+	}
+	nodeSetStatus.ReadyReplicas = dep.Status.ReadyReplicas
+	nodeSetStatus.UpdatedReplicas = dep.Status.UpdatedReplicas
+	nodeSetStatus.AvailableReplicas = dep.Status.AvailableReplicas
+	nodeSetStatus.NuxeoConfHash = dep.Spec.Template.Annotations[common.NuxeoConfHashAnnotation]
+	nodeSetStatus.Rollout = rolloutState(dep, nodeSetStatus.DesiredReplicas)
+	return true, nil
+}
+
+// statefulSetStatus populates the passed NodeSetStatus from the StatefulSet of the passed NodeSet. Returns false if
+// the StatefulSet does not exist or is not owned by the passed Nuxeo CR. A StatefulSet does not report available
+// replicas so ready replicas are reported as available.
+func (r *NuxeoReconciler) statefulSetStatus(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet,
+	nodeSetStatus *v1alpha1.NodeSetStatus) (bool, error) {
+	sts := appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: nodeSetStatus.DeploymentName,
+		Namespace: instance.Namespace}, &sts); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
 		}
-		instance.Status.DesiredNodes = desiredNodes
-		instance.Status.AvailableNodes = availableNodes
-		switch {
-		case availableNodes == 0:
-			instance.Status.Status = v1alpha1.StatusUnavailable
-		case availableNodes == desiredNodes:
-			instance.Status.Status = v1alpha1.StatusHealthy
-		default:
-			instance.Status.Status = v1alpha1.StatusDegraded
+		return false, err
+	} else if !instance.IsOwner(sts.ObjectMeta) {
+		return false, nil
+	}
+	if replicasManagedExternally(nodeSet) && sts.Spec.Replicas != nil {
+		nodeSetStatus.DesiredReplicas = *sts.Spec.Replicas
+	}
+	nodeSetStatus.ReadyReplicas = sts.Status.ReadyReplicas
+	nodeSetStatus.UpdatedReplicas = sts.Status.UpdatedReplicas
+	nodeSetStatus.AvailableReplicas = sts.Status.ReadyReplicas
+	nodeSetStatus.NuxeoConfHash = sts.Spec.Template.Annotations[common.NuxeoConfHashAnnotation]
+	nodeSetStatus.Rollout = statefulSetRolloutState(sts, nodeSetStatus.DesiredReplicas)
+	return true, nil
+}
+
+// nuxeoConfConflicts returns the nuxeo.conf conflicts recorded on the nuxeo.conf ConfigMap - or Secret - of the
+// passed NodeSet, or nil if there are none, or if the ConfigMap does not exist or is not owned by the passed Nuxeo CR
+func (r *NuxeoReconciler) nuxeoConfConflicts(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) ([]string, error) {
+	var obj runtime.Object
+	var meta *metav1.ObjectMeta
+	if nuxeoConfInSecret(nodeSet) {
+		secret := &corev1.Secret{}
+		obj, meta = secret, &secret.ObjectMeta
+	} else {
+		cm := &corev1.ConfigMap{}
+		obj, meta = cm, &cm.ObjectMeta
+	}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: nuxeoConfCMName(instance, nodeSet.Name),
+		Namespace: instance.Namespace}, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
 		}
+		return nil, err
+	} else if !instance.IsOwner(*meta) {
+		return nil, nil
 	}
-	if err := r.Status().Update(context.TODO(), instance); err != nil {
+	if conflicts := meta.Annotations[common.NuxeoConfConflictsAnnotation]; conflicts != "" {
+		return strings.Split(conflicts, "\n"), nil
+	}
+	return nil, nil
+}
+
+// rolloutState determines the rollout state of the passed Deployment the same way 'kubectl rollout status'
+// does: the rollout is stalled if the Deployment has exceeded its progress deadline, and complete if the
+// Deployment controller has observed the current generation and all desired replicas are updated and available.
+func rolloutState(dep appsv1.Deployment, desired int32) v1alpha1.RolloutState {
+	for _, cond := range dep.Status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+			return v1alpha1.RolloutStalled
+		}
+	}
+	if dep.Status.ObservedGeneration >= dep.Generation && dep.Status.UpdatedReplicas >= desired &&
+		dep.Status.AvailableReplicas >= desired && dep.Status.Replicas == dep.Status.UpdatedReplicas {
+		return v1alpha1.RolloutComplete
+	}
+	return v1alpha1.RolloutProgressing
+}
+
+// statefulSetRolloutState determines the rollout state of the passed StatefulSet the same way 'kubectl rollout
+// status' does: the rollout is complete if the StatefulSet controller has observed the current generation, all
+// desired replicas are updated and ready, and the update revision has become the current revision. A StatefulSet
+// has no progress deadline and so its rollout is never reported as stalled.
+func statefulSetRolloutState(sts appsv1.StatefulSet, desired int32) v1alpha1.RolloutState {
+	if sts.Status.ObservedGeneration >= sts.Generation && sts.Status.UpdatedReplicas >= desired &&
+		sts.Status.ReadyReplicas >= desired && sts.Status.UpdateRevision == sts.Status.CurrentRevision {
+		return v1alpha1.RolloutComplete
+	}
+	return v1alpha1.RolloutProgressing
+}
+
+// clusterHealth derives the health of the Nuxeo cluster from the passed NodeSet statuses. The cluster is healthy if
+// every NodeSet is healthy. The cluster is unavailable if the interactive NodeSet is unavailable, or if every
+// NodeSet is unavailable. Otherwise the cluster is degraded.
+func clusterHealth(nodeSetStatuses []v1alpha1.NodeSetStatus) v1alpha1.StatusValue {
+	healthy, unavailable := 0, 0
+	for _, nodeSetStatus := range nodeSetStatuses {
+		switch nodeSetStatus.Status {
+		case v1alpha1.StatusHealthy:
+			healthy++
+		case v1alpha1.StatusUnavailable:
+			if nodeSetStatus.Interactive {
+				return v1alpha1.StatusUnavailable
+			}
+			unavailable++
+		}
+	}
+	switch {
+	case unavailable == len(nodeSetStatuses):
+		return v1alpha1.StatusUnavailable
+	case healthy == len(nodeSetStatuses):
+		return v1alpha1.StatusHealthy
+	default:
+		return v1alpha1.StatusDegraded
+	}
+}
+
+// reconcileFailed is called by the reconciler when a reconciliation step fails. It sets the passed condition type
+// to False with the passed reason and the error message - unless the error is a conditionError, in which case the
+// condition type and reason are taken from the error. The Ready condition is also set to False. The status is then
+// written to the cluster, and a Warning event is recorded against the Nuxeo CR, so that the failure is visible to
+// users who do not have access to the Operator logs. The passed error is always returned so
+// the caller can return it to the controller runtime.
+func (r *NuxeoReconciler) reconcileFailed(instance *v1alpha1.Nuxeo, condType string, reason string, err error) error {
+	var condErr *conditionError
+	if errors.As(err, &condErr) {
+		condType, reason = condErr.condType, condErr.reason
+	}
+	r.Recorder.Event(instance, corev1.EventTypeWarning, reason, err.Error())
+	if condType != v1alpha1.ConditionReady {
+		setCondition(instance, condType, metav1.ConditionFalse, reason, err.Error())
+	}
+	setCondition(instance, v1alpha1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+	instance.Status.ObservedGeneration = instance.Generation
+	if statusErr := r.Status().Update(context.TODO(), instance); statusErr != nil {
+		r.Log.Error(statusErr, "unable to update Nuxeo status", "Namespace", instance.Namespace,
+			"Name", instance.Name)
+	}
+	return err
+}
+
+// setStorageCondition sets the StorageBound condition based on the phase of the PVCs owned by the passed Nuxeo CR
+func (r *NuxeoReconciler) setStorageCondition(instance *v1alpha1.Nuxeo) error {
+	pvcs := corev1.PersistentVolumeClaimList{}
+	opts := []client.ListOption{
+		client.InNamespace(instance.Namespace),
+	}
+	if err := r.List(context.TODO(), &pvcs, opts...); err != nil {
 		return err
 	}
+	for _, pvc := range pvcs.Items {
+		if ownsPvc(instance, pvc.ObjectMeta) && pvc.Status.Phase != corev1.ClaimBound {
+			setCondition(instance, v1alpha1.ConditionStorageBound, metav1.ConditionFalse, "ClaimNotBound",
+				fmt.Sprintf("PVC '%v' is in phase '%v'", pvc.Name, pvc.Status.Phase))
+			return nil
+		}
+	}
+	setCondition(instance, v1alpha1.ConditionStorageBound, metav1.ConditionTrue, "ClaimsBound",
+		"all Operator-managed PVCs are bound")
+	return nil
+}
+
+// setReadyCondition sets the Ready condition from the other conditions and from the health of the Nuxeo cluster.
+// Ready is True only if no other condition is False, and all desired nodes are available.
+func setReadyCondition(instance *v1alpha1.Nuxeo) {
+	for _, cond := range instance.Status.Conditions {
+		if cond.Type != v1alpha1.ConditionReady && cond.Status == metav1.ConditionFalse {
+			setCondition(instance, v1alpha1.ConditionReady, metav1.ConditionFalse, cond.Reason,
+				cond.Type+": "+cond.Message)
+			return
+		}
+	}
+	message := fmt.Sprintf("%v of %v nodes available", instance.Status.AvailableNodes,
+		instance.Status.DesiredNodes)
+	switch instance.Status.Status {
+	case v1alpha1.StatusHealthy:
+		setCondition(instance, v1alpha1.ConditionReady, metav1.ConditionTrue, "Available", message)
+	case v1alpha1.StatusDegraded:
+		setCondition(instance, v1alpha1.ConditionReady, metav1.ConditionFalse, "Degraded", message)
+	default:
+		setCondition(instance, v1alpha1.ConditionReady, metav1.ConditionFalse, "Unavailable", message)
+	}
+}
+
+// setCondition adds or updates the condition of the passed type in the passed Nuxeo CR status. The transition
+// time is only changed if the status of the condition changes.
+func setCondition(instance *v1alpha1.Nuxeo, condType string, status metav1.ConditionStatus, reason string,
+	message string) {
+	cond := getCondition(instance, condType)
+	if cond == nil {
+		instance.Status.Conditions = append(instance.Status.Conditions, v1alpha1.NuxeoCondition{Type: condType})
+		cond = &instance.Status.Conditions[len(instance.Status.Conditions)-1]
+	}
+	if cond.Status != status {
+		cond.Status = status
+		cond.LastTransitionTime = metav1.Now()
+	}
+	cond.Reason = reason
+	cond.Message = message
+	cond.ObservedGeneration = instance.Generation
+}
+
+// getCondition returns a ref to the condition of the passed type in the passed Nuxeo CR status, or nil if
+// there is no such condition
+func getCondition(instance *v1alpha1.Nuxeo, condType string) *v1alpha1.NuxeoCondition {
+	for i := range instance.Status.Conditions {
+		if instance.Status.Conditions[i].Type == condType {
+			return &instance.Status.Conditions[i]
+		}
+	}
 	return nil
 }
@@ -18,9 +18,11 @@ package nuxeo
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
 	"github.com/aceeric/nuxeo-operator/controllers/util"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -43,47 +45,90 @@ func (suite *nuxeoStatusSuite) TestNuxeoStatus() {
 	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: suite.nuxeoName, Namespace: suite.namespace}, nux)
 	require.Nil(suite.T(), err)
 	require.Equal(suite.T(), v1alpha1.StatusUnavailable, nux.Status.Status)
-	dep := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "x",
-			Namespace: suite.namespace,
-			OwnerReferences: []metav1.OwnerReference{{
-				APIVersion: "v1alpha1",
-				Kind:       "Nuxeo",
-				Name:       suite.nuxeoName,
-				UID:        nux.UID,
-			}},
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: util.Int32Ptr(4),
-			Template: corev1.PodTemplateSpec{
-				Spec: corev1.PodSpec{
-					ServiceAccountName: NuxeoServiceAccountName,
-					Containers: []corev1.Container{{
-						Name: "nuxeo",
-					}},
-				},
-			},
-		},
-	}
-	// fake doesn't update available replicas
-	dep.Status.AvailableReplicas = *dep.Spec.Replicas
-	err = suite.r.Create(context.TODO(), dep)
+	require.Equal(suite.T(), 2, len(nux.Status.NodeSets))
+	fooDep := suite.nuxeoStatusSuiteNewDeployment(nux, "foo", 3)
+	err = suite.r.Create(context.TODO(), fooDep)
 	require.Nil(suite.T(), err)
 	err = suite.r.updateNuxeoStatus(nux)
 	require.Nil(suite.T(), err)
 	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: suite.nuxeoName, Namespace: suite.namespace}, nux)
 	require.Nil(suite.T(), err)
 	require.Equal(suite.T(), v1alpha1.StatusDegraded, nux.Status.Status)
-	dep.Spec.Replicas = util.Int32Ptr(5)
-	dep.Status.AvailableReplicas = *dep.Spec.Replicas
-	err = suite.r.Client.Update(context.TODO(), dep)
+	require.Equal(suite.T(), v1alpha1.StatusHealthy, nux.Status.NodeSets[0].Status)
+	require.Equal(suite.T(), "abc", nux.Status.NodeSets[0].NuxeoConfHash)
+	require.Equal(suite.T(), v1alpha1.StatusUnavailable, nux.Status.NodeSets[1].Status)
+	barDep := suite.nuxeoStatusSuiteNewDeployment(nux, "bar", 2)
+	err = suite.r.Create(context.TODO(), barDep)
 	require.Nil(suite.T(), err)
 	err = suite.r.updateNuxeoStatus(nux)
 	require.Nil(suite.T(), err)
 	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: suite.nuxeoName, Namespace: suite.namespace}, nux)
 	require.Nil(suite.T(), err)
 	require.Equal(suite.T(), v1alpha1.StatusHealthy, nux.Status.Status)
+	require.Equal(suite.T(), int32(5), nux.Status.AvailableNodes)
+	require.Equal(suite.T(), v1alpha1.RolloutComplete, nux.Status.NodeSets[1].Rollout)
+}
+
+// TestClusterHealth tests that an unavailable interactive NodeSet makes the cluster unavailable, whereas an
+// unavailable worker NodeSet only degrades the cluster
+func (suite *nuxeoStatusSuite) TestClusterHealth() {
+	nodeSetStatuses := []v1alpha1.NodeSetStatus{{
+		Name:        "interactive",
+		Interactive: true,
+		Status:      v1alpha1.StatusHealthy,
+	}, {
+		Name:   "worker",
+		Status: v1alpha1.StatusUnavailable,
+	}}
+	require.Equal(suite.T(), v1alpha1.StatusDegraded, clusterHealth(nodeSetStatuses))
+	nodeSetStatuses[0].Status, nodeSetStatuses[1].Status = v1alpha1.StatusUnavailable, v1alpha1.StatusHealthy
+	require.Equal(suite.T(), v1alpha1.StatusUnavailable, clusterHealth(nodeSetStatuses))
+}
+
+// TestNuxeoStatusConditions tests that a reconciliation failure is reported in the conditions against the
+// condition type carried by the error, and that the Ready condition follows
+func (suite *nuxeoStatusSuite) TestNuxeoStatusConditions() {
+	nux := suite.nuxeoStatusSuiteNewNuxeo()
+	nux.UID = "87654321-1234-1234-1234-123456789012"
+	nux.Generation = 3
+	err := suite.r.Create(context.TODO(), nux)
+	require.Nil(suite.T(), err)
+	cause := fmt.Errorf("backing service resource not found")
+	err = suite.r.reconcileFailed(nux, v1alpha1.ConditionReady, "NodeSetError",
+		withCondition(v1alpha1.ConditionBackingServicesResolved, "BackingServiceError", cause))
+	require.Equal(suite.T(), cause.Error(), err.Error())
+	err = suite.r.Client.Get(context.TODO(), types.NamespacedName{Name: suite.nuxeoName, Namespace: suite.namespace}, nux)
+	require.Nil(suite.T(), err)
+	cond := getCondition(nux, v1alpha1.ConditionBackingServicesResolved)
+	require.NotNil(suite.T(), cond)
+	require.Equal(suite.T(), metav1.ConditionFalse, cond.Status)
+	require.Equal(suite.T(), "BackingServiceError", cond.Reason)
+	cond = getCondition(nux, v1alpha1.ConditionReady)
+	require.NotNil(suite.T(), cond)
+	require.Equal(suite.T(), metav1.ConditionFalse, cond.Status)
+	require.Equal(suite.T(), cause.Error(), cond.Message)
+	require.Equal(suite.T(), nux.Generation, nux.Status.ObservedGeneration)
+	// once the backing service resolves, Ready reflects node availability
+	setCondition(nux, v1alpha1.ConditionBackingServicesResolved, metav1.ConditionTrue, "Resolved", "")
+	err = suite.r.updateNuxeoStatus(nux)
+	require.Nil(suite.T(), err)
+	cond = getCondition(nux, v1alpha1.ConditionReady)
+	require.Equal(suite.T(), "Unavailable", cond.Reason)
+}
+
+// TestScaleStatus tests that the status fields backing the scale subresource reflect the interactive NodeSet
+func (suite *nuxeoStatusSuite) TestScaleStatus() {
+	nux := suite.nuxeoStatusSuiteNewNuxeo()
+	nux.UID = "12345678-1234-1234-1234-123456789012"
+	nux.Spec.NodeSets[0].Interactive = true
+	nux.Spec.Replicas = util.Int32Ptr(4)
+	err := suite.r.Create(context.TODO(), nux)
+	require.Nil(suite.T(), err)
+	err = suite.r.updateNuxeoStatus(nux)
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), int32(4), nux.Status.Replicas)
+	require.Equal(suite.T(), int32(4), nux.Status.NodeSets[0].DesiredReplicas)
+	require.Equal(suite.T(), "app=nuxeo,interactive=true,nuxeoCr="+suite.nuxeoName, nux.Status.Selector)
 }
 
 // nuxeoStatusSuite is the NuxeoStatus test suite structure
@@ -105,6 +150,8 @@ func (suite *nuxeoStatusSuite) SetupSuite() {
 func (suite *nuxeoStatusSuite) AfterTest(_, _ string) {
 	obj := v1alpha1.Nuxeo{}
 	_ = suite.r.Client.DeleteAllOf(context.TODO(), &obj)
+	objDep := appsv1.Deployment{}
+	_ = suite.r.Client.DeleteAllOf(context.TODO(), &objDep)
 }
 
 // This function runs the NuxeoStatus unit test suite. It is called by 'go test' and will call every
@@ -131,3 +178,40 @@ func (suite *nuxeoStatusSuite) nuxeoStatusSuiteNewNuxeo() *v1alpha1.Nuxeo {
 		},
 	}
 }
+
+// nuxeoStatusSuiteNewDeployment creates a Deployment for the passed NodeSet name owned by the passed Nuxeo, with
+// all replicas available
+func (suite *nuxeoStatusSuite) nuxeoStatusSuiteNewDeployment(nux *v1alpha1.Nuxeo, nodeSetName string,
+	replicas int32) *appsv1.Deployment {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      nux.Name + "-" + nodeSetName,
+			Namespace: suite.namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1alpha1",
+				Kind:       "Nuxeo",
+				Name:       suite.nuxeoName,
+				UID:        nux.UID,
+			}},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: util.Int32Ptr(replicas),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{common.NuxeoConfHashAnnotation: "abc"},
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: NuxeoServiceAccountName,
+					Containers: []corev1.Container{{
+						Name: "nuxeo",
+					}},
+				},
+			},
+		},
+	}
+	// fake doesn't update replica counts
+	dep.Status.Replicas = replicas
+	dep.Status.UpdatedReplicas = replicas
+	dep.Status.AvailableReplicas = replicas
+	return dep
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"strings"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/nuxeo/preconfigs"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// validateNuxeo applies the rules that the reconciler would otherwise only discover part way through a
+// reconciliation to the passed Nuxeo CR, and returns a list of errors - each one identifying the offending field
+// by its path in the CR. An empty list means the CR is valid. This is called by the validating admission webhook
+// so that an invalid CR is rejected by the API server rather than looping in the reconciler. The reconciler
+// retains its own checks, so the webhook is an early warning rather than the only line of defense.
+func validateNuxeo(instance *v1alpha1.Nuxeo) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+	errs = append(errs, validateNodeSets(instance, specPath.Child("nodeSets"))...)
+	errs = append(errs, validateClid(instance.Spec.Clid, specPath.Child("clid"))...)
+	errs = append(errs, validateService(instance.Spec.Service, specPath.Child("serviceSpec"))...)
+	errs = append(errs, validateAccess(instance, specPath.Child("access"))...)
+	errs = append(errs, validateBackingServices(instance.Spec.BackingServices, specPath.Child("backingServices"))...)
+	if instance.Spec.BinaryStore != nil && instance.Spec.BinaryStore.S3.Bucket == "" {
+		errs = append(errs, field.Required(specPath.Child("binaryStore", "s3", "bucket"),
+			"an S3 binary store requires a bucket"))
+	}
+	errs = append(errs, validatePodMetadata(instance.Spec.PodLabels, instance.Spec.PodAnnotations, specPath)...)
+	for idx, container := range instance.Spec.Containers {
+		if container.Name == "nuxeo" {
+			errs = append(errs, field.Invalid(specPath.Child("containers").Index(idx).Child("name"),
+				container.Name, "container name 'nuxeo' is reserved by the operator"))
+		}
+	}
+	return errs
+}
+
+// validateNodeSets validates each NodeSet, and that exactly one NodeSet is interactive
+func validateNodeSets(instance *v1alpha1.Nuxeo, nodeSetsPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	interactiveCnt := 0
+	for idx, nodeSet := range instance.Spec.NodeSets {
+		nodeSetPath := nodeSetsPath.Index(idx)
+		if nodeSet.Interactive {
+			if interactiveCnt += 1; interactiveCnt > 1 {
+				errs = append(errs, field.Invalid(nodeSetPath.Child("interactive"), nodeSet.Interactive,
+					"exactly one interactive NodeSet is required in the Nuxeo CR"))
+			}
+		}
+		if nodeSet.Interactive && replicasManagedExternally(nodeSet) && instance.Spec.Replicas != nil {
+			errs = append(errs, field.Forbidden(field.NewPath("spec", "replicas"),
+				"spec.replicas cannot be specified if the interactive NodeSet is autoscaled"))
+		}
+		if autoscaling := nodeSet.Autoscaling; autoscaling != nil && hpaMinReplicas(nodeSet) > autoscaling.MaxReplicas {
+			msg := "maxReplicas cannot be less than minReplicas"
+			if autoscaling.MinReplicas == nil {
+				msg = "maxReplicas cannot be less than the NodeSet replicas, which are the default minReplicas"
+			}
+			errs = append(errs, field.Invalid(nodeSetPath.Child("autoscaling", "maxReplicas"),
+				autoscaling.MaxReplicas, msg))
+		}
+		if budget := nodeSet.DisruptionBudget; budget != nil &&
+			(budget.MinAvailable == nil) == (budget.MaxUnavailable == nil) {
+			errs = append(errs, field.Invalid(nodeSetPath.Child("disruptionBudget"), budget,
+				"exactly one of minAvailable or maxUnavailable must be specified"))
+		}
+		if nodeSet.ClusterEnabled && !binaryStorageIsDefined(nodeSet) && instance.Spec.BinaryStore == nil {
+			errs = append(errs, field.Required(nodeSetPath.Child("storage"),
+				"clustering requires a Binaries storageType or a binaryStore"))
+		}
+		for sIdx, storage := range nodeSet.Storage {
+			if storage.VolumeSource == (corev1.VolumeSource{}) && storage.VolumeClaimTemplate.Name == "" {
+				// the operator generates a PVC for this storage and so the size has to parse
+				if _, err := resource.ParseQuantity(storage.Size); err != nil {
+					errs = append(errs, field.Invalid(nodeSetPath.Child("storage").Index(sIdx).Child("size"),
+						storage.Size, err.Error()))
+				}
+			}
+			if nodeSet.ClusterEnabled && isStatefulSet(nodeSet) && instance.Spec.BinaryStore == nil &&
+				storage.StorageType == v1alpha1.NuxeoStorageBinaries && storageUsesClaimTemplate(storage) {
+				// a claim template would give each Pod its own binary store
+				errs = append(errs, field.Required(nodeSetPath.Child("storage").Index(sIdx).Child("volumeSource"),
+					"a clustered StatefulSet requires a shared volumeSource for Binaries storage"))
+			}
+		}
+		errs = append(errs, validateStrategy(resolveStrategy(instance, nodeSet), nodeSetPath.Child("strategy"))...)
+		errs = append(errs, validatePodMetadata(nodeSet.PodLabels, nodeSet.PodAnnotations, nodeSetPath)...)
+		errs = append(errs, validateContributions(nodeSet.Contributions, nodeSetPath.Child("contribs"))...)
+		errs = append(errs, validateNuxeoConfig(nodeSet, nodeSetPath.Child("nuxeoConfig"))...)
+	}
+	if interactiveCnt == 0 {
+		errs = append(errs, field.Required(nodeSetsPath, "exactly one interactive NodeSet is required in the Nuxeo CR"))
+	}
+	return errs
+}
+
+// validatePodMetadata validates Pod labels and annotations from the Nuxeo CR or a NodeSet. The labels that the
+// Operator applies to the Pods - which include the Deployment selector labels - and the annotations with the
+// Operator prefix cannot be specified.
+func validatePodMetadata(labels map[string]string, annotations map[string]string, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	reserved := mergeMaps(labelsForNuxeo(&v1alpha1.Nuxeo{}, true), recommendedLabels(&v1alpha1.Nuxeo{}),
+		map[string]string{common.AppComponentLabel: ""})
+	for key := range labels {
+		if _, ok := reserved[key]; ok {
+			errs = append(errs, field.Invalid(path.Child("podLabels"), key, "label is reserved by the operator"))
+		}
+	}
+	for key := range annotations {
+		if strings.HasPrefix(key, operatorAnnotationPrefix) {
+			errs = append(errs, field.Invalid(path.Child("podAnnotations"), key,
+				"annotation prefix '"+operatorAnnotationPrefix+"' is reserved by the operator"))
+		}
+	}
+	return errs
+}
+
+// validateStrategy validates the strategy resolved for a NodeSet from the NodeSet, the Nuxeo CR, and the Operator
+// defaults. A rolling update cannot have both a zero max surge and a zero max unavailable because it could never
+// make progress.
+func validateStrategy(strategy v1alpha1.StrategySpec, strategyPath *field.Path) field.ErrorList {
+	if strategy.Type != appsv1.RollingUpdateDeploymentStrategyType {
+		return nil
+	}
+	if isZero(strategy.MaxSurge) && isZero(strategy.MaxUnavailable) {
+		return field.ErrorList{field.Invalid(strategyPath.Child("maxUnavailable"), strategy.MaxUnavailable.String(),
+			"maxSurge and maxUnavailable cannot both be zero")}
+	}
+	return nil
+}
+
+// isZero returns true if the passed IntOrString is an int zero or a zero percentage
+func isZero(val *intstr.IntOrString) bool {
+	return val != nil && (val.Type == intstr.Int && val.IntVal == 0 || val.Type == intstr.String && val.StrVal == "0%")
+}
+
+// validateContributions applies the same rules to the passed contributions that the configureContributions
+// function applies
+func validateContributions(contribs []v1alpha1.Contribution, contribsPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	cfgMapSecretCnt, nonCfgMapSecretCnt := 0, 0
+	for idx, contrib := range contribs {
+		if contrib.VolumeSource.ConfigMap != nil || contrib.VolumeSource.Secret != nil {
+			if len(contrib.Templates) != 1 {
+				errs = append(errs, field.Invalid(contribsPath.Index(idx).Child("templates"), contrib.Templates,
+					"ConfigMap/Secret contributions can only supply one template name"))
+			}
+			cfgMapSecretCnt += 1
+		} else {
+			nonCfgMapSecretCnt += 1
+		}
+	}
+	if cfgMapSecretCnt != 0 && nonCfgMapSecretCnt != 0 {
+		errs = append(errs, field.Invalid(contribsPath, len(contribs),
+			"cannot define both ConfigMap/Secret contributions and non-ConfigMap/Secret contributions"))
+	} else if nonCfgMapSecretCnt > 1 {
+		errs = append(errs, field.TooMany(contribsPath, nonCfgMapSecretCnt, 1))
+	}
+	return errs
+}
+
+// validateNuxeoConfig validates the volume sources and the nuxeo.conf properties in the passed NodeSet's
+// NuxeoConfig
+func validateNuxeoConfig(nodeSet v1alpha1.NodeSet, cfgPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	valueFrom := nodeSet.NuxeoConfig.NuxeoConf.ValueFrom
+	if valueFrom != (corev1.VolumeSource{}) {
+		valueFromPath := cfgPath.Child("nuxeoConf", "valueFrom")
+		if valueFrom.ConfigMap == nil && valueFrom.Secret == nil {
+			errs = append(errs, field.NotSupported(valueFromPath, valueFrom, []string{"configMap", "secret"}))
+		}
+	}
+	for _, key := range sortedKeys(nodeSet.NuxeoConfig.Properties) {
+		value := nodeSet.NuxeoConfig.Properties[key]
+		if !isValidPropertyKey(key) {
+			errs = append(errs, field.Invalid(cfgPath.Child("properties"), key, "invalid nuxeo.conf property key"))
+		} else if strings.ContainsAny(value, "\r\n") {
+			errs = append(errs, field.Invalid(cfgPath.Child("properties").Key(key), "(redacted)",
+				"a nuxeo.conf property value cannot span lines"))
+		}
+	}
+	envVars := map[string]string{}
+	for idx, prop := range nodeSet.NuxeoConfig.SecretProperties {
+		propPath := cfgPath.Child("secretProperties").Index(idx)
+		if !isValidPropertyKey(prop.Key) {
+			errs = append(errs, field.Invalid(propPath.Child("key"), prop.Key, "invalid nuxeo.conf property key"))
+		} else if other, ok := envVars[secretPropertyEnvVar(prop.Key)]; ok {
+			errs = append(errs, field.Duplicate(propPath.Child("key"), prop.Key+" (environment variable "+
+				secretPropertyEnvVar(prop.Key)+" is also used by "+other+")"))
+		} else {
+			envVars[secretPropertyEnvVar(prop.Key)] = prop.Key
+		}
+		if prop.SecretKeyRef.Name == "" || prop.SecretKeyRef.Key == "" {
+			errs = append(errs, field.Required(propPath.Child("secretKeyRef"), "a Secret name and key are required"))
+		}
+	}
+	for idx, pkg := range nodeSet.NuxeoConfig.OfflinePackages {
+		if pkg.ValueFrom.ConfigMap == nil && pkg.ValueFrom.Secret == nil {
+			errs = append(errs, field.NotSupported(cfgPath.Child("offlinePackages").Index(idx).Child("valueFrom"),
+				pkg.ValueFrom, []string{"configMap", "secret"}))
+		}
+	}
+	return errs
+}
+
+// isValidPropertyKey returns true if the passed nuxeo.conf property key can be rendered into nuxeo.conf as is
+func isValidPropertyKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "=: \t\r\n") && key[0] != '#' && key[0] != '!'
+}
+
+// validateClid verifies that the passed CLID - if specified - contains the Nuxeo separator
+func validateClid(clid string, clidPath *field.Path) field.ErrorList {
+	if clid != "" && len(strings.Split(clid, clidSeparator)) != 2 {
+		return field.ErrorList{field.Invalid(clidPath, "(redacted)",
+			"CLID must contain exactly one '"+clidSeparator+"' separator")}
+	}
+	return nil
+}
+
+// validateService verifies that the passed ServiceSpec requests a Service type the operator can generate
+func validateService(svc v1alpha1.ServiceSpec, svcPath *field.Path) field.ErrorList {
+	if svc.Type != "" && svc.Type != corev1.ServiceTypeClusterIP {
+		return field.ErrorList{field.NotSupported(svcPath.Child("type"), svc.Type,
+			[]string{string(corev1.ServiceTypeClusterIP)})}
+	}
+	return nil
+}
+
+// validateAccess applies the rules from defaultRoute and defaultIngress to the access spec in the passed CR
+func validateAccess(instance *v1alpha1.Nuxeo, accessPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	access := instance.Spec.Access
+	if access == (v1alpha1.NuxeoAccess{}) {
+		return nil
+	}
+	interactiveNodeSet, _ := getInteractiveNodeSet(instance.Spec.NodeSets)
+	if access.Termination != "" && interactiveNodeSet.NuxeoConfig.TlsSecret != "" {
+		errs = append(errs, field.Invalid(accessPath.Child("termination"), access.Termination,
+			"invalid to explicitly specify route/ingress termination if Nuxeo is terminating TLS"))
+	}
+	if !util.IsOpenShift() && access.Termination != "" {
+		if access.Termination != routev1.TLSTerminationPassthrough && access.Termination != routev1.TLSTerminationEdge {
+			errs = append(errs, field.NotSupported(accessPath.Child("termination"), access.Termination,
+				[]string{string(routev1.TLSTerminationPassthrough), string(routev1.TLSTerminationEdge)}))
+		} else if access.Termination == routev1.TLSTerminationEdge && access.TLSSecret == "" {
+			errs = append(errs, field.Required(accessPath.Child("tlsSecret"),
+				"the Ingress was configured for TLS termination but no secret was provided"))
+		}
+	}
+	return errs
+}
+
+// validateBackingServices applies backingSvcIsValid, ParsePreconfigOpts, and validateProjections to each
+// backing service in the passed array
+func validateBackingServices(backingServices []v1alpha1.BackingService, backingPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for idx, backingService := range backingServices {
+		svcPath := backingPath.Index(idx)
+		if !backingSvcIsValid(backingService) {
+			errs = append(errs, field.Invalid(svcPath, backingService.Name,
+				"a backing service requires either preConfigured, or name and resources"))
+			continue
+		}
+		if backingService.Preconfigured.Type != "" {
+			if _, err := preconfigs.ParsePreconfigOpts(backingService.Preconfigured); err != nil {
+				errs = append(errs, field.Invalid(svcPath.Child("preConfigured", "settings"),
+					backingService.Preconfigured.Settings, err.Error()))
+			}
+			continue
+		}
+		for rIdx, res := range backingService.Resources {
+			gvk := strings.ToLower(res.Group + "." + res.Version + "." + res.Kind)
+			if err := validateProjections(gvk, res.Projections); err != nil {
+				errs = append(errs, field.Invalid(svcPath.Child("resources").Index(rIdx).Child("projections"),
+					res.Name, err.Error()))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Tests that a minimal CR passes validation
+func (suite *nuxeoValidateSuite) TestValidNuxeo() {
+	nux := suite.nuxeoValidateSuiteNewNuxeo()
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 0, len(errs))
+}
+
+// Tests that each rule produces an error with a field path identifying the offending field
+func (suite *nuxeoValidateSuite) TestInvalidNuxeo() {
+	nux := suite.nuxeoValidateSuiteNewNuxeo()
+	nux.Spec.Clid = "NOTVALID"
+	nux.Spec.NodeSets = append(nux.Spec.NodeSets, v1alpha1.NodeSet{
+		Name:        "second",
+		Replicas:    1,
+		Interactive: true,
+		Contributions: []v1alpha1.Contribution{{
+			Templates: []string{"one", "two"},
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "foo"},
+				},
+			},
+		}},
+		NuxeoConfig: v1alpha1.NuxeoConfig{
+			Properties: map[string]string{"not valid": "true"},
+			SecretProperties: []v1alpha1.SecretProperty{{
+				Key:          "nuxeo.db.password",
+				SecretKeyRef: corev1.SecretKeySelector{Key: "password"},
+			}, {
+				Key: "nuxeo.db-password",
+				SecretKeyRef: corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "db-secret"},
+					Key:                  "password",
+				},
+			}},
+		},
+	})
+	nux.Spec.BackingServices = []v1alpha1.BackingService{{
+		Preconfigured: v1alpha1.PreconfiguredBackingService{
+			Type:     v1alpha1.ECK,
+			Resource: "elastic",
+			Settings: map[string]string{"auth": "not-a-valid-auth-type"},
+		},
+	}}
+	errs := validateNuxeo(nux)
+	fields := map[string]bool{}
+	for _, err := range errs {
+		fields[err.Field] = true
+	}
+	require.True(suite.T(), fields["spec.clid"], "CLID separator not validated")
+	require.True(suite.T(), fields["spec.nodeSets[1].interactive"], "Multiple interactive NodeSets not validated")
+	require.True(suite.T(), fields["spec.nodeSets[1].contribs[0].templates"], "Contributions not validated")
+	require.True(suite.T(), fields["spec.nodeSets[1].nuxeoConfig.properties"], "nuxeo.conf properties not validated")
+	require.True(suite.T(), fields["spec.nodeSets[1].nuxeoConfig.secretProperties[0].secretKeyRef"],
+		"Secret property Secret not validated")
+	require.True(suite.T(), fields["spec.nodeSets[1].nuxeoConfig.secretProperties[1].key"],
+		"Secret property environment variable collision not validated")
+	require.True(suite.T(), fields["spec.backingServices[0].preConfigured.settings"],
+		"Pre-configured settings not validated")
+}
+
+// Tests that a Nuxeo CR without an interactive NodeSet is rejected
+func (suite *nuxeoValidateSuite) TestNoInteractiveNodeSet() {
+	nux := suite.nuxeoValidateSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].Interactive = false
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 1, len(errs))
+	require.Equal(suite.T(), "spec.nodeSets", errs[0].Field, "Missing interactive NodeSet not validated")
+	nux.Spec.NodeSets = nil
+	errs = validateNuxeo(nux)
+	require.Equal(suite.T(), 1, len(errs))
+	require.Equal(suite.T(), "spec.nodeSets", errs[0].Field, "Missing NodeSets not validated")
+}
+
+// Tests that an explicit termination is rejected if Nuxeo terminates TLS
+func (suite *nuxeoValidateSuite) TestTerminationWithNuxeoTLS() {
+	nux := suite.nuxeoValidateSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].NuxeoConfig.TlsSecret = "tls-secret"
+	nux.Spec.Access = v1alpha1.NuxeoAccess{
+		Hostname:    "nuxeo-server.apps-crc.testing",
+		Termination: "edge",
+		TLSSecret:   "tls-secret",
+	}
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 1, len(errs))
+	require.Equal(suite.T(), "spec.access.termination", errs[0].Field)
+}
+
+// Tests that the webhook handler denies an invalid CR and admits a valid CR
+func (suite *nuxeoValidateSuite) TestWebhookHandler() {
+	s := runtime.NewScheme()
+	require.Nil(suite.T(), v1alpha1.AddToScheme(s))
+	decoder, err := admission.NewDecoder(s)
+	require.Nil(suite.T(), err)
+	v := &NuxeoValidator{Log: log.Log.WithName("webhook_test")}
+	require.Nil(suite.T(), v.InjectDecoder(decoder))
+	nux := suite.nuxeoValidateSuiteNewNuxeo()
+	resp := v.Handle(context.TODO(), suite.nuxeoValidateSuiteRequest(nux))
+	require.True(suite.T(), resp.Allowed, "Valid CR should have been admitted")
+	nux.Spec.Clid = "NOTVALID"
+	resp = v.Handle(context.TODO(), suite.nuxeoValidateSuiteRequest(nux))
+	require.False(suite.T(), resp.Allowed, "Invalid CR should have been denied")
+	require.Equal(suite.T(), metav1.StatusReasonInvalid, resp.Result.Reason)
+}
+
+// nuxeoValidateSuite is the validation test suite structure
+type nuxeoValidateSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *nuxeoValidateSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *nuxeoValidateSuite) AfterTest(_, _ string) {
+	// nop
+}
+
+// This function runs the validation unit test suite. It is called by 'go test' and will call every
+// function in this file with a nuxeoValidateSuite receiver that begins with "Test..."
+func TestNuxeoValidateUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(nuxeoValidateSuite))
+}
+
+// nuxeoValidateSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
+func (suite *nuxeoValidateSuite) nuxeoValidateSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "Nuxeo",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:        "test",
+				Replicas:    1,
+				Interactive: true,
+			}},
+		},
+	}
+}
+
+// nuxeoValidateSuiteRequest wraps the passed Nuxeo CR in an admission request
+func (suite *nuxeoValidateSuite) nuxeoValidateSuiteRequest(nux *v1alpha1.Nuxeo) admission.Request {
+	raw, _ := json.Marshal(nux)
+	return admission.Request{
+		AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Operation: admissionv1beta1.Create,
+			Name:      nux.Name,
+			Namespace: nux.Namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
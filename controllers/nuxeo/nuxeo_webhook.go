@@ -0,0 +1,109 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/mutate-appzygy-net-v1alpha1-nuxeo,mutating=true,failurePolicy=fail,groups=appzygy.net,resources=nuxeos,verbs=create;update,versions=v1alpha1,name=mnuxeo.appzygy.net
+// +kubebuilder:webhook:path=/validate-appzygy-net-v1alpha1-nuxeo,mutating=false,failurePolicy=fail,groups=appzygy.net,resources=nuxeos,verbs=create;update,versions=v1alpha1,name=vnuxeo.appzygy.net
+
+const (
+	mutatingWebhookPath   = "/mutate-appzygy-net-v1alpha1-nuxeo"
+	validatingWebhookPath = "/validate-appzygy-net-v1alpha1-nuxeo"
+)
+
+// NuxeoDefaulter is the admission handler that materializes operator defaults into Nuxeo CRs on create and update
+type NuxeoDefaulter struct {
+	decoder *admission.Decoder
+}
+
+// NuxeoValidator is the admission handler that validates Nuxeo CRs on create and update
+type NuxeoValidator struct {
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+// SetupWebhooksWithManager registers the Nuxeo admission webhooks with the webhook server in the passed manager.
+// The webhook server is started by the manager, and expects a serving certificate to have been provisioned in
+// the server's cert dir. (In the kustomize configuration, this is handled by cert-manager.)
+func SetupWebhooksWithManager(mgr ctrl.Manager) {
+	mgr.GetWebhookServer().Register(mutatingWebhookPath, &webhook.Admission{
+		Handler: &NuxeoDefaulter{},
+	})
+	mgr.GetWebhookServer().Register(validatingWebhookPath, &webhook.Admission{
+		Handler: &NuxeoValidator{Log: ctrl.Log.WithName("webhooks").WithName("nuxeo-validator")},
+	})
+}
+
+// Handle decodes the Nuxeo CR from the admission request, defaults it, and returns a JSON patch containing
+// the defaulted fields
+func (d *NuxeoDefaulter) Handle(_ context.Context, req admission.Request) admission.Response {
+	instance := &v1alpha1.Nuxeo{}
+	if err := d.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	defaultNuxeo(instance)
+	defaulted, err := json.Marshal(instance)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, defaulted)
+}
+
+// InjectDecoder is called by the controller-runtime webhook machinery to provide the decoder
+func (d *NuxeoDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+// Handle decodes the Nuxeo CR from the admission request and validates it. If the CR is invalid then the
+// request is denied with a status listing every invalid field, in the same form the API server uses for
+// OpenAPI schema violations.
+func (v *NuxeoValidator) Handle(_ context.Context, req admission.Request) admission.Response {
+	instance := &v1alpha1.Nuxeo{}
+	if err := v.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if errs := validateNuxeo(instance); len(errs) != 0 {
+		v.Log.Info("Rejecting invalid Nuxeo CR", "Namespace", req.Namespace, "Name", req.Name,
+			"Errors", errs.ToAggregate().Error())
+		gk := schema.GroupKind{Group: v1alpha1.GroupVersion.Group, Kind: "Nuxeo"}
+		status := apierrors.NewInvalid(gk, instance.Name, errs).ErrStatus
+		resp := admission.Denied(status.Message)
+		resp.Result = &status
+		return resp
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder is called by the controller-runtime webhook machinery to provide the decoder
+func (v *NuxeoValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
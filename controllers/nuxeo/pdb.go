@@ -0,0 +1,66 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reconcilePdb reconciles the PodDisruptionBudget for the passed NodeSet. If the NodeSet specifies a disruption
+// budget then a PDB selecting the NodeSet Pods is created or updated. Otherwise, any PDB previously generated for
+// the NodeSet is removed.
+func (r *NuxeoReconciler) reconcilePdb(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) error {
+	pdbName := pdbName(instance, nodeSet)
+	if nodeSet.DisruptionBudget == nil {
+		return r.removeIfPresent(instance, pdbName, instance.Namespace, &policyv1beta1.PodDisruptionBudget{})
+	}
+	expected := r.defaultPdb(instance, pdbName, nodeSet)
+	_, err := r.addOrUpdate(instance, pdbName, instance.Namespace, expected, &policyv1beta1.PodDisruptionBudget{},
+		util.PdbComparer)
+	return err
+}
+
+// defaultPdb generates a PDB from the disruption budget in the passed NodeSet. The PDB selects only the Pods of the
+// NodeSet, so that the budgets of different NodeSets never cover the same Pods.
+func (r *NuxeoReconciler) defaultPdb(instance *v1alpha1.Nuxeo, pdbName string,
+	nodeSet v1alpha1.NodeSet) *policyv1beta1.PodDisruptionBudget {
+	pdb := &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pdbName,
+			Namespace: instance.Namespace,
+			Labels:    nodeSetLabels(instance, nodeSet),
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable:   nodeSet.DisruptionBudget.MinAvailable,
+			MaxUnavailable: nodeSet.DisruptionBudget.MaxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: nodeSetSelector(instance, nodeSet),
+			},
+		},
+	}
+	_ = controllerutil.SetControllerReference(instance, pdb, r.Scheme)
+	return pdb
+}
+
+// pdbName generates the PDB name for the passed NodeSet. It is the same as the name of the NodeSet Deployment.
+func pdbName(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) string {
+	return deploymentName(instance, nodeSet)
+}
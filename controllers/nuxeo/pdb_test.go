@@ -0,0 +1,150 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// TestPdbLifecycle tests that a PDB with the NodeSet selector is generated from the NodeSet disruption
+// budget, that it is updated when the budget changes, and that it is removed when the budget is removed
+func (suite *pdbSuite) TestPdbLifecycle() {
+	nux := suite.pdbSuiteNewNuxeo()
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	pdb := policyv1beta1.PodDisruptionBudget{}
+	name := types.NamespacedName{Name: pdbName(nux, nux.Spec.NodeSets[0]), Namespace: suite.namespace}
+	err = suite.r.Get(context.TODO(), name, &pdb)
+	require.Nil(suite.T(), err, "PDB was not created")
+	require.Equal(suite.T(), nodeSetSelector(nux, nux.Spec.NodeSets[0]), pdb.Spec.Selector.MatchLabels)
+	require.Equal(suite.T(), intstr.FromInt(1), *pdb.Spec.MaxUnavailable)
+	require.Nil(suite.T(), pdb.Spec.MinAvailable)
+	budget := intstr.FromString("50%")
+	nux.Spec.NodeSets[0].DisruptionBudget = &v1alpha1.DisruptionBudgetSpec{MinAvailable: &budget}
+	_, err = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	pdb = policyv1beta1.PodDisruptionBudget{}
+	_ = suite.r.Get(context.TODO(), name, &pdb)
+	require.Equal(suite.T(), budget, *pdb.Spec.MinAvailable)
+	require.Nil(suite.T(), pdb.Spec.MaxUnavailable)
+	nux.Spec.NodeSets[0].DisruptionBudget = nil
+	_, err = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	err = suite.r.Get(context.TODO(), name, &pdb)
+	require.True(suite.T(), apierrors.IsNotFound(err), "PDB should have been removed")
+}
+
+// TestPdbSelectorsDoNotOverlap tests that with several NodeSets each PDB selects the Pods of its own NodeSet, and
+// none of the Pods of the other NodeSets
+func (suite *pdbSuite) TestPdbSelectorsDoNotOverlap() {
+	nux := suite.pdbSuiteNewNuxeo()
+	worker1 := nux.Spec.NodeSets[0]
+	worker1.Name, worker1.Interactive = "worker1", false
+	worker2 := worker1
+	worker2.Name = "worker2"
+	nux.Spec.NodeSets = append(nux.Spec.NodeSets, worker1, worker2)
+	for _, nodeSet := range nux.Spec.NodeSets {
+		_, err := suite.r.reconcileNodeSet(nodeSet, nux)
+		require.Nil(suite.T(), err)
+	}
+	for _, nodeSet := range nux.Spec.NodeSets {
+		pdb := policyv1beta1.PodDisruptionBudget{}
+		err := suite.r.Get(context.TODO(), types.NamespacedName{Name: pdbName(nux, nodeSet),
+			Namespace: suite.namespace}, &pdb)
+		require.Nil(suite.T(), err)
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		require.Nil(suite.T(), err)
+		for _, other := range nux.Spec.NodeSets {
+			require.Equal(suite.T(), nodeSet.Name == other.Name, selector.Matches(labels.Set(podLabels(nux, other))),
+				"PDB for NodeSet %v vs Pods of NodeSet %v", nodeSet.Name, other.Name)
+		}
+	}
+}
+
+// TestPdbValidation tests that a disruption budget must specify exactly one of minAvailable or maxUnavailable
+func (suite *pdbSuite) TestPdbValidation() {
+	nux := suite.pdbSuiteNewNuxeo()
+	require.Equal(suite.T(), 0, len(validateNuxeo(nux)))
+	nux.Spec.NodeSets[0].DisruptionBudget = &v1alpha1.DisruptionBudgetSpec{}
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 1, len(errs))
+	require.Equal(suite.T(), "spec.nodeSets[0].disruptionBudget", errs[0].Field)
+}
+
+// pdbSuite is the PodDisruptionBudget test suite structure
+type pdbSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *pdbSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *pdbSuite) AfterTest(_, _ string) {
+	obj := policyv1beta1.PodDisruptionBudget{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	objDep := appsv1.Deployment{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &objDep)
+}
+
+// This function runs the PDB unit test suite. It is called by 'go test' and will call every
+// function in this file with a pdbSuite receiver that begins with "Test..."
+func TestPdbUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(pdbSuite))
+}
+
+// pdbSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
+func (suite *pdbSuite) pdbSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	maxUnavailable := intstr.FromInt(1)
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+			// the fake client doesn't assign a UID - and the owner UID is needed to remove the PDB
+			UID: "12345678-1234-1234-1234-123456789012",
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:        "cluster",
+				Replicas:    3,
+				Interactive: true,
+				DisruptionBudget: &v1alpha1.DisruptionBudgetSpec{
+					MaxUnavailable: &maxUnavailable,
+				},
+			}},
+		},
+	}
+}
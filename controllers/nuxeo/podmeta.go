@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"strings"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// the value of the app.kubernetes.io/managed-by label
+	managedBy = "nuxeo-operator"
+	// the prefix of the annotations that the Operator applies
+	operatorAnnotationPrefix = "appzygy.net/"
+)
+
+// recommendedLabels returns the Kubernetes recommended labels that the Operator applies to every resource that it
+// generates for the passed Nuxeo CR
+func recommendedLabels(instance *v1alpha1.Nuxeo) map[string]string {
+	return map[string]string{
+		common.AppNameLabel:      "nuxeo",
+		common.AppInstanceLabel:  instance.Name,
+		common.AppManagedByLabel: managedBy,
+	}
+}
+
+// addRecommendedLabels adds the Kubernetes recommended labels for the passed Nuxeo CR to the passed object. Labels
+// that the object already has are not overwritten, so a more specific label - e.g. the component of a NodeSet
+// resource - is kept.
+func addRecommendedLabels(instance *v1alpha1.Nuxeo, obj runtime.Object) error {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	objMeta.SetLabels(mergeMaps(recommendedLabels(instance), objMeta.GetLabels()))
+	return nil
+}
+
+// podLabels returns the labels for the Pod template of the passed NodeSet: the Pod labels from the Nuxeo CR,
+// then the Pod labels from the NodeSet, then the recommended labels, then the selector labels. Each overrides
+// the preceding ones, so the Deployment selector always matches the Pods.
+func podLabels(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) map[string]string {
+	return mergeMaps(instance.Spec.PodLabels, nodeSet.PodLabels, recommendedLabels(instance),
+		map[string]string{common.AppComponentLabel: nodeSet.Name}, labelsForNuxeo(instance, nodeSet.Interactive))
+}
+
+// podAnnotations returns the annotations for the Pod template of the passed NodeSet from the Pod annotations in
+// the Nuxeo CR, overridden by the Pod annotations in the NodeSet. The keys of these annotations are recorded in
+// an Operator annotation so that the Deployment comparer can remove an annotation from the Pod template when it
+// is removed from the Nuxeo CR, while leaving annotations that were added to the Pod template by something else -
+// such as 'kubectl rollout restart'. Returns nil if there are no Pod annotations.
+func podAnnotations(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) map[string]string {
+	annotations := mergeMaps(instance.Spec.PodAnnotations, nodeSet.PodAnnotations)
+	if len(annotations) == 0 {
+		return nil
+	}
+	annotations[common.PodAnnotationsAnnotation] = strings.Join(sortedKeys(annotations), ",")
+	return annotations
+}
+
+// annotatePodTemplate applies the passed annotation to the Pod template of the passed Deployment, and records its
+// key along with the keys of the Pod annotations from the Nuxeo CR. So the Deployment comparer removes the annotation
+// from the Pod template when the Operator no longer applies it, but leaves it alone if something else applied it.
+func annotatePodTemplate(dep *appsv1.Deployment, key, val string) {
+	util.AnnotateTemplate(dep, key, val)
+	keys := map[string]string{key: val}
+	for _, applied := range strings.Split(dep.Spec.Template.Annotations[common.PodAnnotationsAnnotation], ",") {
+		if applied != "" {
+			keys[applied] = dep.Spec.Template.Annotations[applied]
+		}
+	}
+	dep.Spec.Template.Annotations[common.PodAnnotationsAnnotation] = strings.Join(sortedKeys(keys), ",")
+}
+
+// mergeMaps returns a new map with the entries of the passed maps. An entry in a map overrides an entry with the
+// same key in a preceding map. Returns nil if there are no entries.
+func mergeMaps(maps ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, m := range maps {
+		for key, val := range m {
+			if merged == nil {
+				merged = map[string]string{}
+			}
+			merged[key] = val
+		}
+	}
+	return merged
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TestPodLabelsAndAnnotations tests that the Pod labels and annotations from the Nuxeo CR and the NodeSet are
+// merged into the Pod template with the NodeSet taking precedence, that the Deployment and its Pods have the
+// recommended labels, and that the Deployment selector is not changed
+func (suite *podMetaSuite) TestPodLabelsAndAnnotations() {
+	nux := suite.podMetaSuiteNewNuxeo()
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	dep := suite.getDeployment(nux)
+	require.Equal(suite.T(), labelsForNuxeo(nux, true), dep.Spec.Selector.MatchLabels)
+	labels := dep.Spec.Template.Labels
+	require.Equal(suite.T(), "cc-1234", labels["cost-center"])
+	require.Equal(suite.T(), "ecm", labels["team"], "NodeSet label should have overridden the Nuxeo CR label")
+	require.Equal(suite.T(), "nuxeo", labels["app"])
+	require.Equal(suite.T(), suite.nuxeoName, labels[common.AppInstanceLabel])
+	require.Equal(suite.T(), "cluster", labels[common.AppComponentLabel])
+	annotations := dep.Spec.Template.Annotations
+	require.Equal(suite.T(), "true", annotations["prometheus.io/scrape"])
+	require.Equal(suite.T(), "enabled", annotations["sidecar.istio.io/inject"])
+	require.Equal(suite.T(), managedBy, dep.Labels[common.AppManagedByLabel])
+	require.Equal(suite.T(), "cluster", dep.Labels[common.AppComponentLabel])
+}
+
+// TestPodAnnotationRemoved tests that a Pod annotation removed from the Nuxeo CR is removed from the Pod template,
+// and that a Pod template annotation added by something other than the Operator is kept
+func (suite *podMetaSuite) TestPodAnnotationRemoved() {
+	nux := suite.podMetaSuiteNewNuxeo()
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	dep := suite.getDeployment(nux)
+	// simulate kubectl rollout restart
+	dep.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = "2020-10-01T00:00:00Z"
+	_ = suite.r.Update(context.TODO(), dep)
+	delete(nux.Spec.PodAnnotations, "prometheus.io/scrape")
+	_, err = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	dep = suite.getDeployment(nux)
+	_, ok := dep.Spec.Template.Annotations["prometheus.io/scrape"]
+	require.False(suite.T(), ok, "Pod annotation should have been removed")
+	require.Equal(suite.T(), "enabled", dep.Spec.Template.Annotations["sidecar.istio.io/inject"])
+	require.Equal(suite.T(), "2020-10-01T00:00:00Z", dep.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"])
+}
+
+// TestRecommendedLabels tests that resources generated outside of a NodeSet also have the recommended labels
+func (suite *podMetaSuite) TestRecommendedLabels() {
+	nux := suite.podMetaSuiteNewNuxeo()
+	err := suite.r.reconcileServiceAccount(nux)
+	require.Nil(suite.T(), err)
+	sa := corev1.ServiceAccount{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: serviceAccountName(nux), Namespace: suite.namespace},
+		&sa)
+	require.Equal(suite.T(), recommendedLabels(nux), sa.Labels)
+}
+
+// TestPodMetadataValidation tests that Operator labels and annotations cannot be specified in the Nuxeo CR
+func (suite *podMetaSuite) TestPodMetadataValidation() {
+	nux := suite.podMetaSuiteNewNuxeo()
+	require.Equal(suite.T(), 0, len(validateNuxeo(nux)))
+	nux.Spec.PodLabels["app"] = "other"
+	nux.Spec.NodeSets[0].PodAnnotations[common.NuxeoConfHashAnnotation] = "0"
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 2, len(errs))
+	require.Equal(suite.T(), "spec.nodeSets[0].podAnnotations", errs[0].Field)
+	require.Equal(suite.T(), "spec.podLabels", errs[1].Field)
+}
+
+// podMetaSuite is the Pod metadata test suite structure
+type podMetaSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *podMetaSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *podMetaSuite) AfterTest(_, _ string) {
+	obj := appsv1.Deployment{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	sa := corev1.ServiceAccount{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &sa)
+}
+
+// This function runs the Pod metadata unit test suite. It is called by 'go test' and will call every
+// function in this file with a podMetaSuite receiver that begins with "Test..."
+func TestPodMetaUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(podMetaSuite))
+}
+
+// podMetaSuiteNewNuxeo creates a test Nuxeo struct with Pod labels and annotations in the spec and the NodeSet
+func (suite *podMetaSuite) podMetaSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			PodLabels:      map[string]string{"cost-center": "cc-1234", "team": "platform"},
+			PodAnnotations: map[string]string{"prometheus.io/scrape": "true"},
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:           "cluster",
+				Interactive:    true,
+				Replicas:       1,
+				PodLabels:      map[string]string{"team": "ecm"},
+				PodAnnotations: map[string]string{"sidecar.istio.io/inject": "enabled"},
+			}},
+		},
+	}
+}
+
+// getDeployment gets the Deployment generated for the first NodeSet of the passed Nuxeo CR
+func (suite *podMetaSuite) getDeployment(nux *v1alpha1.Nuxeo) *appsv1.Deployment {
+	dep := &appsv1.Deployment{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, dep)
+	return dep
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	routev1 "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1beta1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// pruneNodeSets removes the resources that the Operator generated for NodeSets that are no longer in the passed
+// Nuxeo CR - e.g. because a NodeSet was removed from the CR or renamed. Candidate resources are listed by the
+// Nuxeo CR label. A resource is removed only if it is owned by the passed Nuxeo CR, and its NodeSet label does
+// not match any NodeSet in the CR. Resources without a NodeSet label are never removed. A resource annotated
+// with 'appzygy.net/orphan-protect: "true"' is left in place, so the configurer can opt in to keeping it.
+func (r *NuxeoReconciler) pruneNodeSets(instance *v1alpha1.Nuxeo) error {
+	nodeSets := map[string]bool{}
+	for _, nodeSet := range instance.Spec.NodeSets {
+		nodeSets[nodeSet.Name] = true
+	}
+	lists := []runtime.Object{
+		&appsv1.DeploymentList{},
+		&appsv1.StatefulSetList{},
+		&corev1.ConfigMapList{},
+		&corev1.SecretList{},
+		&corev1.ServiceList{},
+		&autoscalingv2beta2.HorizontalPodAutoscalerList{},
+		&policyv1beta1.PodDisruptionBudgetList{},
+	}
+	if util.IsOpenShift() {
+		lists = append(lists, &routev1.RouteList{})
+	} else {
+		lists = append(lists, &v1beta1.IngressList{})
+	}
+	opts := []client.ListOption{
+		client.InNamespace(instance.Namespace),
+		client.MatchingLabels{common.NuxeoCrLabel: instance.Name},
+	}
+	for _, list := range lists {
+		if err := r.List(context.TODO(), list, opts...); err != nil {
+			return err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := r.pruneIfOrphaned(instance, nodeSets, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneIfOrphaned removes the passed object if it was generated by the Operator for a NodeSet that is not in the
+// passed set of NodeSet names, unless the object is protected by the orphan protection annotation
+func (r *NuxeoReconciler) pruneIfOrphaned(instance *v1alpha1.Nuxeo, nodeSets map[string]bool,
+	obj runtime.Object) error {
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	nodeSet, ok := objMeta.GetLabels()[common.NodeSetLabel]
+	if !ok || nodeSets[nodeSet] {
+		return nil
+	}
+	var uids []string
+	for _, ref := range objMeta.GetOwnerReferences() {
+		uids = append(uids, string(ref.UID))
+	}
+	if !instance.IsOwnerUids(uids) {
+		return nil
+	}
+	kind, err := getKind(r.Scheme, obj)
+	if err != nil {
+		return err
+	}
+	if objMeta.GetAnnotations()[common.OrphanProtectAnnotation] == "true" {
+		r.Log.Info("not removing protected "+kind+" of removed NodeSet", "Name", objMeta.GetName(),
+			"NodeSet", nodeSet)
+		return nil
+	}
+	r.Log.Info("Deleting "+kind+" of removed NodeSet", "Name", objMeta.GetName(), "NodeSet", nodeSet)
+	if err := r.Delete(context.TODO(), obj); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Deleted", "Deleted %v %v of removed NodeSet %v", kind,
+		objMeta.GetName(), nodeSet)
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TestPruneRemovedNodeSet tests that the Deployment and nuxeo.conf ConfigMap of a NodeSet that is removed from the
+// Nuxeo CR are removed, and that the resources of the remaining NodeSet are left in place
+func (suite *pruneSuite) TestPruneRemovedNodeSet() {
+	nux := suite.pruneSuiteNewNuxeo()
+	for _, nodeSet := range nux.Spec.NodeSets {
+		_, err := suite.r.reconcileNodeSet(nodeSet, nux)
+		require.Nil(suite.T(), err)
+	}
+	worker := nux.Spec.NodeSets[1]
+	nux.Spec.NodeSets = nux.Spec.NodeSets[:1]
+	require.Nil(suite.T(), suite.r.pruneNodeSets(nux))
+	err := suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, worker),
+		Namespace: suite.namespace}, &appsv1.Deployment{})
+	require.True(suite.T(), apierrors.IsNotFound(err), "Deployment of removed NodeSet should have been removed")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: nuxeoConfCMName(nux, worker.Name),
+		Namespace: suite.namespace}, &corev1.ConfigMap{})
+	require.True(suite.T(), apierrors.IsNotFound(err), "ConfigMap of removed NodeSet should have been removed")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, &appsv1.Deployment{})
+	require.Nil(suite.T(), err, "Deployment of remaining NodeSet should not have been removed")
+}
+
+// TestPruneNuxeoConfSecret tests that the generated nuxeo.conf Secret of a removed NodeSet whose external nuxeo.conf
+// is in a Secret is removed, and that the external Secret is left in place
+func (suite *pruneSuite) TestPruneNuxeoConfSecret() {
+	nux := suite.pruneSuiteNewNuxeo()
+	external := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "external-nuxeo-conf", Namespace: suite.namespace},
+		Data:       map[string][]byte{"nuxeo.conf": []byte("external.setting=1\n")},
+	}
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), &external))
+	worker := nux.Spec.NodeSets[1]
+	worker.NuxeoConfig.NuxeoConf = v1alpha1.NuxeoConfigSetting{
+		ValueFrom: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: external.Name}},
+	}
+	_, err := suite.r.reconcileNodeSet(worker, nux)
+	require.Nil(suite.T(), err)
+	secretName := types.NamespacedName{Name: nuxeoConfCMName(nux, worker.Name), Namespace: suite.namespace}
+	require.Nil(suite.T(), suite.r.Get(context.TODO(), secretName, &corev1.Secret{}),
+		"nuxeo.conf Secret should have been generated")
+	nux.Spec.NodeSets = nux.Spec.NodeSets[:1]
+	require.Nil(suite.T(), suite.r.pruneNodeSets(nux))
+	err = suite.r.Get(context.TODO(), secretName, &corev1.Secret{})
+	require.True(suite.T(), apierrors.IsNotFound(err), "nuxeo.conf Secret of removed NodeSet should have been removed")
+	require.Nil(suite.T(), suite.r.Get(context.TODO(), types.NamespacedName{Name: external.Name,
+		Namespace: suite.namespace}, &corev1.Secret{}), "External Secret should not have been removed")
+}
+
+// TestPruneProtected tests that a resource of a removed NodeSet that is annotated for orphan protection is not
+// removed, and that a resource not owned by the Nuxeo CR is not removed
+func (suite *pruneSuite) TestPruneProtected() {
+	nux := suite.pruneSuiteNewNuxeo()
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[1], nux)
+	dep := appsv1.Deployment{}
+	depName := types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[1]), Namespace: suite.namespace}
+	_ = suite.r.Get(context.TODO(), depName, &dep)
+	dep.Annotations = map[string]string{common.OrphanProtectAnnotation: "true"}
+	require.Nil(suite.T(), suite.r.Update(context.TODO(), &dep))
+	notOwned := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "not-owned",
+			Namespace: suite.namespace,
+			Labels:    nodeSetLabels(nux, nux.Spec.NodeSets[1]),
+		},
+	}
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), &notOwned))
+	nux.Spec.NodeSets = nux.Spec.NodeSets[:1]
+	require.Nil(suite.T(), suite.r.pruneNodeSets(nux))
+	require.Nil(suite.T(), suite.r.Get(context.TODO(), depName, &dep), "Protected Deployment should not be removed")
+	require.Nil(suite.T(), suite.r.Get(context.TODO(), types.NamespacedName{Name: notOwned.Name,
+		Namespace: suite.namespace}, &notOwned), "ConfigMap not owned by the Nuxeo CR should not be removed")
+}
+
+// pruneSuite is the NodeSet pruning test suite structure
+type pruneSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *pruneSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *pruneSuite) AfterTest(_, _ string) {
+	obj := appsv1.Deployment{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	objCm := corev1.ConfigMap{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &objCm)
+	objSecret := corev1.Secret{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &objSecret)
+}
+
+// This function runs the NodeSet pruning unit test suite. It is called by 'go test' and will call every
+// function in this file with a pruneSuite receiver that begins with "Test..."
+func TestPruneUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(pruneSuite))
+}
+
+// pruneSuiteNewNuxeo creates a test Nuxeo struct with an interactive NodeSet and a worker NodeSet. Each NodeSet
+// has an inline nuxeo.conf so the Operator generates a nuxeo.conf ConfigMap for each.
+func (suite *pruneSuite) pruneSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+			// the fake client doesn't assign a UID - and the owner UID is needed to prune
+			UID: "12345678-1234-1234-1234-123456789012",
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:        "cluster",
+				Replicas:    1,
+				Interactive: true,
+				NuxeoConfig: v1alpha1.NuxeoConfig{
+					NuxeoConf: v1alpha1.NuxeoConfigSetting{Inline: "a.b.c=1"},
+				},
+			}, {
+				Name:     "worker",
+				Replicas: 1,
+				NuxeoConfig: v1alpha1.NuxeoConfig{
+					NuxeoConf: v1alpha1.NuxeoConfigSetting{Inline: "a.b.c=2"},
+				},
+			}},
+		},
+	}
+}
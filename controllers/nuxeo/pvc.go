@@ -22,66 +22,117 @@ import (
 	"reflect"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
-	"github.com/aceeric/nuxeo-operator/controllers/util"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 // reconcilePvc examines the Storage definitions in each NodeSet of the passed Nuxeo CR, gathers a list of PVCs,
 // then conforms actual PVCs in the cluster to those expected PVCs. If the Nuxeo CR changes the definition of a PVC,
-// and there is an existing PVC with the same name, then the existing PVC is deleted and re-created.
+// and there is an existing PVC with the same name, then the existing PVC is updated in place if possible. See
+// updatePvc for details.
 func (r *NuxeoReconciler) reconcilePvc(instance *v1alpha1.Nuxeo) error {
+	expectedPvcs, storages, err := r.expectedPvcs(instance)
+	if err != nil {
+		return err
+	}
+	// we now have a (possibly empty) list of all PVCs that are expected in the cluster - conform the cluster
+	var actualPvcs corev1.PersistentVolumeClaimList
+	opts := []client.ListOption{
+		client.InNamespace(instance.Namespace),
+	}
+	if err := r.List(context.TODO(), &actualPvcs, opts...); err != nil {
+		return err
+	} else {
+		if err := r.addPvcs(instance, expectedPvcs, actualPvcs.Items, storages); err != nil {
+			return err
+		}
+		if err := r.deletePvcs(instance, expectedPvcs, actualPvcs.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectedPvcs returns the PVCs that the Operator is expected to reconcile for the storage in the NodeSets of the
+// passed Nuxeo CR, along with a map of the storage spec of each PVC by PVC name
+func (r *NuxeoReconciler) expectedPvcs(instance *v1alpha1.Nuxeo) ([]corev1.PersistentVolumeClaim,
+	map[string]v1alpha1.NuxeoStorageSpec, error) {
 	var expectedPvcs []corev1.PersistentVolumeClaim
+	storages := map[string]v1alpha1.NuxeoStorageSpec{}
 	for _, nodeSet := range instance.Spec.NodeSets {
+		if isStatefulSet(nodeSet) {
+			// the StatefulSet controller creates the PVCs from the StatefulSet volume claim templates
+			continue
+		}
 		for _, storage := range nodeSet.Storage {
 			if !reflect.DeepEqual(storage.VolumeClaimTemplate, corev1.PersistentVolumeClaim{}) {
 				// CR defines an explicit PVC for the storage
 				storage.VolumeClaimTemplate.Namespace = instance.Namespace
-				_ = controllerutil.SetControllerReference(instance, &storage.VolumeClaimTemplate, r.Scheme)
+				storage.VolumeClaimTemplate.Labels = mergeMaps(recommendedLabels(instance),
+					storage.VolumeClaimTemplate.Labels)
+				r.setPvcRetention(instance, &storage.VolumeClaimTemplate, retentionPolicy(instance, storage))
 				expectedPvcs = append(expectedPvcs, storage.VolumeClaimTemplate)
+				storages[storage.VolumeClaimTemplate.Name] = storage
 			} else if storage.VolumeSource == (corev1.VolumeSource{}) {
 				// default PVC - let the operator define the PVC struct
-				volName := volumeNameForStorage(storage.StorageType)
+				pvcName, err := r.pvcName(instance, storage.StorageType)
+				if err != nil {
+					return nil, nil, err
+				}
 				pvc := corev1.PersistentVolumeClaim{
 					ObjectMeta: metav1.ObjectMeta{
-						Name:      volName + "-pvc",
+						Name:      pvcName,
 						Namespace: instance.Namespace,
+						Labels:    recommendedLabels(instance),
 					},
-					Spec: corev1.PersistentVolumeClaimSpec{
-						AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
-						Resources: corev1.ResourceRequirements{
-							Requests: corev1.ResourceList{
-								corev1.ResourceStorage: resource.MustParse(storage.Size),
-							},
-						},
-					},
+					Spec: defaultPvcSpec(storage),
 				}
-				_ = controllerutil.SetControllerReference(instance, &pvc, r.Scheme)
+				r.setPvcRetention(instance, &pvc, retentionPolicy(instance, storage))
 				expectedPvcs = append(expectedPvcs, pvc)
+				storages[pvc.Name] = storage
 			} else {
 				// volume source explicitly defined in CR so do not reconcile a PVC for this storage spec
 			}
 		}
 	}
-	// we now have a (possibly empty) list of all PVCs that are expected in the cluster - conform the cluster
-	var actualPvcs corev1.PersistentVolumeClaimList
-	opts := []client.ListOption{
-		client.InNamespace(instance.Namespace),
+	return expectedPvcs, storages, nil
+}
+
+// defaultPvcSpec returns the spec of the PVC that the Operator generates for the passed storage if the storage does
+// not define an explicit PVC template or volume source
+func defaultPvcSpec(storage v1alpha1.NuxeoStorageSpec) corev1.PersistentVolumeClaimSpec {
+	return corev1.PersistentVolumeClaimSpec{
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceStorage: resource.MustParse(storage.Size),
+			},
+		},
 	}
-	if err := r.List(context.TODO(), &actualPvcs, opts...); err != nil {
-		return err
-	} else {
-		if err := r.addPvcs(instance, expectedPvcs, actualPvcs.Items); err != nil {
-			return err
-		}
-		if err := r.deletePvcs(instance, expectedPvcs, actualPvcs.Items); err != nil {
-			return err
+}
+
+// pvcName returns the name of the default PVC that the Operator generates for the passed storage type. The name is
+// scoped to the Nuxeo CR: the Nuxeo CR name + dash + volume name + dash + 'pvc'. E.g.: 'my-nuxeo-binaries-pvc'.
+// Prior versions of the Operator did not prefix the name with the Nuxeo CR name. So the data in an existing
+// install is not orphaned, if a PVC with the legacy name exists and is owned by - or was retained for - the passed
+// Nuxeo CR, then the legacy name is returned.
+func (r *NuxeoReconciler) pvcName(instance *v1alpha1.Nuxeo, storageType v1alpha1.NuxeoStorage) (string, error) {
+	legacyName := volumeNameForStorage(storageType) + "-pvc"
+	pvc := corev1.PersistentVolumeClaim{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: legacyName, Namespace: instance.Namespace},
+		&pvc); err == nil {
+		if ownsPvc(instance, pvc.ObjectMeta) {
+			return legacyName, nil
 		}
+	} else if !apierrors.IsNotFound(err) {
+		return "", err
 	}
-	return nil
+	return instance.Name + "-" + legacyName, nil
 }
 
 // getPvc searches the passed array of PVCs for one with a Name matching the passed pvc Name. If found, returns
@@ -95,44 +146,169 @@ func getPvc(pvcs []corev1.PersistentVolumeClaim, pvcName string) *corev1.Persist
 	return nil
 }
 
-// addPvcs creates expected PVCs in the cluster if 1) not already existent, or 2) the specs differ. If there
-// is an existing PVC for an expected PVC (same name) and that existing PVC is not owned by the passed Nuxeo
-// CR, then that is an error condition, and a non-nil error is returned.
+// addPvcs creates expected PVCs in the cluster if not already existent, and updates existing PVCs whose specs
+// differ from the expected PVCs. If there is an existing PVC for an expected PVC (same name) and that existing PVC
+// neither is owned by - nor was retained for - the passed Nuxeo CR, then that is an error condition, and a non-nil
+// error is returned. The retention of an existing PVC is conformed to the expected PVC. The passed storages map
+// holds the storage spec of each expected PVC by PVC name.
 func (r *NuxeoReconciler) addPvcs(instance *v1alpha1.Nuxeo, expected []corev1.PersistentVolumeClaim,
-	actual []corev1.PersistentVolumeClaim) error {
+	actual []corev1.PersistentVolumeClaim, storages map[string]v1alpha1.NuxeoStorageSpec) error {
 	for _, expectedPvc := range expected {
 		if actualPvc := getPvc(actual, expectedPvc.Name); actualPvc != nil {
-			if !instance.IsOwner(actualPvc.ObjectMeta) {
-				return fmt.Errorf("existing PVC '%v' is not owned by this Nuxeo '%v' and cannot be reconciled",
-					actualPvc.Name, instance.UID)
+			if actualPvc.DeletionTimestamp != nil {
+				return pvcTerminatingError(actualPvc.Name)
 			}
-			if !util.PvcComparer(&expectedPvc, actualPvc) {
-				if err := r.Delete(context.TODO(), actualPvc); err != nil {
-					return err
-				}
-				if err := r.Create(context.TODO(), &expectedPvc); err != nil {
-					return err
-				}
-			} else {
-				// same - nop
+			if !ownsPvc(instance, actualPvc.ObjectMeta) {
+				return withCondition(v1alpha1.ConditionStorageBound, "PvcOwnershipConflict",
+					fmt.Errorf("existing PVC '%v' is not owned by this Nuxeo '%v' and cannot be reconciled",
+						actualPvc.Name, instance.UID))
+			}
+			if err := r.conformPvcRetention(instance, &expectedPvc, actualPvc); err != nil {
+				return err
+			}
+			if err := r.updatePvc(instance, &expectedPvc, actualPvc, storages[expectedPvc.Name].Reclaim); err != nil {
+				return err
 			}
 		} else if err := r.Create(context.TODO(), &expectedPvc); err != nil {
 			return err
+		} else {
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Created", "Created PersistentVolumeClaim %v",
+				expectedPvc.Name)
+		}
+	}
+	return nil
+}
+
+// updatePvc conforms the passed actual PVC to the passed expected PVC. Since a PVC holds data, its spec is treated
+// as immutable with one exception: an increased storage request is applied in place if the storage class of the
+// PVC allows volume expansion. Any other difference is an incompatible change. If the passed reclaim policy is
+// 'Recreate', then an incompatible change is applied by deleting and re-creating the PVC, losing its data. Since
+// the PVC is not deleted while Pods use it, an error with a StorageBound condition is returned until the PVC is
+// gone and can be re-created. Otherwise, the PVC is left unchanged and an error with a StorageBound condition is
+// returned.
+func (r *NuxeoReconciler) updatePvc(instance *v1alpha1.Nuxeo, expected *corev1.PersistentVolumeClaim,
+	actual *corev1.PersistentVolumeClaim, reclaim v1alpha1.PvcReclaimPolicy) error {
+	incompatibility, grow := comparePvcs(expected, actual)
+	if incompatibility == "" && !grow {
+		return nil
+	}
+	if incompatibility == "" {
+		if expandable, err := r.allowsExpansion(actual); err != nil {
+			return err
+		} else if expandable {
+			size := expected.Spec.Resources.Requests[corev1.ResourceStorage]
+			if actual.Spec.Resources.Requests == nil {
+				actual.Spec.Resources.Requests = corev1.ResourceList{}
+			}
+			actual.Spec.Resources.Requests[corev1.ResourceStorage] = size
+			if err := r.Update(context.TODO(), actual); err != nil {
+				return err
+			}
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Updated",
+				"Expanded PersistentVolumeClaim %v to %v", actual.Name, size.String())
+			return nil
 		}
+		incompatibility = "the storage class of the PVC does not allow volume expansion"
+	}
+	if reclaim != v1alpha1.PvcReclaimRecreate {
+		return withCondition(v1alpha1.ConditionStorageBound, "PvcChangeRefused",
+			fmt.Errorf("refusing to change existing PVC '%v': %v. Set the storage reclaim policy to '%v' to "+
+				"re-create the PVC, which deletes its data", actual.Name, incompatibility, v1alpha1.PvcReclaimRecreate))
+	}
+	if err := r.Delete(context.TODO(), actual); err != nil {
+		return err
 	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Deleted", "Deleted PersistentVolumeClaim %v to re-create "+
+		"it: %v", actual.Name, incompatibility)
+	// the PVC is only deleted once no Pod uses it, so it may still exist
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: actual.Name, Namespace: actual.Namespace},
+		&corev1.PersistentVolumeClaim{}); err == nil {
+		return pvcTerminatingError(actual.Name)
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := r.Create(context.TODO(), expected); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Created", "Re-created PersistentVolumeClaim %v",
+		expected.Name)
 	return nil
 }
 
+// pvcTerminatingError returns an error with a StorageBound condition for the passed PVC, which is being deleted.
+// Kubernetes does not delete a PVC while a Pod uses it, so the PVC stays terminating - and cannot be re-created -
+// until the Pods of the NodeSet release it. Since the reconciliation is retried, the PVC is re-created once it is
+// gone.
+func pvcTerminatingError(pvcName string) error {
+	return withCondition(v1alpha1.ConditionStorageBound, "PvcRecreatePending",
+		fmt.Errorf("waiting for PVC '%v' to be deleted before re-creating it. The PVC is not deleted while Pods "+
+			"use it - delete the Pods of the NodeSet, or scale the NodeSet to zero, to release it", pvcName))
+}
+
+// comparePvcs compares the passed expected and actual PVCs. If the expected PVC differs from the actual PVC in a way
+// that cannot be applied to the actual PVC, then a description of the difference is returned. Otherwise, an empty
+// string is returned, along with true if the expected PVC requests more storage than the actual PVC.
+func comparePvcs(expected *corev1.PersistentVolumeClaim, actual *corev1.PersistentVolumeClaim) (string, bool) {
+	if !reflect.DeepEqual(expected.Spec.AccessModes, actual.Spec.AccessModes) {
+		return fmt.Sprintf("access modes cannot be changed from %v to %v", actual.Spec.AccessModes,
+			expected.Spec.AccessModes), false
+	}
+	if expected.Spec.VolumeMode != nil &&
+		(actual.Spec.VolumeMode == nil || *expected.Spec.VolumeMode != *actual.Spec.VolumeMode) {
+		return "volume mode cannot be changed", false
+	}
+	if expected.Spec.StorageClassName != nil &&
+		(actual.Spec.StorageClassName == nil || *expected.Spec.StorageClassName != *actual.Spec.StorageClassName) {
+		return fmt.Sprintf("storage class cannot be changed to '%v'", *expected.Spec.StorageClassName), false
+	}
+	expectedSize := expected.Spec.Resources.Requests[corev1.ResourceStorage]
+	actualSize := actual.Spec.Resources.Requests[corev1.ResourceStorage]
+	switch expectedSize.Cmp(actualSize) {
+	case -1:
+		return fmt.Sprintf("storage request cannot be reduced from %v to %v", actualSize.String(),
+			expectedSize.String()), false
+	case 1:
+		return "", true
+	}
+	return "", false
+}
+
+// allowsExpansion returns true if the storage class of the passed PVC allows volume expansion. A PVC with no
+// storage class, or with a storage class that does not exist in the cluster, is not considered expandable.
+func (r *NuxeoReconciler) allowsExpansion(pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, nil
+	}
+	sc := storagev1.StorageClass{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: *pvc.Spec.StorageClassName}, &sc); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return sc.AllowVolumeExpansion != nil && *sc.AllowVolumeExpansion, nil
+}
+
 // deletePvcs removes orphaned PVCs. The use case is: a Nuxeo CR is deployed with a PVC defined for, say, Data.
 // Someone edits the Nuxeo CR and changes the name of the PVC. This function removes the previous PVC. Only PVCs
-// owned by the passed Nuxeo CR are removed.
+// owned by the passed Nuxeo CR are removed. Since the storage of an orphaned PVC is no longer in the Nuxeo CR, the
+// retention policy recorded on the PVC applies: if it is 'Retain', then the orphaned PVC is released rather than
+// removed. See recordedRetentionPolicy.
 func (r *NuxeoReconciler) deletePvcs(instance *v1alpha1.Nuxeo, expected []corev1.PersistentVolumeClaim,
 	actual []corev1.PersistentVolumeClaim) error {
 	for _, actualPvc := range actual {
 		if expectedPvc := getPvc(expected, actualPvc.Name); expectedPvc == nil && instance.IsOwner(actualPvc.ObjectMeta) {
+			if recordedRetentionPolicy(instance, actualPvc.ObjectMeta) == v1alpha1.RetentionRetain {
+				if err := r.releasePvc(instance, &actualPvc); err != nil {
+					return err
+				}
+				continue
+			}
 			if err := r.Delete(context.TODO(), &actualPvc); err != nil {
 				return err
 			}
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Deleted", "Deleted PersistentVolumeClaim %v",
+				actualPvc.Name)
 		}
 	}
 	return nil
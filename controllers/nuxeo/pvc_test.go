@@ -18,23 +18,29 @@ package nuxeo
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 // Performs a basic PVC test. Defines a Nuxeo CR with storage configuration that should result in two PVCs.
-// Creates an orphaned PVC. Ensures that the two PVCs were created and the orphan was removed.
+// Creates an orphaned PVC. Ensures that the two PVCs were created and the orphan was removed, since the Nuxeo CR
+// retention policy is explicitly Delete.
 func (suite *persistentVolumeClaimSuite) TestBasicPVC() {
 	var err error
 	nux := suite.persistentVolumeClaimSuiteNewNuxeo()
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionDelete
 	err = createOrphanPVC(nux, suite.orphanPVCName, suite.r)
 	require.Nil(suite.T(), err, "Error creating orphaned")
 	err = suite.r.reconcilePvc(nux)
@@ -54,6 +60,144 @@ func (suite *persistentVolumeClaimSuite) TestBasicPVC() {
 	}
 }
 
+// TestPvcNames tests that the default PVC is named from the Nuxeo CR, and that a legacy un-scoped PVC owned by
+// the Nuxeo CR continues to be used so existing data is not orphaned
+func (suite *persistentVolumeClaimSuite) TestPvcNames() {
+	nux := suite.persistentVolumeClaimSuiteNewNuxeo()
+	pvcName, err := suite.r.pvcName(nux, v1alpha1.NuxeoStorageBinaries)
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), suite.nuxeoName+"-binaries-pvc", pvcName, "Default PVC name should be scoped to the CR")
+	err = createOrphanPVC(nux, "binaries-pvc", suite.r)
+	require.Nil(suite.T(), err, "Error creating legacy PVC")
+	pvcName, err = suite.r.pvcName(nux, v1alpha1.NuxeoStorageBinaries)
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), "binaries-pvc", pvcName, "Legacy PVC should have been used")
+	// same size as the legacy PVC so the reconciler doesn't refuse the change
+	nux.Spec.NodeSets[0].Storage[0].Size = "1M"
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err, "reconcilePvc failed")
+	pvc := corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: "binaries-pvc", Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err, "Legacy PVC should not have been removed")
+}
+
+// TestPvcExpansion tests that an increased size is applied in place to a PVC whose storage class allows
+// volume expansion
+func (suite *persistentVolumeClaimSuite) TestPvcExpansion() {
+	nux := suite.persistentVolumeClaimSuiteNewNuxeo()
+	err := suite.createStorageClass("foo-storage-class", true)
+	require.Nil(suite.T(), err)
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err, "reconcilePvc failed")
+	pvc := corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: "explicit-pvc", Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err)
+	// a re-created PVC would not have this label
+	pvc.Labels["test"] = "expansion"
+	err = suite.r.Update(context.TODO(), &pvc)
+	require.Nil(suite.T(), err)
+	nux.Spec.NodeSets[0].Storage[2].VolumeClaimTemplate.Spec.Resources.Requests[corev1.ResourceStorage] =
+		resource.MustParse("20M")
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err, "reconcilePvc should have expanded the PVC")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: "explicit-pvc", Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), "expansion", pvc.Labels["test"], "PVC should have been updated in place")
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	require.Equal(suite.T(), "20M", size.String(), "PVC should have been expanded")
+}
+
+// TestPvcChangeRefused tests that incompatible PVC changes are refused with a StorageBound condition, and are
+// applied by re-creating the PVC if the reclaim policy is Recreate
+func (suite *persistentVolumeClaimSuite) TestPvcChangeRefused() {
+	nux := suite.persistentVolumeClaimSuiteNewNuxeo()
+	err := suite.createStorageClass("foo-storage-class", true)
+	require.Nil(suite.T(), err)
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err, "reconcilePvc failed")
+	// the default PVC has no storage class so it can't be expanded
+	nux.Spec.NodeSets[0].Storage[0].Size = "20M"
+	err = suite.r.reconcilePvc(nux)
+	require.NotNil(suite.T(), err, "Expansion without a storage class should have been refused")
+	var condErr *conditionError
+	require.True(suite.T(), errors.As(err, &condErr), "Refusal should carry a condition")
+	require.Equal(suite.T(), "PvcChangeRefused", condErr.reason)
+	// shrinking is refused regardless of the storage class
+	nux.Spec.NodeSets[0].Storage[0].Size = "10M"
+	nux.Spec.NodeSets[0].Storage[2].VolumeClaimTemplate.Spec.Resources.Requests[corev1.ResourceStorage] =
+		resource.MustParse("1M")
+	err = suite.r.reconcilePvc(nux)
+	require.NotNil(suite.T(), err, "Shrinking should have been refused")
+	pvc := corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: "explicit-pvc", Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err)
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	require.Equal(suite.T(), "10M", size.String(), "Refused PVC should not have been changed")
+	nux.Spec.NodeSets[0].Storage[2].Reclaim = v1alpha1.PvcReclaimRecreate
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err, "reconcilePvc should have re-created the PVC")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: "explicit-pvc", Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err)
+	size = pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	require.Equal(suite.T(), "1M", size.String(), "PVC should have been re-created")
+}
+
+// TestPvcRecreateInUse tests that a PVC that is re-created for an incompatible change, but that is kept by the
+// PVC protection finalizer because Pods use it, is reported with a StorageBound condition until it is gone, and
+// is then re-created
+func (suite *persistentVolumeClaimSuite) TestPvcRecreateInUse() {
+	nux := suite.persistentVolumeClaimSuiteNewNuxeo()
+	err := suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err, "reconcilePvc failed")
+	r := suite.r
+	r.Client = &pvcProtectionClient{Client: suite.r.Client}
+	nux.Spec.NodeSets[0].Storage[2].Reclaim = v1alpha1.PvcReclaimRecreate
+	nux.Spec.NodeSets[0].Storage[2].VolumeClaimTemplate.Spec.Resources.Requests[corev1.ResourceStorage] =
+		resource.MustParse("1M")
+	name := types.NamespacedName{Name: "explicit-pvc", Namespace: suite.namespace}
+	for i := 0; i < 2; i++ {
+		err = r.reconcilePvc(nux)
+		var condErr *conditionError
+		require.True(suite.T(), errors.As(err, &condErr), "In-use PVC should be reported: %v", err)
+		require.Equal(suite.T(), "PvcRecreatePending", condErr.reason)
+		pvc := corev1.PersistentVolumeClaim{}
+		_ = r.Get(context.TODO(), name, &pvc)
+		require.NotNil(suite.T(), pvc.DeletionTimestamp, "PVC should be terminating")
+	}
+	// the Pods release the PVC so the finalizer is removed
+	_ = suite.r.Delete(context.TODO(), &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Name: name.Name, Namespace: name.Namespace}})
+	err = r.reconcilePvc(nux)
+	require.Nil(suite.T(), err, "reconcilePvc should have re-created the PVC")
+	pvc := corev1.PersistentVolumeClaim{}
+	_ = r.Get(context.TODO(), name, &pvc)
+	require.Nil(suite.T(), pvc.DeletionTimestamp)
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	require.Equal(suite.T(), "1M", size.String(), "PVC should have been re-created")
+}
+
+// pvcProtectionClient simulates the 'kubernetes.io/pvc-protection' finalizer of a PVC that is used by a Pod, which
+// the fake client does not: deleting a PVC only marks it as terminating
+type pvcProtectionClient struct {
+	client.Client
+}
+
+// Delete marks a PVC as terminating rather than deleting it, and deletes other objects
+func (c *pvcProtectionClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		return c.Client.Delete(ctx, obj, opts...)
+	}
+	found := corev1.PersistentVolumeClaim{}
+	if err := c.Get(ctx, types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}, &found); err != nil {
+		return err
+	}
+	now := metav1.Now()
+	found.DeletionTimestamp = &now
+	found.Finalizers = []string{"kubernetes.io/pvc-protection"}
+	return c.Update(ctx, &found)
+}
+
 // persistentVolumeClaimSuite is the PersistentVolumeClaim test suite structure
 type persistentVolumeClaimSuite struct {
 	suite.Suite
@@ -75,6 +219,8 @@ func (suite *persistentVolumeClaimSuite) SetupSuite() {
 func (suite *persistentVolumeClaimSuite) AfterTest(_, _ string) {
 	obj := corev1.PersistentVolumeClaim{}
 	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	sc := storagev1.StorageClass{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &sc)
 }
 
 // This function runs the PersistentVolumeClaim unit test suite. It is called by 'go test' and will call every
@@ -132,6 +278,18 @@ func (suite *persistentVolumeClaimSuite) persistentVolumeClaimSuiteNewNuxeo() *v
 	}
 }
 
+// createStorageClass creates a StorageClass with the passed name and volume expansion setting
+func (suite *persistentVolumeClaimSuite) createStorageClass(name string, allowExpansion bool) error {
+	sc := storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Provisioner:          "kubernetes.io/no-provisioner",
+		AllowVolumeExpansion: &allowExpansion,
+	}
+	return suite.r.Create(context.TODO(), &sc)
+}
+
 // Creates an "orphaned" PVC that doesn't match any of the PVCs in the test deployment. This mimics a case where
 // a storage spec was defined in the Nuxeo CR, the reconciliation loop fired, a PVC was created, then the
 // storage spec was removed. In that case we want the reconciler to remove any associated PVC that was created
@@ -21,7 +21,9 @@ import (
 	"fmt"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -47,15 +49,19 @@ const (
 // function is called to do two things: 1) determine logical equality of expected and found, and 2) if unequal
 // to set the state of found from expected so this function can write found back into the cluster.
 //
-// Caller is expected to have set the Nuxeo CR as the owner of 'expected' if that is the intent (this function
-// performs no modifications to 'expected')
-func (r *NuxeoReconciler) addOrUpdate(name string, namespace string, expected runtime.Object, found runtime.Object,
-	comparer comparer) (reconOp, error) {
+// Caller is expected to have set the Nuxeo CR as the owner of 'expected' if that is the intent. The only
+// modification this function makes to 'expected' is to add the Kubernetes recommended labels. A Normal event is
+// recorded against the passed Nuxeo CR for each create or update.
+func (r *NuxeoReconciler) addOrUpdate(instance *v1alpha1.Nuxeo, name string, namespace string, expected runtime.Object,
+	found runtime.Object, comparer comparer) (reconOp, error) {
 	var kind string
 	var err error
 	if kind, err = getKind(r.Scheme, expected); err != nil {
 		return NA, err
 	}
+	if err = addRecommendedLabels(instance, expected); err != nil {
+		return NA, err
+	}
 	err = r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, found)
 	if err != nil && apierrors.IsNotFound(err) {
 		r.Log.Info("Creating a new " + kind)
@@ -63,22 +69,28 @@ func (r *NuxeoReconciler) addOrUpdate(name string, namespace string, expected ru
 		if err != nil {
 			return NA, err
 		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Created", "Created %v %v", kind, name)
 		return Created, nil
 	} else if err != nil {
 		return NA, err
 	}
-	if !comparer(expected, found) {
+	same := comparer(expected, found)
+	if labelsChanged, err := syncLabels(expected, found); err != nil {
+		return NA, err
+	} else if !same || labelsChanged {
 		r.Log.Info("Updating " + kind)
 		if err = r.Update(context.TODO(), found); err != nil {
 			return Updated, err
 		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Updated", "Updated %v %v", kind, name)
 	}
 	return NA, nil
 }
 
 // removeIfPresent looks for an object in the cluster matching the passed name and type (as expressed in the 'found'
 // arg.) If such an object exists, and it is owned by the passed Nuxeo instance, then the object is removed.
-// Otherwise cluster state is not modified.
+// Otherwise cluster state is not modified. A Normal event is recorded against the passed Nuxeo CR if the object
+// is removed.
 func (r *NuxeoReconciler) removeIfPresent(instance *v1alpha1.Nuxeo, name string, namespace string,
 	found runtime.Object) error {
 	var kind string
@@ -95,6 +107,7 @@ func (r *NuxeoReconciler) removeIfPresent(instance *v1alpha1.Nuxeo, name string,
 			if err := r.Delete(context.TODO(), found); err != nil {
 				return err
 			}
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Deleted", "Deleted %v %v", kind, name)
 		}
 	} else if !apierrors.IsNotFound(err) {
 		return err
@@ -130,6 +143,35 @@ func getOwnerRefs(obj runtime.Object) ([]string, error) {
 	}
 }
 
+// syncLabels adds the labels of the passed expected object to the passed found object. Labels of the found object
+// that are not in the expected object are left as is, since they could have been added by something other than the
+// Operator. Returns true if the found object was modified.
+func syncLabels(expected runtime.Object, found runtime.Object) (bool, error) {
+	expMeta, err := meta.Accessor(expected)
+	if err != nil {
+		return false, err
+	}
+	fndMeta, err := meta.Accessor(found)
+	if err != nil {
+		return false, err
+	}
+	fndLabels := fndMeta.GetLabels()
+	changed := false
+	for key, val := range expMeta.GetLabels() {
+		if fndVal, ok := fndLabels[key]; !ok || fndVal != val {
+			if fndLabels == nil {
+				fndLabels = map[string]string{}
+			}
+			fndLabels[key] = val
+			changed = true
+		}
+	}
+	if changed {
+		fndMeta.SetLabels(fndLabels)
+	}
+	return changed, nil
+}
+
 // Gets the Kind for the passed object. Returns non-nil error if any error was encountered attempting to do that.
 func getKind(scheme *runtime.Scheme, obj runtime.Object) (string, error) {
 	// use the scheme to get the GVK of the object then get the Kind from the GVK
@@ -27,6 +27,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 )
 
 // Tests the addOrUpdate function with a secret. Note that the fake client will not encode the Secret Data so the
@@ -34,6 +35,7 @@ import (
 // secret.
 func (suite *reconUtilSuite) TestReconUtilSecret() {
 	var err error
+	nux := suite.reconUtilSuiteNewNuxeo()
 	exp := v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      suite.secretName,
@@ -42,7 +44,7 @@ func (suite *reconUtilSuite) TestReconUtilSecret() {
 		Data: map[string][]byte{suite.secretKey: suite.secretData},
 		Type: v1.SecretTypeOpaque,
 	}
-	_, err = suite.r.addOrUpdate(suite.secretName, suite.namespace, &exp, &v1.Secret{}, util.SecretComparer)
+	_, err = suite.r.addOrUpdate(nux, suite.secretName, suite.namespace, &exp, &v1.Secret{}, util.SecretComparer)
 	require.Nil(suite.T(), err, "addOrUpdate failed with error")
 	created := v1.Secret{}
 	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: suite.secretName, Namespace: suite.namespace}, &created)
@@ -102,6 +104,33 @@ func (suite *reconUtilSuite) TestShouldNotRemove() {
 	require.Nil(suite.T(), err, "failed to get object")
 }
 
+// Tests that addOrUpdate and removeIfPresent record Normal events against the Nuxeo CR
+func (suite *reconUtilSuite) TestReconUtilEvents() {
+	recorder := record.NewFakeRecorder(10)
+	r := suite.r
+	r.Recorder = recorder
+	nux := suite.reconUtilSuiteNewNuxeo()
+	exp := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.cmName + "-events",
+			Namespace: suite.namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1alpha1",
+				Kind:       "Nuxeo",
+				Name:       suite.nuxeoName,
+				UID:        suite.nuxeoUID,
+			}},
+		},
+		Data: map[string]string{"x": "y"},
+	}
+	_, err := r.addOrUpdate(nux, exp.Name, suite.namespace, &exp, &v1.ConfigMap{}, util.ConfigMapComparer)
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), "Normal Created Created ConfigMap "+exp.Name, <-recorder.Events)
+	err = r.removeIfPresent(nux, exp.Name, suite.namespace, &v1.ConfigMap{})
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), "Normal Deleted Deleted ConfigMap "+exp.Name, <-recorder.Events)
+}
+
 // reconUtilSuite is the ReconUtil test suite structure
 type reconUtilSuite struct {
 	suite.Suite
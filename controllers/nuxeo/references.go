@@ -0,0 +1,310 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// indexes Nuxeo CRs by the names of the ConfigMaps that they reference
+	configMapRefIndex = "nuxeo.configMapRefs"
+	// indexes Nuxeo CRs by the names of the Secrets that they reference
+	secretRefIndex = "nuxeo.secretRefs"
+)
+
+// resourceRef identifies a ConfigMap or a Secret that a Nuxeo CR references
+type resourceRef struct {
+	kind string
+	name string
+}
+
+const (
+	configMapKind = "configmap"
+	secretKind    = "secret"
+)
+
+// nodeSetReferences returns the ConfigMaps and Secrets - not generated by the Operator - whose content the
+// Operator renders into the Pods of the passed NodeSet, whether mounted, projected into environment variables, or
+// read by the Operator during reconciliation. Each reference is returned once, in the order in which it is found.
+func nodeSetReferences(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) []resourceRef {
+	var refs []resourceRef
+	add := func(kind string, name string) {
+		if ref := (resourceRef{kind: kind, name: name}); name != "" && !containsRef(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	addVolumeSource := func(vs corev1.VolumeSource) {
+		if vs.ConfigMap != nil {
+			add(configMapKind, vs.ConfigMap.Name)
+		} else if vs.Secret != nil {
+			add(secretKind, vs.Secret.SecretName)
+		}
+	}
+	addEnv := func(env []corev1.EnvVar, envFrom []corev1.EnvFromSource) {
+		for _, envVar := range env {
+			if envVar.ValueFrom == nil {
+				continue
+			} else if envVar.ValueFrom.ConfigMapKeyRef != nil {
+				add(configMapKind, envVar.ValueFrom.ConfigMapKeyRef.Name)
+			} else if envVar.ValueFrom.SecretKeyRef != nil {
+				add(secretKind, envVar.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+		for _, envSource := range envFrom {
+			if envSource.ConfigMapRef != nil {
+				add(configMapKind, envSource.ConfigMapRef.Name)
+			} else if envSource.SecretRef != nil {
+				add(secretKind, envSource.SecretRef.Name)
+			}
+		}
+	}
+	addVolumeSource(nodeSet.NuxeoConfig.NuxeoConf.ValueFrom)
+	addEnv(nodeSet.Env, nil)
+	add(secretKind, nodeSet.NuxeoConfig.JvmPKISecret)
+	for _, pkg := range nodeSet.NuxeoConfig.OfflinePackages {
+		addVolumeSource(pkg.ValueFrom)
+	}
+	for _, prop := range nodeSet.NuxeoConfig.SecretProperties {
+		add(secretKind, prop.SecretKeyRef.Name)
+	}
+	for _, contrib := range nodeSet.Contributions {
+		addVolumeSource(contrib.VolumeSource)
+	}
+	if nodeSet.Interactive {
+		if nginx := instance.Spec.RevProxy.Nginx; nginx != (v1alpha1.NginxRevProxySpec{}) {
+			add(configMapKind, nginx.ConfigMap)
+			add(secretKind, nginx.Secret)
+		} else {
+			add(secretKind, nodeSet.NuxeoConfig.TlsSecret)
+		}
+	}
+	for _, backingService := range instance.Spec.BackingServices {
+		if backingService.Preconfigured.Type != "" {
+			var err error
+			if backingService, err = xlatBacking(backingService.Preconfigured); err != nil {
+				// reported by the reconciler
+				continue
+			}
+		}
+		for _, resource := range backingService.Resources {
+			if isConfigMap(resource) {
+				add(configMapKind, resource.Name)
+			} else if isSecret(resource) {
+				add(secretKind, resource.Name)
+			}
+		}
+	}
+	if binaryStore := instance.Spec.BinaryStore; binaryStore != nil {
+		add(secretKind, binaryStore.S3.CredentialsSecret)
+		add(secretKind, binaryStore.S3.CaBundleSecret)
+	}
+	for _, vol := range instance.Spec.Volumes {
+		addVolumeSource(vol.VolumeSource)
+	}
+	for _, container := range append(append([]corev1.Container{}, instance.Spec.Containers...),
+		instance.Spec.InitContainers...) {
+		addEnv(container.Env, container.EnvFrom)
+	}
+	return refs
+}
+
+// referencedNames returns the names of the resources of the passed kind that any NodeSet of the passed Nuxeo CR
+// references
+func referencedNames(instance *v1alpha1.Nuxeo, kind string) []string {
+	var names []string
+	for _, nodeSet := range instance.Spec.NodeSets {
+		for _, ref := range nodeSetReferences(instance, nodeSet) {
+			if ref.kind == kind {
+				names = appendUnique(names, ref.name)
+			}
+		}
+	}
+	return names
+}
+
+// referencedConfigMaps returns the names of the ConfigMaps that the passed Nuxeo CR references
+func referencedConfigMaps(instance *v1alpha1.Nuxeo) []string {
+	return referencedNames(instance, configMapKind)
+}
+
+// referencedSecrets returns the names of the Secrets that the passed Nuxeo CR references
+func referencedSecrets(instance *v1alpha1.Nuxeo) []string {
+	return referencedNames(instance, secretKind)
+}
+
+// annotateReferences annotates the Pod template of the passed Deployment with a content hash of each ConfigMap and
+// Secret that the passed NodeSet references. E.g.: 'appzygy.net/references: secret/db-creds=9f86d0...'. Since the
+// Operator watches the referenced resources, a change to the content of one of them - e.g. a rotated password or
+// a renewed certificate - changes the Pod template, which rolls the NodeSet. A reference that does not exist is
+// hashed as absent: if the reference is required then reconciliation fails elsewhere.
+func (r *NuxeoReconciler) annotateReferences(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment,
+	nodeSet v1alpha1.NodeSet) error {
+	var hashes []string
+	for _, ref := range nodeSetReferences(instance, nodeSet) {
+		hash, err := r.referenceHash(instance.Namespace, ref)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, ref.kind+"/"+ref.name+"="+hash)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	sort.Strings(hashes)
+	util.AnnotateTemplate(dep, common.ReferencesAnnotation, strings.Join(hashes, ","))
+	return nil
+}
+
+// referenceHash returns the hex-encoded SHA-256 hash of the content of the passed ConfigMap or Secret in the passed
+// namespace, or 'absent' if the resource does not exist. The keys are hashed in order so the hash is deterministic.
+// A cryptographic hash is used because the hash of a Secret is visible to anyone who can read the Deployment, and a
+// short checksum of a low-entropy value - such as a password - could be reversed by brute force.
+func (r *NuxeoReconciler) referenceHash(namespace string, ref resourceRef) (string, error) {
+	data := map[string][]byte{}
+	var obj runtime.Object
+	if ref.kind == configMapKind {
+		obj = &corev1.ConfigMap{}
+	} else {
+		obj = &corev1.Secret{}
+	}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: ref.name, Namespace: namespace}, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "absent", nil
+		}
+		return "", err
+	}
+	switch res := obj.(type) {
+	case *corev1.ConfigMap:
+		for key, val := range res.Data {
+			data[key] = []byte(val)
+		}
+		for key, val := range res.BinaryData {
+			data[key] = val
+		}
+	case *corev1.Secret:
+		data = res.Data
+	}
+	var keys []string
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	for _, key := range keys {
+		buf.WriteString(key)
+		buf.WriteByte(0)
+		buf.Write(data[key])
+		buf.WriteByte(0)
+	}
+	return util.SHA256(buf.Bytes()), nil
+}
+
+// watchReferences configures the passed controller builder to reconcile a Nuxeo CR when a ConfigMap or a Secret
+// that the Nuxeo CR references changes. Since these resources are not owned by the Nuxeo CR, the Nuxeo CRs are
+// indexed by the names of the resources they reference, so a change can be mapped back to the Nuxeo CRs.
+func (r *NuxeoReconciler) watchReferences(mgr ctrl.Manager, bldr *builder.Builder) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1alpha1.Nuxeo{}, configMapRefIndex,
+		func(obj runtime.Object) []string {
+			return referencedConfigMaps(obj.(*v1alpha1.Nuxeo))
+		}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1alpha1.Nuxeo{}, secretRefIndex,
+		func(obj runtime.Object) []string {
+			return referencedSecrets(obj.(*v1alpha1.Nuxeo))
+		}); err != nil {
+		return err
+	}
+	bldr.Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: r.referencingNuxeos(configMapRefIndex, referencedConfigMaps),
+	}).Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: r.referencingNuxeos(secretRefIndex, referencedSecrets),
+	})
+	return nil
+}
+
+// referencingNuxeos returns a function that maps a ConfigMap or Secret to a reconcile request for each Nuxeo CR
+// in the same namespace that references it. The Nuxeo CRs are listed with the passed index, and filtered with
+// the passed function that returns the references of a Nuxeo CR.
+func (r *NuxeoReconciler) referencingNuxeos(index string,
+	references func(*v1alpha1.Nuxeo) []string) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		nuxeos := v1alpha1.NuxeoList{}
+		if err := r.List(context.TODO(), &nuxeos, client.InNamespace(obj.Meta.GetNamespace()),
+			client.MatchingFields{index: obj.Meta.GetName()}); err != nil {
+			r.Log.Error(err, "unable to list Nuxeo CRs referencing resource", "resource", obj.Meta.GetName())
+			return nil
+		}
+		var requests []reconcile.Request
+		for i := range nuxeos.Items {
+			if containsString(references(&nuxeos.Items[i]), obj.Meta.GetName()) {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+					Name:      nuxeos.Items[i].Name,
+					Namespace: nuxeos.Items[i].Namespace,
+				}})
+			}
+		}
+		return requests
+	}
+}
+
+// containsRef returns true if the passed slice contains the passed resource reference
+func containsRef(refs []resourceRef, ref resourceRef) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends the passed string to the passed slice if the slice does not already contain it
+func appendUnique(strs []string, str string) []string {
+	if containsString(strs, str) {
+		return strs
+	}
+	return append(strs, str)
+}
+
+// containsString returns true if the passed slice contains the passed string
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
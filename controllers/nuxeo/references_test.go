@@ -0,0 +1,276 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// TestReferencingNuxeos tests that a change to a ConfigMap that holds an external nuxeo.conf is mapped to a
+// reconcile request for the Nuxeo CR that references it, and not for a Nuxeo CR that does not
+func (suite *referencesSuite) TestReferencingNuxeos() {
+	nux := suite.referencesSuiteNewNuxeo(suite.nuxeoName, "external-nuxeo-conf")
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), nux))
+	other := suite.referencesSuiteNewNuxeo("other", "other-nuxeo-conf")
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), other))
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "external-nuxeo-conf", Namespace: suite.namespace},
+	}
+	requests := suite.r.referencingNuxeos(configMapRefIndex, referencedConfigMaps)(handler.MapObject{
+		Meta: cm, Object: cm,
+	})
+	require.Equal(suite.T(), []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Name: suite.nuxeoName, Namespace: suite.namespace},
+	}}, requests)
+	require.Equal(suite.T(), []string{"other-nuxeo-conf"}, referencedConfigMaps(other))
+	require.Nil(suite.T(), referencedSecrets(other))
+}
+
+// TestNodeSetReferences tests that the ConfigMaps and Secrets referenced throughout the Nuxeo CR are found once
+// each, and that the references that only apply to the interactive NodeSet are only found for that NodeSet
+func (suite *referencesSuite) TestNodeSetReferences() {
+	nux := suite.referencesSuiteNewNuxeo(suite.nuxeoName, "external-nuxeo-conf")
+	nux.Spec.NodeSets[0].Interactive = true
+	nux.Spec.NodeSets[0].NuxeoConfig.TlsSecret = "tls-secret"
+	nux.Spec.NodeSets[0].NuxeoConfig.JvmPKISecret = "jvm-pki"
+	nux.Spec.NodeSets[0].NuxeoConfig.SecretProperties = []v1alpha1.SecretProperty{{
+		Key: "nuxeo.db.password",
+		SecretKeyRef: corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "db-secret"},
+			Key:                  "password",
+		},
+	}}
+	nux.Spec.NodeSets[0].Contributions = []v1alpha1.Contribution{{
+		Templates: []string{"my-contrib"},
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "my-contrib"},
+			},
+		},
+	}}
+	nux.Spec.BackingServices = []v1alpha1.BackingService{{
+		Name: "db",
+		Resources: []v1alpha1.BackingServiceResource{{
+			GroupVersionKind: metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Name:             "db-secret",
+		}},
+	}}
+	nux.Spec.BinaryStore = &v1alpha1.BinaryStoreSpec{
+		S3: v1alpha1.S3BinaryStoreSpec{Bucket: "nuxeo", CredentialsSecret: "s3-creds"},
+	}
+	worker := nux.Spec.NodeSets[0]
+	worker.Name, worker.Interactive = "worker", false
+	nux.Spec.NodeSets = append(nux.Spec.NodeSets, worker)
+	require.Equal(suite.T(), []resourceRef{
+		{configMapKind, "external-nuxeo-conf"},
+		{secretKind, "jvm-pki"},
+		{secretKind, "db-secret"},
+		{configMapKind, "my-contrib"},
+		{secretKind, "tls-secret"},
+		{secretKind, "s3-creds"},
+	}, nodeSetReferences(nux, nux.Spec.NodeSets[0]))
+	require.NotContains(suite.T(), nodeSetReferences(nux, nux.Spec.NodeSets[1]), resourceRef{secretKind, "tls-secret"})
+	require.Equal(suite.T(), []string{"jvm-pki", "db-secret", "tls-secret", "s3-creds"}, referencedSecrets(nux))
+}
+
+// TestEnvReferences tests that the ConfigMaps and Secrets referenced by the environment variables of the NodeSet,
+// and by the environment variables and environment sources of the containers and init containers from the Nuxeo
+// CR, are returned
+func (suite *referencesSuite) TestEnvReferences() {
+	nux := suite.referencesSuiteNewNuxeo(suite.nuxeoName, "")
+	nux.Spec.NodeSets[0].Env = []corev1.EnvVar{{
+		Name:  "PLAIN",
+		Value: "value",
+	}, {
+		Name: "FROM_CM",
+		ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "env-cm"},
+				Key:                  "key",
+			},
+		},
+	}, {
+		Name: "FROM_SECRET",
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "env-secret"},
+				Key:                  "key",
+			},
+		},
+	}, {
+		Name: "FROM_FIELD",
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		},
+	}}
+	nux.Spec.Containers = []corev1.Container{{
+		Name: "sidecar",
+		Env: []corev1.EnvVar{{
+			Name: "SIDECAR_SECRET",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "sidecar-secret"},
+					Key:                  "key",
+				},
+			},
+		}},
+		EnvFrom: []corev1.EnvFromSource{{
+			ConfigMapRef: &corev1.ConfigMapEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "sidecar-cm"},
+			},
+		}},
+	}}
+	nux.Spec.InitContainers = []corev1.Container{{
+		Name: "init",
+		EnvFrom: []corev1.EnvFromSource{{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "init-secret"},
+			},
+		}, {
+			ConfigMapRef: &corev1.ConfigMapEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "sidecar-cm"},
+			},
+		}},
+	}}
+	require.Equal(suite.T(), []resourceRef{
+		{configMapKind, "env-cm"},
+		{secretKind, "env-secret"},
+		{secretKind, "sidecar-secret"},
+		{configMapKind, "sidecar-cm"},
+		{secretKind, "init-secret"},
+	}, nodeSetReferences(nux, nux.Spec.NodeSets[0]))
+	require.Equal(suite.T(), []string{"env-cm", "sidecar-cm"}, referencedConfigMaps(nux))
+}
+
+// TestAnnotateReferences tests that the Pod template is annotated with a hash of each referenced resource, and
+// that the annotation changes when the content of a referenced resource changes
+func (suite *referencesSuite) TestAnnotateReferences() {
+	nux := suite.referencesSuiteNewNuxeo(suite.nuxeoName, "external-nuxeo-conf")
+	nux.Spec.NodeSets[0].NuxeoConfig.SecretProperties = []v1alpha1.SecretProperty{{
+		Key: "nuxeo.db.password",
+		SecretKeyRef: corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "db-secret"},
+			Key:                  "password",
+		},
+	}}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "external-nuxeo-conf", Namespace: suite.namespace},
+		Data:       map[string]string{"nuxeo.conf": "a.b=c\n"},
+	}
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), cm))
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-secret", Namespace: suite.namespace},
+		Data:       map[string][]byte{"password": []byte("secret1")},
+	}
+	require.Nil(suite.T(), suite.r.Create(context.TODO(), secret))
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	annotation := suite.getDeployment(nux).Spec.Template.Annotations[common.ReferencesAnnotation]
+	require.Regexp(suite.T(), "^configmap/external-nuxeo-conf=[0-9a-f]{64},secret/db-secret=[0-9a-f]{64}$",
+		annotation)
+	// the SHA-256 hash of the key and value, each followed by a NUL
+	require.Equal(suite.T(), "secret/db-secret="+
+		"3bec34b59b13a4c8555db1348e8719a860d230bc56066902a81408f1eee9180a", strings.Split(annotation, ",")[1])
+	secret.Data["password"] = []byte("secret2")
+	require.Nil(suite.T(), suite.r.Update(context.TODO(), secret))
+	_, err = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	newAnnotation := suite.getDeployment(nux).Spec.Template.Annotations[common.ReferencesAnnotation]
+	require.NotEqual(suite.T(), annotation, newAnnotation, "Secret change should have changed the Pod template")
+	require.Equal(suite.T(), strings.Split(annotation, ",")[0], strings.Split(newAnnotation, ",")[0],
+		"ConfigMap hash should not have changed")
+}
+
+// referencesSuite is the referenced resources test suite structure
+type referencesSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *referencesSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *referencesSuite) AfterTest(_, _ string) {
+	obj := v1alpha1.Nuxeo{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	dep := appsv1.Deployment{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &dep)
+	cm := corev1.ConfigMap{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &cm)
+	secret := corev1.Secret{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &secret)
+}
+
+// This function runs the referenced resources unit test suite. It is called by 'go test' and will call every
+// function in this file with a referencesSuite receiver that begins with "Test..."
+func TestReferencesUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(referencesSuite))
+}
+
+// getDeployment gets the Deployment generated for the first NodeSet of the passed Nuxeo CR
+func (suite *referencesSuite) getDeployment(nux *v1alpha1.Nuxeo) *appsv1.Deployment {
+	dep := &appsv1.Deployment{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, dep)
+	return dep
+}
+
+// referencesSuiteNewNuxeo creates a test Nuxeo struct with the passed name, whose NodeSet references an external
+// nuxeo.conf in the ConfigMap with the passed name
+func (suite *referencesSuite) referencesSuiteNewNuxeo(name string, cmName string) *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:     "cluster",
+				Replicas: 1,
+				NuxeoConfig: v1alpha1.NuxeoConfig{
+					NuxeoConf: v1alpha1.NuxeoConfigSetting{
+						ValueFrom: corev1.VolumeSource{
+							ConfigMap: &corev1.ConfigMapVolumeSource{
+								LocalObjectReference: corev1.LocalObjectReference{Name: cmName},
+							},
+						},
+					},
+				},
+			}},
+		},
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reconcileFinalizer adds the PVC retention finalizer to the passed Nuxeo CR if any of the PVCs generated for the
+// Nuxeo CR are retained, and removes the finalizer otherwise. If the Nuxeo CR is being deleted, then the retained
+// PVCs are released and the finalizer is removed so the deletion can proceed. In that case true is returned,
+// meaning the caller should not reconcile the Nuxeo CR any further.
+func (r *NuxeoReconciler) reconcileFinalizer(instance *v1alpha1.Nuxeo) (bool, error) {
+	hasFinalizer := controllerutil.ContainsFinalizer(instance, common.PvcRetentionFinalizer)
+	if instance.DeletionTimestamp != nil {
+		if hasFinalizer {
+			if err := r.releasePvcs(instance); err != nil {
+				return true, err
+			}
+			controllerutil.RemoveFinalizer(instance, common.PvcRetentionFinalizer)
+			if err := r.Update(context.TODO(), instance); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	if retainsPvcs(instance) && !hasFinalizer {
+		controllerutil.AddFinalizer(instance, common.PvcRetentionFinalizer)
+		return false, r.Update(context.TODO(), instance)
+	} else if !retainsPvcs(instance) && hasFinalizer {
+		controllerutil.RemoveFinalizer(instance, common.PvcRetentionFinalizer)
+		return false, r.Update(context.TODO(), instance)
+	}
+	return false, nil
+}
+
+// releasePvcs releases each PVC owned by the passed Nuxeo CR whose retention policy is 'Retain', so that the PVC
+// is not garbage collected when the Nuxeo CR is deleted. Retained PVCs are normally released when they are
+// reconciled, so this covers PVCs that were not reconciled since their retention policy changed. An owned PVC that
+// is not expected - e.g. because its storage was removed from the Nuxeo CR - has its recorded retention policy.
+func (r *NuxeoReconciler) releasePvcs(instance *v1alpha1.Nuxeo) error {
+	_, storages, err := r.expectedPvcs(instance)
+	if err != nil {
+		return err
+	}
+	pvcs := corev1.PersistentVolumeClaimList{}
+	if err := r.List(context.TODO(), &pvcs, client.InNamespace(instance.Namespace)); err != nil {
+		return err
+	}
+	for _, pvc := range pvcs.Items {
+		if !instance.IsOwner(pvc.ObjectMeta) {
+			continue
+		}
+		policy := recordedRetentionPolicy(instance, pvc.ObjectMeta)
+		if storage, ok := storages[pvc.Name]; ok {
+			policy = retentionPolicy(instance, storage)
+		}
+		if policy == v1alpha1.RetentionRetain {
+			if err := r.releasePvc(instance, &pvc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releasePvc removes the owner reference to the passed Nuxeo CR from the passed PVC, records the 'Retain' policy on
+// it, and labels the PVC with the Nuxeo CR name so a Nuxeo CR with the same name can later adopt the PVC
+func (r *NuxeoReconciler) releasePvc(instance *v1alpha1.Nuxeo, pvc *corev1.PersistentVolumeClaim) error {
+	var refs []metav1.OwnerReference
+	for _, ref := range pvc.OwnerReferences {
+		if ref.UID != instance.UID {
+			refs = append(refs, ref)
+		}
+	}
+	pvc.OwnerReferences = refs
+	if pvc.Labels == nil {
+		pvc.Labels = map[string]string{}
+	}
+	pvc.Labels[common.NuxeoCrLabel] = instance.Name
+	pvc.Annotations = mergeMaps(pvc.Annotations,
+		map[string]string{common.RetentionPolicyAnnotation: string(v1alpha1.RetentionRetain)})
+	if err := r.Update(context.TODO(), pvc); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Retained", "Retained PersistentVolumeClaim %v", pvc.Name)
+	return nil
+}
+
+// setPvcRetention configures the passed expected PVC for the passed retention policy. The policy is recorded in an
+// annotation on the PVC, and the PVC is labeled with the Nuxeo CR name. A PVC with the 'Delete' policy is owned by
+// the passed Nuxeo CR, so it is garbage collected with the Nuxeo CR. A PVC with the 'Retain' policy is not given an
+// owner reference at all. Otherwise, foreground deletion of the Nuxeo CR could garbage collect the PVC - since the
+// owner reference blocks owner deletion - before the finalizer releases it.
+func (r *NuxeoReconciler) setPvcRetention(instance *v1alpha1.Nuxeo, pvc *corev1.PersistentVolumeClaim,
+	policy v1alpha1.RetentionPolicy) {
+	pvc.Labels = mergeMaps(pvc.Labels, map[string]string{common.NuxeoCrLabel: instance.Name})
+	pvc.Annotations = mergeMaps(pvc.Annotations, map[string]string{common.RetentionPolicyAnnotation: string(policy)})
+	if policy != v1alpha1.RetentionRetain {
+		_ = controllerutil.SetControllerReference(instance, pvc, r.Scheme)
+	}
+}
+
+// conformPvcRetention conforms the retention of the passed actual PVC to the passed expected PVC generated by
+// expectedPvcs: the recorded retention policy, and the owner reference. So a PVC whose retention policy changes to
+// 'Retain' is released, and a PVC whose retention policy changes to 'Delete' - or which was retained for a Nuxeo CR
+// with the same name as the passed Nuxeo CR and is now expected with the 'Delete' policy - is adopted.
+func (r *NuxeoReconciler) conformPvcRetention(instance *v1alpha1.Nuxeo, expected *corev1.PersistentVolumeClaim,
+	actual *corev1.PersistentVolumeClaim) error {
+	policy := expected.Annotations[common.RetentionPolicyAnnotation]
+	retain := policy == string(v1alpha1.RetentionRetain)
+	if actual.Annotations[common.RetentionPolicyAnnotation] == policy &&
+		instance.IsOwner(actual.ObjectMeta) != retain && actual.Labels[common.NuxeoCrLabel] == instance.Name {
+		return nil
+	}
+	if retain {
+		return r.releasePvc(instance, actual)
+	}
+	actual.Annotations = mergeMaps(actual.Annotations, map[string]string{common.RetentionPolicyAnnotation: policy})
+	actual.Labels = mergeMaps(actual.Labels, map[string]string{common.NuxeoCrLabel: instance.Name})
+	adopt := !instance.IsOwner(actual.ObjectMeta)
+	if err := controllerutil.SetControllerReference(instance, actual, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Update(context.TODO(), actual); err != nil {
+		return err
+	}
+	if adopt {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Adopted", "Adopted retained PersistentVolumeClaim %v",
+			actual.Name)
+	}
+	return nil
+}
+
+// isRetainedFor returns true if the passed object metadata is that of a PVC that is retained for a Nuxeo CR with
+// the same name as the passed Nuxeo CR: it has no controller, and is labeled with the Nuxeo CR name
+func isRetainedFor(instance *v1alpha1.Nuxeo, objMeta metav1.ObjectMeta) bool {
+	return metav1.GetControllerOf(&objMeta) == nil && objMeta.Labels[common.NuxeoCrLabel] == instance.Name
+}
+
+// ownsPvc returns true if the PVC with the passed object metadata belongs to the passed Nuxeo CR: either it is owned
+// by the Nuxeo CR, or it is retained for the Nuxeo CR
+func ownsPvc(instance *v1alpha1.Nuxeo, objMeta metav1.ObjectMeta) bool {
+	return instance.IsOwner(objMeta) || isRetainedFor(instance, objMeta)
+}
+
+// recordedRetentionPolicy returns the retention policy recorded on the PVC with the passed object metadata when it
+// was last reconciled. A PVC generated before the Operator recorded the policy has the retention policy of the
+// passed Nuxeo CR.
+func recordedRetentionPolicy(instance *v1alpha1.Nuxeo, objMeta metav1.ObjectMeta) v1alpha1.RetentionPolicy {
+	if policy := objMeta.Annotations[common.RetentionPolicyAnnotation]; policy != "" {
+		return v1alpha1.RetentionPolicy(policy)
+	}
+	return retentionPolicy(instance, v1alpha1.NuxeoStorageSpec{})
+}
+
+// retentionPolicy returns the retention policy for the passed storage: the storage retention policy if specified,
+// else the Nuxeo CR retention policy if specified, else 'Retain'. So a PVC is only deleted if the 'Delete' policy is
+// explicitly specified
+func retentionPolicy(instance *v1alpha1.Nuxeo, storage v1alpha1.NuxeoStorageSpec) v1alpha1.RetentionPolicy {
+	if storage.RetentionPolicy != "" {
+		return storage.RetentionPolicy
+	} else if instance.Spec.RetentionPolicy != "" {
+		return instance.Spec.RetentionPolicy
+	}
+	return v1alpha1.RetentionRetain
+}
+
+// retainsPvcs returns true if any PVC generated for the passed Nuxeo CR could be retained
+func retainsPvcs(instance *v1alpha1.Nuxeo) bool {
+	if instance.Spec.RetentionPolicy == v1alpha1.RetentionRetain {
+		return true
+	}
+	for _, nodeSet := range instance.Spec.NodeSets {
+		for _, storage := range nodeSet.Storage {
+			if retentionPolicy(instance, storage) == v1alpha1.RetentionRetain {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// TestRetentionPolicyPrecedence tests that the storage retention policy overrides the Nuxeo CR retention policy,
+// which overrides the default of Retain
+func (suite *retentionSuite) TestRetentionPolicyPrecedence() {
+	nux := suite.retentionSuiteNewNuxeo()
+	storage := nux.Spec.NodeSets[0].Storage[0]
+	require.Equal(suite.T(), v1alpha1.RetentionRetain, retentionPolicy(nux, storage))
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionDelete
+	require.Equal(suite.T(), v1alpha1.RetentionDelete, retentionPolicy(nux, storage))
+	storage.RetentionPolicy = v1alpha1.RetentionRetain
+	require.Equal(suite.T(), v1alpha1.RetentionRetain, retentionPolicy(nux, storage))
+}
+
+// TestFinalizer tests that the finalizer is added to the Nuxeo CR only while a PVC could be retained
+func (suite *retentionSuite) TestFinalizer() {
+	nux := suite.retentionSuiteNewNuxeo()
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionDelete
+	err := suite.r.Create(context.TODO(), nux)
+	require.Nil(suite.T(), err)
+	deleting, err := suite.r.reconcileFinalizer(nux)
+	require.Nil(suite.T(), err)
+	require.False(suite.T(), deleting)
+	require.False(suite.T(), controllerutil.ContainsFinalizer(nux, common.PvcRetentionFinalizer),
+		"Finalizer should not have been added")
+	nux.Spec.NodeSets[0].Storage[0].RetentionPolicy = v1alpha1.RetentionRetain
+	_, err = suite.r.reconcileFinalizer(nux)
+	require.Nil(suite.T(), err)
+	require.True(suite.T(), controllerutil.ContainsFinalizer(nux, common.PvcRetentionFinalizer),
+		"Finalizer should have been added")
+	nux.Spec.NodeSets[0].Storage[0].RetentionPolicy = ""
+	nux.Spec.RetentionPolicy = ""
+	_, err = suite.r.reconcileFinalizer(nux)
+	require.Nil(suite.T(), err)
+	require.True(suite.T(), controllerutil.ContainsFinalizer(nux, common.PvcRetentionFinalizer),
+		"Finalizer should have been kept for the default retention policy")
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionDelete
+	_, err = suite.r.reconcileFinalizer(nux)
+	require.Nil(suite.T(), err)
+	require.False(suite.T(), controllerutil.ContainsFinalizer(nux, common.PvcRetentionFinalizer),
+		"Finalizer should have been removed")
+}
+
+// TestRetainAndAdopt tests that a retained PVC is released when the Nuxeo CR is deleted, and is adopted by a
+// re-created Nuxeo CR with the same name
+func (suite *retentionSuite) TestRetainAndAdopt() {
+	nux := suite.retentionSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].Storage[0].RetentionPolicy = v1alpha1.RetentionRetain
+	err := suite.r.Create(context.TODO(), nux)
+	require.Nil(suite.T(), err)
+	_, err = suite.r.reconcileFinalizer(nux)
+	require.Nil(suite.T(), err)
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	pvcName := suite.nuxeoName + "-binaries-pvc"
+	pvc := corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: pvcName, Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err)
+	require.Nil(suite.T(), metav1.GetControllerOf(&pvc), "Retained PVC should not have an owner reference")
+	// simulate deletion of the Nuxeo CR
+	now := metav1.Now()
+	nux.DeletionTimestamp = &now
+	deleting, err := suite.r.reconcileFinalizer(nux)
+	require.Nil(suite.T(), err)
+	require.True(suite.T(), deleting)
+	require.False(suite.T(), controllerutil.ContainsFinalizer(nux, common.PvcRetentionFinalizer),
+		"Finalizer should have been removed")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: pvcName, Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err)
+	require.False(suite.T(), nux.IsOwner(pvc.ObjectMeta), "Retained PVC should have been released")
+	require.Equal(suite.T(), suite.nuxeoName, pvc.Labels[common.NuxeoCrLabel])
+	// re-create the Nuxeo CR with a different UID, and with the Delete policy so it takes ownership of the PVC
+	recreated := suite.retentionSuiteNewNuxeo()
+	recreated.UID = "87654321-4321-4321-4321-210987654321"
+	recreated.Spec.RetentionPolicy = v1alpha1.RetentionDelete
+	err = suite.r.reconcilePvc(recreated)
+	require.Nil(suite.T(), err, "reconcilePvc should have adopted the retained PVC")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: pvcName, Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err)
+	require.True(suite.T(), recreated.IsOwner(pvc.ObjectMeta), "Retained PVC should have been adopted")
+}
+
+// TestRetainRemovedStorage tests that the PVC of a storage removed from the Nuxeo CR is kept rather than removed
+// if no retention policy is specified
+func (suite *retentionSuite) TestRetainRemovedStorage() {
+	nux := suite.retentionSuiteNewNuxeo()
+	err := suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	nux.Spec.NodeSets[0].Storage = nil
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	pvc := corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: suite.nuxeoName + "-binaries-pvc",
+		Namespace: suite.namespace}, &pvc)
+	require.Nil(suite.T(), err, "PVC of removed storage should have been retained")
+	require.False(suite.T(), nux.IsOwner(pvc.ObjectMeta), "PVC of removed storage should have been released")
+}
+
+// TestRetainRecordedPolicy tests that the PVC of a removed storage whose own retention policy was Retain is
+// retained, even though the Nuxeo CR retention policy is Delete
+func (suite *retentionSuite) TestRetainRecordedPolicy() {
+	nux := suite.retentionSuiteNewNuxeo()
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionDelete
+	nux.Spec.NodeSets[0].Storage[0].RetentionPolicy = v1alpha1.RetentionRetain
+	err := suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	pvcName := types.NamespacedName{Name: suite.nuxeoName + "-binaries-pvc", Namespace: suite.namespace}
+	pvc := corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), pvcName, &pvc)
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), string(v1alpha1.RetentionRetain), pvc.Annotations[common.RetentionPolicyAnnotation])
+	nux.Spec.NodeSets[0].Storage = nil
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	err = suite.r.Get(context.TODO(), pvcName, &pvc)
+	require.Nil(suite.T(), err, "PVC of removed storage should have been retained")
+}
+
+// TestRetentionPolicyChange tests that a PVC is released when its retention policy changes to Retain, and adopted
+// again when its retention policy changes back to Delete
+func (suite *retentionSuite) TestRetentionPolicyChange() {
+	nux := suite.retentionSuiteNewNuxeo()
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionDelete
+	err := suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	pvcName := types.NamespacedName{Name: suite.nuxeoName + "-binaries-pvc", Namespace: suite.namespace}
+	pvc := corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), pvcName, &pvc)
+	require.Nil(suite.T(), err)
+	require.True(suite.T(), nux.IsOwner(pvc.ObjectMeta), "PVC should be owned by the Nuxeo CR")
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionRetain
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	pvc = corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), pvcName, &pvc)
+	require.Nil(suite.T(), err)
+	require.False(suite.T(), nux.IsOwner(pvc.ObjectMeta), "PVC should have been released")
+	require.Equal(suite.T(), string(v1alpha1.RetentionRetain), pvc.Annotations[common.RetentionPolicyAnnotation])
+	nux.Spec.RetentionPolicy = v1alpha1.RetentionDelete
+	err = suite.r.reconcilePvc(nux)
+	require.Nil(suite.T(), err)
+	pvc = corev1.PersistentVolumeClaim{}
+	err = suite.r.Get(context.TODO(), pvcName, &pvc)
+	require.Nil(suite.T(), err)
+	require.True(suite.T(), nux.IsOwner(pvc.ObjectMeta), "PVC should have been adopted")
+	require.Equal(suite.T(), string(v1alpha1.RetentionDelete), pvc.Annotations[common.RetentionPolicyAnnotation])
+}
+
+// retentionSuite is the PVC retention test suite structure
+type retentionSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *retentionSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *retentionSuite) AfterTest(_, _ string) {
+	obj := corev1.PersistentVolumeClaim{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	nux := v1alpha1.Nuxeo{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &nux)
+}
+
+// This function runs the PVC retention unit test suite. It is called by 'go test' and will call every
+// function in this file with a retentionSuite receiver that begins with "Test..."
+func TestRetentionUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(retentionSuite))
+}
+
+// retentionSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite
+func (suite *retentionSuite) retentionSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+			UID:       "12345678-1234-1234-1234-123456789012",
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:     "test",
+				Replicas: 1,
+				Storage: []v1alpha1.NuxeoStorageSpec{{
+					StorageType: v1alpha1.NuxeoStorageBinaries,
+					Size:        "10M",
+				}},
+			}},
+		},
+	}
+}
@@ -41,9 +41,9 @@ func configureNginx(dep *appsv1.Deployment, nginx v1alpha1.NginxRevProxySpec) er
 
 // defaultNginxContainer creates and returns a Container struct defining the Nginx reverse proxy. It defines various
 // volume mounts which - therefore - must also be defined in the deployment that ultimately holds this container
-// struct.
+// struct. The Operator registry rewrites are applied to the Nginx image.
 func defaultNginxContainer(nginx v1alpha1.NginxRevProxySpec) corev1.Container {
-	nginxImage := "nginx:latest"
+	nginxImage := imageConfig.NginxImage
 	if nginx.Image != "" {
 		nginxImage = nginx.Image
 	}
@@ -57,7 +57,7 @@ func defaultNginxContainer(nginx v1alpha1.NginxRevProxySpec) corev1.Container {
 	}
 	c := corev1.Container{
 		Name:            "nginx",
-		Image:           nginxImage,
+		Image:           rewriteImage(nginxImage),
 		ImagePullPolicy: pullPolicy,
 		Ports: []corev1.ContainerPort{{
 			Name:          "nginx-port",
@@ -150,7 +150,7 @@ func (r *NuxeoReconciler) reconcileNginxCM(instance *v1alpha1.Nuxeo, configMapNa
 			},
 		}
 		_ = controllerutil.SetControllerReference(instance, cm, r.Scheme)
-		_, err := r.addOrUpdate(cm.Name, instance.Namespace, cm, &corev1.ConfigMap{}, util.ConfigMapComparer)
+		_, err := r.addOrUpdate(instance, cm.Name, instance.Namespace, cm, &corev1.ConfigMap{}, util.ConfigMapComparer)
 		return defaultCmName, err
 	} else {
 		// configurer specified nginx configmap so - in case previously it was not specified and therefore
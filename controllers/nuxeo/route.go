@@ -37,7 +37,7 @@ func (r *NuxeoReconciler) reconcileOpenShiftRoute(access v1alpha1.NuxeoAccess, f
 		if expected, err := r.defaultRoute(instance, access, forcePassthrough, routeName, nodeSet); err != nil {
 			return err
 		} else {
-			_, err = r.addOrUpdate(routeName, instance.Namespace, expected, &routev1.Route{}, util.RouteComparer)
+			_, err = r.addOrUpdate(instance, routeName, instance.Namespace, expected, &routev1.Route{}, util.RouteComparer)
 			return err
 		}
 	} else {
@@ -64,6 +64,7 @@ func (r *NuxeoReconciler) defaultRoute(instance *v1alpha1.Nuxeo, access v1alpha1
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      routeName,
 			Namespace: instance.Namespace,
+			Labels:    nodeSetLabels(instance, nodeSet),
 		},
 		Spec: routev1.RouteSpec{
 			Host: access.Hostname,
@@ -0,0 +1,68 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// configureScheduling copies the scheduling controls from the passed NodeSet into the pod spec of the passed
+// Deployment: node selector, affinity, tolerations, topology spread constraints, and priority class. If the
+// NodeSet is clustered and does not specify an affinity, then a default preferred Pod anti-affinity is
+// configured so the scheduler tries to avoid placing two Pods of the NodeSet on the same host or in the same zone.
+func configureScheduling(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet) {
+	podSpec := &dep.Spec.Template.Spec
+	podSpec.NodeSelector = nodeSet.NodeSelector
+	podSpec.Tolerations = nodeSet.Tolerations
+	podSpec.TopologySpreadConstraints = nodeSet.TopologySpreadConstraints
+	podSpec.PriorityClassName = nodeSet.PriorityClassName
+	if nodeSet.Affinity != nil {
+		podSpec.Affinity = nodeSet.Affinity.DeepCopy()
+	} else if nodeSet.ClusterEnabled {
+		podSpec.Affinity = defaultAntiAffinity(instance, nodeSet)
+	}
+}
+
+// defaultAntiAffinity returns a preferred Pod anti-affinity for the Pods of the passed NodeSet across hosts and,
+// with a lower weight, across zones. Only the Pods of the NodeSet are selected, so the Pods of the NodeSet are not
+// spread against the Pods of other NodeSets. Since these are preferences rather than requirements, a NodeSet can
+// still have more replicas than there are nodes or zones, and the zone term has no effect on nodes without a zone
+// label.
+func defaultAntiAffinity(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) *corev1.Affinity {
+	term := func(weight int32, topologyKey string) corev1.WeightedPodAffinityTerm {
+		return corev1.WeightedPodAffinityTerm{
+			Weight: weight,
+			PodAffinityTerm: corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: nodeSetSelector(instance, nodeSet),
+				},
+				TopologyKey: topologyKey,
+			},
+		}
+	}
+	return &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+				term(100, corev1.LabelHostname),
+				term(50, corev1.LabelZoneFailureDomainStable),
+			},
+		},
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// TestExplicitScheduling tests that the scheduling controls in the NodeSet are copied into the pod spec
+func (suite *schedulingSuite) TestExplicitScheduling() {
+	nux := suite.schedulingSuiteNewNuxeo()
+	nodeSet := &nux.Spec.NodeSets[0]
+	nodeSet.NodeSelector = map[string]string{"pool": "high-cpu"}
+	nodeSet.Tolerations = []corev1.Toleration{{
+		Key:      "dedicated",
+		Operator: corev1.TolerationOpEqual,
+		Value:    "high-cpu",
+		Effect:   corev1.TaintEffectNoSchedule,
+	}}
+	nodeSet.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{
+		MaxSkew:           1,
+		TopologyKey:       corev1.LabelZoneFailureDomainStable,
+		WhenUnsatisfiable: corev1.ScheduleAnyway,
+	}}
+	nodeSet.PriorityClassName = "nuxeo-worker"
+	nodeSet.Affinity = &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{},
+	}
+	dep := appsv1.Deployment{}
+	configureScheduling(nux, &dep, *nodeSet)
+	podSpec := dep.Spec.Template.Spec
+	require.Equal(suite.T(), nodeSet.NodeSelector, podSpec.NodeSelector)
+	require.Equal(suite.T(), nodeSet.Tolerations, podSpec.Tolerations)
+	require.Equal(suite.T(), nodeSet.TopologySpreadConstraints, podSpec.TopologySpreadConstraints)
+	require.Equal(suite.T(), "nuxeo-worker", podSpec.PriorityClassName)
+	require.Equal(suite.T(), nodeSet.Affinity, podSpec.Affinity)
+}
+
+// TestDefaultAntiAffinity tests that a clustered NodeSet with no affinity gets a preferred Pod anti-affinity
+// across hosts and zones that selects only its own Pods, and that a non-clustered NodeSet gets no affinity
+func (suite *schedulingSuite) TestDefaultAntiAffinity() {
+	nux := suite.schedulingSuiteNewNuxeo()
+	dep := appsv1.Deployment{}
+	configureScheduling(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), dep.Spec.Template.Spec.Affinity)
+	nux.Spec.NodeSets[0].ClusterEnabled = true
+	configureScheduling(nux, &dep, nux.Spec.NodeSets[0])
+	require.NotNil(suite.T(), dep.Spec.Template.Spec.Affinity)
+	terms := dep.Spec.Template.Spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	require.Equal(suite.T(), 2, len(terms))
+	require.Equal(suite.T(), corev1.LabelHostname, terms[0].PodAffinityTerm.TopologyKey)
+	require.Equal(suite.T(), corev1.LabelZoneFailureDomainStable, terms[1].PodAffinityTerm.TopologyKey)
+	require.True(suite.T(), terms[0].Weight > terms[1].Weight, "host spreading should be preferred over zones")
+	for _, term := range terms {
+		require.Equal(suite.T(), nodeSetSelector(nux, nux.Spec.NodeSets[0]),
+			term.PodAffinityTerm.LabelSelector.MatchLabels)
+	}
+	other := nux.Spec.NodeSets[0]
+	other.Name = "other"
+	selector, _ := metav1.LabelSelectorAsSelector(terms[0].PodAffinityTerm.LabelSelector)
+	require.True(suite.T(), selector.Matches(labels.Set(podLabels(nux, nux.Spec.NodeSets[0]))))
+	require.False(suite.T(), selector.Matches(labels.Set(podLabels(nux, other))),
+		"anti-affinity should not select the Pods of other NodeSets")
+}
+
+// schedulingSuite is the scheduling test suite structure
+type schedulingSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *schedulingSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *schedulingSuite) AfterTest(_, _ string) {
+	// nop
+}
+
+// This function runs the scheduling unit test suite. It is called by 'go test' and will call every
+// function in this file with a schedulingSuite receiver that begins with "Test..."
+func TestSchedulingUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(schedulingSuite))
+}
+
+// schedulingSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
+func (suite *schedulingSuite) schedulingSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:     "worker",
+				Replicas: 2,
+			}},
+		},
+	}
+}
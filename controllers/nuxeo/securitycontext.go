@@ -0,0 +1,242 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"strings"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// the UID of the 'nginx' user in the official Nginx image, which otherwise runs as root
+const nginxUid = 101
+
+// writableDir is a directory that a container writes to, and that therefore needs an emptyDir volume when the
+// container runs with a read-only root filesystem
+type writableDir struct {
+	volName string
+	path    string
+}
+
+// writableDirs maps the name of each Operator-generated container to the directories that the container writes
+// to. Directories that are backed by a volume anyway - e.g. Nuxeo storage - are skipped. The Nginx cache and temp
+// directories are always emptyDir volumes, and the S3 trust store init container only writes to its own emptyDir
+// volume, so they are not listed here.
+var writableDirs = map[string][]writableDir{
+	"nuxeo": {
+		{"nuxeo-tmp", "/tmp"},
+		{"nuxeo-log", "/var/log/nuxeo"},
+		{"nuxeo-run", "/var/run/nuxeo"},
+		{"nuxeo-data", "/var/lib/nuxeo/data"},
+		{"nuxeo-server-tmp", "/opt/nuxeo/server/tmp"},
+	},
+	"nginx": {
+		{"nginx-run", "/var/run"},
+	},
+}
+
+// seededDirs are the directories of the Nuxeo image that Nuxeo writes to at every start: the entrypoint updates
+// nuxeo.conf in /etc/nuxeo, and nuxeoctl generates the server configuration into the server directory from the
+// templates, and records installed packages. Unlike writableDirs these directories hold content from the image, so
+// with a read-only root filesystem each is backed by an emptyDir volume that an init container seeds from the image.
+var seededDirs = []writableDir{
+	{"nuxeo-etc", "/etc/nuxeo"},
+	{"nuxeo-server-conf", "/opt/nuxeo/server/conf"},
+	{"nuxeo-server-nxserver", "/opt/nuxeo/server/nxserver"},
+	{"nuxeo-server-packages", "/opt/nuxeo/server/packages"},
+}
+
+const (
+	// the name of the init container that seeds the seededDirs volumes from the Nuxeo image
+	nuxeoSeedContainerName = "nuxeo-seed"
+	// the directory under which the seededDirs volumes are mounted in the seed init container
+	nuxeoSeedPath = "/nuxeo-seed"
+)
+
+// configureSecurityContext applies the Pod security context from the passed NodeSet to the passed Deployment,
+// and the container security context from the NodeSet to the Nuxeo container, the Nginx sidecar, and the init
+// containers that the Operator generated. Containers and init containers from the passed Nuxeo CR are not
+// modified. If the NodeSet opts in to the 'Restricted' security profile then a security context that the NodeSet
+// does not specify defaults to one that complies with the Pod Security Standards 'restricted' profile. Otherwise
+// the Operator applies no security context. Since the Kubernetes API that the Operator is built against pre-dates
+// the seccompProfile field, the RuntimeDefault seccomp profile is configured with the seccomp Pod annotation, which
+// the API server translates to the field. If the container security context specifies a read-only root filesystem
+// then emptyDir volumes are mounted on the paths that the containers write to - seeded from the Nuxeo image for the
+// Nuxeo container. Must be called after all Operator-generated containers are added to the Deployment.
+func configureSecurityContext(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet) error {
+	podSpec := &dep.Spec.Template.Spec
+	if nodeSet.PodSecurityContext != nil {
+		podSpec.SecurityContext = nodeSet.PodSecurityContext.DeepCopy()
+	} else if nodeSet.SecurityProfile == v1alpha1.SecurityProfileRestricted {
+		podSpec.SecurityContext = &corev1.PodSecurityContext{RunAsNonRoot: util.BoolPtr(true)}
+		if _, ok := dep.Spec.Template.Annotations[common.SeccompAnnotation]; !ok {
+			// unless specified in the Nuxeo CR Pod annotations
+			annotatePodTemplate(dep, common.SeccompAnnotation, corev1.SeccompProfileRuntimeDefault)
+		}
+	}
+	for i := range podSpec.InitContainers {
+		if !isCrContainer(podSpec.InitContainers[i].Name, instance.Spec.InitContainers) {
+			podSpec.InitContainers[i].SecurityContext = containerSecurityContext(podSpec.InitContainers[i], nodeSet)
+		}
+	}
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if isCrContainer(container.Name, instance.Spec.Containers) {
+			continue
+		}
+		container.SecurityContext = containerSecurityContext(*container, nodeSet)
+		if container.SecurityContext == nil {
+			continue
+		}
+		readOnlyRoot := container.SecurityContext.ReadOnlyRootFilesystem
+		if readOnlyRoot != nil && *readOnlyRoot {
+			if err := addWritableDirs(dep, container); err != nil {
+				return err
+			}
+			if container.Name == "nuxeo" {
+				if err := addSeededDirs(dep, container, nodeSet); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// containerSecurityContext returns the security context for the passed Operator-generated container: a copy of
+// the container security context from the passed NodeSet if specified, otherwise the default of the 'Restricted'
+// security profile if the NodeSet opts in to it, otherwise nil. Since the official Nginx image runs as root, the
+// 'Restricted' default for the Nginx sidecar runs it as the 'nginx' user.
+func containerSecurityContext(container corev1.Container, nodeSet v1alpha1.NodeSet) *corev1.SecurityContext {
+	if nodeSet.ContainerSecurityContext != nil {
+		return nodeSet.ContainerSecurityContext.DeepCopy()
+	} else if nodeSet.SecurityProfile != v1alpha1.SecurityProfileRestricted {
+		return nil
+	}
+	sc := &corev1.SecurityContext{
+		AllowPrivilegeEscalation: util.BoolPtr(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+	if container.Name == "nginx" {
+		sc.RunAsUser = util.Int64Ptr(nginxUid)
+	}
+	return sc
+}
+
+// addWritableDirs adds an emptyDir volume to the passed Deployment and a corresponding volume mount to the passed
+// container for each directory that the container writes to, unless the container already mounts a volume on -
+// or above - the directory
+func addWritableDirs(dep *appsv1.Deployment, container *corev1.Container) error {
+	for _, dir := range writableDirs[container.Name] {
+		if isMounted(container, dir.path) {
+			continue
+		}
+		if err := util.OnlyAddVol(dep, corev1.Volume{
+			Name: dir.volName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		}); err != nil {
+			return err
+		}
+		if err := util.OnlyAddVolMnt(container, corev1.VolumeMount{
+			Name:      dir.volName,
+			MountPath: dir.path,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSeededDirs adds an emptyDir volume to the passed Deployment and a corresponding volume mount to the passed Nuxeo
+// container for each of the seededDirs that is not already mounted, and an init container that runs the Nuxeo image
+// to copy the content of each directory from the image into its volume before Nuxeo starts. The init container gets
+// the same security context as the Nuxeo container, which is fine since it only writes to the volumes.
+func addSeededDirs(dep *appsv1.Deployment, nuxeoContainer *corev1.Container, nodeSet v1alpha1.NodeSet) error {
+	seed := corev1.Container{
+		Name:                     nuxeoSeedContainerName,
+		Image:                    nuxeoContainer.Image,
+		ImagePullPolicy:          nuxeoContainer.ImagePullPolicy,
+		TerminationMessagePath:   "/dev/termination-log",
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+	script := "set -e"
+	for _, dir := range seededDirs {
+		if isMounted(nuxeoContainer, dir.path) {
+			continue
+		}
+		if err := util.OnlyAddVol(dep, corev1.Volume{
+			Name: dir.volName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		}); err != nil {
+			return err
+		}
+		if err := util.OnlyAddVolMnt(nuxeoContainer, corev1.VolumeMount{
+			Name:      dir.volName,
+			MountPath: dir.path,
+		}); err != nil {
+			return err
+		}
+		seedPath := nuxeoSeedPath + "/" + dir.volName
+		seed.VolumeMounts = append(seed.VolumeMounts, corev1.VolumeMount{Name: dir.volName, MountPath: seedPath})
+		script += "; if [ -d " + dir.path + " ]; then cp -a " + dir.path + "/. " + seedPath + "/; fi"
+	}
+	if len(seed.VolumeMounts) == 0 {
+		return nil
+	}
+	seed.Command = []string{"/bin/sh", "-c", script}
+	seed.SecurityContext = containerSecurityContext(seed, nodeSet)
+	// copy so the init containers from the Nuxeo CR are not modified
+	dep.Spec.Template.Spec.InitContainers = append(append([]corev1.Container{},
+		dep.Spec.Template.Spec.InitContainers...), seed)
+	return nil
+}
+
+// isMounted returns true if the passed container mounts a whole volume - not a sub path - on the passed path or
+// on a parent of the passed path
+func isMounted(container *corev1.Container, path string) bool {
+	for _, mnt := range container.VolumeMounts {
+		if mnt.SubPath != "" {
+			continue
+		}
+		mntPath := strings.TrimSuffix(mnt.MountPath, "/")
+		if path == mntPath || strings.HasPrefix(path, mntPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isCrContainer returns true if the passed container name is the name of one of the passed containers from the
+// Nuxeo CR
+func isCrContainer(name string, crContainers []corev1.Container) bool {
+	for _, container := range crContainers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
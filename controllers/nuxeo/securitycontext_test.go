@@ -0,0 +1,289 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestRestrictedSecurityProfile tests that the security context of the Restricted security profile is applied to
+// the Pod, the Nuxeo container, the Nginx sidecar, and Operator-generated init containers - but not to containers
+// from the Nuxeo CR
+func (suite *securityContextSuite) TestRestrictedSecurityProfile() {
+	nux := suite.securityContextSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].SecurityProfile = v1alpha1.SecurityProfileRestricted
+	dep := genTestDeploymentForSecurityContextSuite(nux)
+	err := configureSecurityContext(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	podSpec := dep.Spec.Template.Spec
+	require.True(suite.T(), *podSpec.SecurityContext.RunAsNonRoot)
+	require.Equal(suite.T(), corev1.SeccompProfileRuntimeDefault,
+		dep.Spec.Template.Annotations[common.SeccompAnnotation])
+	generated := []corev1.Container{podSpec.Containers[0], podSpec.Containers[1], podSpec.InitContainers[1]}
+	for _, container := range generated {
+		require.NotNil(suite.T(), container.SecurityContext, "Security context not applied to "+container.Name)
+		require.False(suite.T(), *container.SecurityContext.AllowPrivilegeEscalation)
+		require.Equal(suite.T(), []corev1.Capability{"ALL"}, container.SecurityContext.Capabilities.Drop)
+	}
+	require.Nil(suite.T(), podSpec.Containers[0].SecurityContext.RunAsUser)
+	require.Equal(suite.T(), int64(nginxUid), *podSpec.Containers[1].SecurityContext.RunAsUser)
+	require.Nil(suite.T(), podSpec.Containers[2].SecurityContext, "Nuxeo CR sidecar should not have been modified")
+	require.Nil(suite.T(), podSpec.InitContainers[0].SecurityContext,
+		"Nuxeo CR init container should not have been modified")
+	// the Operator removes the seccomp annotation that it applied when the profile is no longer specified
+	nux.Spec.NodeSets[0].SecurityProfile = ""
+	expected := genTestDeploymentForSecurityContextSuite(nux)
+	err = configureSecurityContext(nux, &expected, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	require.False(suite.T(), util.DeploymentComparer(&expected, &dep))
+	_, ok := dep.Spec.Template.Annotations[common.SeccompAnnotation]
+	require.False(suite.T(), ok, "Seccomp annotation should have been removed")
+}
+
+// TestNoSecurityProfile tests that no security context is applied unless the NodeSet opts in to a security profile,
+// and that the Operator leaves a seccomp annotation that it did not apply in place
+func (suite *securityContextSuite) TestNoSecurityProfile() {
+	nux := suite.securityContextSuiteNewNuxeo()
+	dep := genTestDeploymentForSecurityContextSuite(nux)
+	// as generated by defaultDeployment
+	dep.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	err := configureSecurityContext(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	require.Equal(suite.T(), corev1.PodSecurityContext{}, *dep.Spec.Template.Spec.SecurityContext)
+	_, ok := dep.Spec.Template.Annotations[common.SeccompAnnotation]
+	require.False(suite.T(), ok, "Seccomp annotation should not have been applied")
+	for _, container := range dep.Spec.Template.Spec.Containers {
+		require.Nil(suite.T(), container.SecurityContext, "Security context applied to "+container.Name)
+	}
+	for _, container := range dep.Spec.Template.Spec.InitContainers {
+		require.Nil(suite.T(), container.SecurityContext, "Security context applied to "+container.Name)
+	}
+	found := dep.DeepCopy()
+	found.Spec.Template.Annotations = map[string]string{common.SeccompAnnotation: "localhost/custom.json"}
+	require.True(suite.T(), util.DeploymentComparer(&dep, found), "Seccomp annotation should not be reconciled")
+	require.Equal(suite.T(), "localhost/custom.json", found.Spec.Template.Annotations[common.SeccompAnnotation])
+}
+
+// TestExplicitSecurityContext tests that the security contexts from the NodeSet override the security profile, and
+// that an empty Pod security context does not apply the seccomp annotation
+func (suite *securityContextSuite) TestExplicitSecurityContext() {
+	nux := suite.securityContextSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].SecurityProfile = v1alpha1.SecurityProfileRestricted
+	nux.Spec.NodeSets[0].PodSecurityContext = &corev1.PodSecurityContext{}
+	nux.Spec.NodeSets[0].ContainerSecurityContext = &corev1.SecurityContext{RunAsUser: util.Int64Ptr(1000)}
+	dep := genTestDeploymentForSecurityContextSuite(nux)
+	err := configureSecurityContext(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	require.Equal(suite.T(), corev1.PodSecurityContext{}, *dep.Spec.Template.Spec.SecurityContext)
+	_, ok := dep.Spec.Template.Annotations[common.SeccompAnnotation]
+	require.False(suite.T(), ok, "Seccomp annotation should not have been applied")
+	for _, container := range dep.Spec.Template.Spec.Containers[0:2] {
+		require.Equal(suite.T(), int64(1000), *container.SecurityContext.RunAsUser)
+		require.Nil(suite.T(), container.SecurityContext.Capabilities)
+	}
+}
+
+// TestReadOnlyRootFilesystem tests that a read-only root filesystem mounts emptyDir volumes on the directories
+// that the Operator-generated containers write to, except for directories that are already backed by a volume
+func (suite *securityContextSuite) TestReadOnlyRootFilesystem() {
+	nux := suite.securityContextSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].ContainerSecurityContext = &corev1.SecurityContext{
+		ReadOnlyRootFilesystem: util.BoolPtr(true),
+	}
+	dep := genTestDeploymentForSecurityContextSuite(nux)
+	nuxeoContainer, _ := GetNuxeoContainer(&dep)
+	nuxeoContainer.VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/var/lib/nuxeo/data"}}
+	err := configureSecurityContext(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	mounts := map[string]string{}
+	for _, mnt := range dep.Spec.Template.Spec.Containers[0].VolumeMounts {
+		mounts[mnt.MountPath] = mnt.Name
+	}
+	require.Equal(suite.T(), map[string]string{
+		"/tmp":                       "nuxeo-tmp",
+		"/var/log/nuxeo":             "nuxeo-log",
+		"/var/run/nuxeo":             "nuxeo-run",
+		"/var/lib/nuxeo/data":        "data",
+		"/opt/nuxeo/server/tmp":      "nuxeo-server-tmp",
+		"/etc/nuxeo":                 "nuxeo-etc",
+		"/opt/nuxeo/server/conf":     "nuxeo-server-conf",
+		"/opt/nuxeo/server/nxserver": "nuxeo-server-nxserver",
+		"/opt/nuxeo/server/packages": "nuxeo-server-packages",
+	}, mounts)
+	nginxMounts := dep.Spec.Template.Spec.Containers[1].VolumeMounts
+	require.Equal(suite.T(), "/var/run", nginxMounts[len(nginxMounts)-1].MountPath)
+	// two Nginx volumes are always defined
+	require.Equal(suite.T(), 11, len(dep.Spec.Template.Spec.Volumes))
+	require.Equal(suite.T(), 0, len(dep.Spec.Template.Spec.Containers[2].VolumeMounts),
+		"Nuxeo CR sidecar should not have been modified")
+}
+
+// TestReadOnlyRootSeededDirs tests that with a read-only root filesystem every path that Nuxeo writes to at startup
+// is on a volume, and that the directories holding content from the image are seeded from the Nuxeo image by an
+// init container that copies each directory into the volume that the Nuxeo container mounts on that directory
+func (suite *securityContextSuite) TestReadOnlyRootSeededDirs() {
+	nux := suite.securityContextSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].ContainerSecurityContext = &corev1.SecurityContext{
+		ReadOnlyRootFilesystem: util.BoolPtr(true),
+	}
+	dep := genTestDeploymentForSecurityContextSuite(nux)
+	err := configureSecurityContext(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	nuxeoContainer := dep.Spec.Template.Spec.Containers[0]
+	// files and directories written by the Nuxeo image entrypoint and by nuxeoctl when Nuxeo starts
+	for _, path := range []string{
+		"/etc/nuxeo/nuxeo.conf",
+		"/opt/nuxeo/server/conf/server.xml",
+		"/opt/nuxeo/server/nxserver/config/default-repository-config.xml",
+		"/opt/nuxeo/server/nxserver/nuxeo.war/WEB-INF/web.xml",
+		"/opt/nuxeo/server/packages/.packages",
+		"/opt/nuxeo/server/tmp/nuxeo.pid",
+		"/var/lib/nuxeo/data/instance.clid",
+		"/var/log/nuxeo/server.log",
+		"/tmp/nuxeo-upload",
+	} {
+		require.True(suite.T(), isMounted(&nuxeoContainer, path), path+" is not writable")
+	}
+	var seed *corev1.Container
+	for i := range dep.Spec.Template.Spec.InitContainers {
+		if dep.Spec.Template.Spec.InitContainers[i].Name == nuxeoSeedContainerName {
+			seed = &dep.Spec.Template.Spec.InitContainers[i]
+		}
+	}
+	require.NotNil(suite.T(), seed, "Seed init container not defined")
+	require.Equal(suite.T(), nuxeoContainer.Image, seed.Image, "Seed init container must run the Nuxeo image")
+	require.True(suite.T(), *seed.SecurityContext.ReadOnlyRootFilesystem)
+	require.Equal(suite.T(), 3, len(seed.Command))
+	nuxeoMounts := map[string]string{}
+	for _, mnt := range nuxeoContainer.VolumeMounts {
+		nuxeoMounts[mnt.Name] = mnt.MountPath
+	}
+	require.Equal(suite.T(), len(seededDirs), len(seed.VolumeMounts))
+	for _, mnt := range seed.VolumeMounts {
+		imagePath, ok := nuxeoMounts[mnt.Name]
+		require.True(suite.T(), ok, "Seeded volume "+mnt.Name+" not mounted in the Nuxeo container")
+		require.Contains(suite.T(), seed.Command[2], "cp -a "+imagePath+"/. "+mnt.MountPath+"/",
+			"Seed init container does not copy "+imagePath)
+	}
+	require.Nil(suite.T(), dep.Spec.Template.Spec.InitContainers[0].SecurityContext,
+		"Nuxeo CR init container should not have been modified")
+}
+
+// TestSeededDirsAlreadyMounted tests that a directory that is already backed by a volume is neither mounted again
+// nor seeded, and that no seed init container is defined without a read-only root filesystem
+func (suite *securityContextSuite) TestSeededDirsAlreadyMounted() {
+	nux := suite.securityContextSuiteNewNuxeo()
+	dep := genTestDeploymentForSecurityContextSuite(nux)
+	err := configureSecurityContext(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	for _, container := range dep.Spec.Template.Spec.InitContainers {
+		require.NotEqual(suite.T(), nuxeoSeedContainerName, container.Name)
+	}
+	nux.Spec.NodeSets[0].ContainerSecurityContext = &corev1.SecurityContext{
+		ReadOnlyRootFilesystem: util.BoolPtr(true),
+	}
+	dep = genTestDeploymentForSecurityContextSuite(nux)
+	nuxeoContainer, _ := GetNuxeoContainer(&dep)
+	nuxeoContainer.VolumeMounts = []corev1.VolumeMount{{Name: "packages", MountPath: "/opt/nuxeo/server/packages"}}
+	err = configureSecurityContext(nux, &dep, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err, "configureSecurityContext failed")
+	seed := dep.Spec.Template.Spec.InitContainers[len(dep.Spec.Template.Spec.InitContainers)-1]
+	require.Equal(suite.T(), nuxeoSeedContainerName, seed.Name)
+	require.Equal(suite.T(), len(seededDirs)-1, len(seed.VolumeMounts))
+	require.NotContains(suite.T(), seed.Command[2], "/opt/nuxeo/server/packages")
+}
+
+// securityContextSuite is the security context test suite structure
+type securityContextSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *securityContextSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *securityContextSuite) AfterTest(_, _ string) {
+	// nothing to remove
+}
+
+// This function runs the security context unit test suite. It is called by 'go test' and will call every
+// function in this file with a securityContextSuite receiver that begins with "Test..."
+func TestSecurityContextUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(securityContextSuite))
+}
+
+// securityContextSuiteNewNuxeo creates a test Nuxeo struct with a sidecar and an init container
+func (suite *securityContextSuite) securityContextSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:     "test",
+				Replicas: 1,
+			}},
+			Containers: []corev1.Container{{
+				Name:  "sidecar",
+				Image: "busybox",
+			}},
+			InitContainers: []corev1.Container{{
+				Name:  "init",
+				Image: "busybox",
+			}},
+		},
+	}
+}
+
+// genTestDeploymentForSecurityContextSuite creates a Deployment with a Nuxeo container, an Nginx sidecar, the
+// sidecar and init container from the passed Nuxeo CR, and an Operator-generated init container - in that order
+func genTestDeploymentForSecurityContextSuite(nux *v1alpha1.Nuxeo) appsv1.Deployment {
+	dep := appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "nuxeo",
+						Image: "nuxeo:LTS-2019",
+					}},
+				},
+			},
+		},
+	}
+	_ = configureNginx(&dep, v1alpha1.NginxRevProxySpec{})
+	_ = configureContainers(nux, &dep)
+	dep.Spec.Template.Spec.InitContainers = append(append([]corev1.Container{},
+		dep.Spec.Template.Spec.InitContainers...), corev1.Container{Name: s3TrustStoreVolumeName})
+	return dep
+}
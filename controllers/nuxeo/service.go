@@ -44,7 +44,8 @@ func (r *NuxeoReconciler) reconcileService(svc v1alpha1.ServiceSpec, nodeSet v1a
 	if err != nil {
 		return err
 	}
-	_, err = r.addOrUpdate(svcName, instance.Namespace, expected, &corev1.Service{}, util.ServiceComparer)
+	expected.Labels = nodeSetLabels(instance, nodeSet)
+	_, err = r.addOrUpdate(instance, svcName, instance.Namespace, expected, &corev1.Service{}, util.ServiceComparer)
 	return err
 }
 
@@ -67,18 +68,8 @@ func (r *NuxeoReconciler) reconcileService(svc v1alpha1.ServiceSpec, nodeSet v1a
 //        targetPort: 8080 (or 8443)
 func (r *NuxeoReconciler) defaultService(instance *v1alpha1.Nuxeo, svc v1alpha1.ServiceSpec,
 	svcName string, isTLS bool) (*corev1.Service, error) {
-	var svcType = corev1.ServiceTypeClusterIP
-	var port int32 = 80
-	var targetPort int32 = 8080
-	if isTLS || instance.Spec.RevProxy != (v1alpha1.RevProxySpec{}) {
-		port = 443
-		targetPort = 8443
-	}
-	if svc != (v1alpha1.ServiceSpec{}) {
-		port = svc.Port
-		targetPort = svc.TargetPort
-		svcType = svc.Type
-	}
+	svc = defaultServiceSpec(instance, svc, isTLS)
+	port, targetPort, svcType := svc.Port, svc.TargetPort, svc.Type
 	switch svcType {
 	case "ClusterIP":
 		s := corev1.Service{
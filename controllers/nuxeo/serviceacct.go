@@ -17,27 +17,36 @@ limitations under the License.
 package nuxeo
 
 import (
+	"strings"
+
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
 	"github.com/aceeric/nuxeo-operator/controllers/util"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
-// reconcileServiceAccount creates a service account for the Nuxeo deployments to run under. At present, there isn't
-// anything in the service account spec - so this is just a placeholder in case any special service-related
-// capabilities are needed in the future
+// reconcileServiceAccount creates a service account for the Nuxeo deployments to run under, with the image pull
+// secrets from the Nuxeo CR. The service account name is scoped to the Nuxeo CR. If the legacy un-scoped service
+// account generated by a prior version of the Operator is owned by the Nuxeo CR, it is removed.
 func (r *NuxeoReconciler) reconcileServiceAccount(instance *v1alpha1.Nuxeo) error {
-	svcAcctName := NuxeoServiceAccountName
+	svcAcctName := serviceAccountName(instance)
 	expected, err := r.defaultServiceAccount(instance, svcAcctName)
 	if err != nil {
 		return err
 	}
-	_, err = r.addOrUpdate(svcAcctName, instance.Namespace, expected, &corev1.ServiceAccount{}, util.NopComparer)
-	return err
+	_, err = r.addOrUpdate(instance, svcAcctName, instance.Namespace, expected, &corev1.ServiceAccount{},
+		util.ServiceAccountComparer)
+	if err != nil {
+		return err
+	}
+	return r.removeIfPresent(instance, NuxeoServiceAccountName, instance.Namespace, &corev1.ServiceAccount{})
 }
 
-// defaultServiceAccount creates and returns a service account struct
+// defaultServiceAccount creates and returns a service account struct with the image pull secrets from the passed
+// Nuxeo CR. The names of the image pull secrets are recorded in an annotation so the service account comparer can
+// tell them from the image pull secrets that were added to the service account by something else.
 func (r *NuxeoReconciler) defaultServiceAccount(instance *v1alpha1.Nuxeo,
 	svcAcctName string) (*corev1.ServiceAccount, error) {
 	sa := corev1.ServiceAccount{
@@ -45,7 +54,21 @@ func (r *NuxeoReconciler) defaultServiceAccount(instance *v1alpha1.Nuxeo,
 			Name:      svcAcctName,
 			Namespace: instance.Namespace,
 		},
+		ImagePullSecrets: instance.Spec.ImagePullSecrets,
+	}
+	if len(instance.Spec.ImagePullSecrets) != 0 {
+		var names []string
+		for _, pullSecret := range instance.Spec.ImagePullSecrets {
+			names = append(names, pullSecret.Name)
+		}
+		sa.Annotations = map[string]string{common.ImagePullSecretsAnnotation: strings.Join(names, ",")}
 	}
 	_ = controllerutil.SetControllerReference(instance, &sa, r.Scheme)
 	return &sa, nil
 }
+
+// serviceAccountName generates the name of the service account for the passed Nuxeo CR: the Nuxeo CR name +
+// dash + 'serviceaccount'. E.g.: 'my-nuxeo-serviceaccount'.
+func serviceAccountName(instance *v1alpha1.Nuxeo) string {
+	return instance.Name + "-serviceaccount"
+}
@@ -21,9 +21,11 @@ import (
 	"testing"
 
 	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/common"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -35,10 +37,73 @@ func (suite *serviceAccountSuite) TestBasicServiceAccountCreation() {
 	err := suite.r.reconcileServiceAccount(nux)
 	require.Nil(suite.T(), err, "reconcileServiceAccount failed")
 	found := &corev1.ServiceAccount{}
-	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: NuxeoServiceAccountName, Namespace: suite.namespace}, found)
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: "testnux-serviceaccount", Namespace: suite.namespace},
+		found)
 	require.Nil(suite.T(), err, "ServiceAccount creation failed")
 }
 
+// TestLegacyServiceAccountRemoved tests that the un-scoped service account generated by a prior version of the
+// Operator is removed if owned by the Nuxeo CR, and that a legacy service account not owned by the Nuxeo CR
+// is left in place
+func (suite *serviceAccountSuite) TestLegacyServiceAccountRemoved() {
+	nux := suite.serviceAccountSuiteNewNuxeo()
+	legacy, _ := suite.r.defaultServiceAccount(nux, NuxeoServiceAccountName)
+	err := suite.r.Create(context.TODO(), legacy)
+	require.Nil(suite.T(), err)
+	err = suite.r.reconcileServiceAccount(nux)
+	require.Nil(suite.T(), err, "reconcileServiceAccount failed")
+	found := &corev1.ServiceAccount{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: NuxeoServiceAccountName, Namespace: suite.namespace},
+		found)
+	require.True(suite.T(), apierrors.IsNotFound(err), "Legacy ServiceAccount should have been removed")
+	// not owned by the Nuxeo CR
+	unowned := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      NuxeoServiceAccountName,
+			Namespace: suite.namespace,
+		},
+	}
+	err = suite.r.Create(context.TODO(), unowned)
+	require.Nil(suite.T(), err)
+	err = suite.r.reconcileServiceAccount(nux)
+	require.Nil(suite.T(), err, "reconcileServiceAccount failed")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: NuxeoServiceAccountName, Namespace: suite.namespace},
+		found)
+	require.Nil(suite.T(), err, "Un-owned legacy ServiceAccount should not have been removed")
+}
+
+// TestServiceAccountPullSecrets tests that the image pull secrets from the Nuxeo CR are added to the ServiceAccount,
+// and that removing an image pull secret from the Nuxeo CR leaves image pull secrets that were added by something
+// other than the Operator
+func (suite *serviceAccountSuite) TestServiceAccountPullSecrets() {
+	nux := suite.serviceAccountSuiteNewNuxeo()
+	nux.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "registry-creds"}}
+	err := suite.r.reconcileServiceAccount(nux)
+	require.Nil(suite.T(), err, "reconcileServiceAccount failed")
+	found := &corev1.ServiceAccount{}
+	name := types.NamespacedName{Name: serviceAccountName(nux), Namespace: suite.namespace}
+	_ = suite.r.Get(context.TODO(), name, found)
+	require.Equal(suite.T(), nux.Spec.ImagePullSecrets, found.ImagePullSecrets)
+	// simulate OpenShift adding a dockercfg secret
+	found.ImagePullSecrets = append(found.ImagePullSecrets, corev1.LocalObjectReference{Name: "dockercfg"})
+	_ = suite.r.Update(context.TODO(), found)
+	nux.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "other-creds"}}
+	err = suite.r.reconcileServiceAccount(nux)
+	require.Nil(suite.T(), err, "reconcileServiceAccount failed")
+	found = &corev1.ServiceAccount{}
+	_ = suite.r.Get(context.TODO(), name, found)
+	require.Equal(suite.T(), []corev1.LocalObjectReference{{Name: "dockercfg"}, {Name: "other-creds"}},
+		found.ImagePullSecrets)
+	nux.Spec.ImagePullSecrets = nil
+	err = suite.r.reconcileServiceAccount(nux)
+	require.Nil(suite.T(), err, "reconcileServiceAccount failed")
+	found = &corev1.ServiceAccount{}
+	_ = suite.r.Get(context.TODO(), name, found)
+	require.Equal(suite.T(), []corev1.LocalObjectReference{{Name: "dockercfg"}}, found.ImagePullSecrets)
+	_, ok := found.Annotations[common.ImagePullSecretsAnnotation]
+	require.False(suite.T(), ok, "Image pull secrets annotation should have been removed")
+}
+
 // serviceAccountSuite is the ServiceAccount test suite structure
 type serviceAccountSuite struct {
 	suite.Suite
@@ -69,7 +134,9 @@ func TestServiceAccountUnitTestSuite(t *testing.T) {
 func (suite *serviceAccountSuite) serviceAccountSuiteNewNuxeo() *v1alpha1.Nuxeo {
 	return &v1alpha1.Nuxeo{
 		ObjectMeta: metav1.ObjectMeta{
+			Name:      "testnux",
 			Namespace: suite.namespace,
+			UID:       "12345678-1234-1234-1234-123456789012",
 		},
 	}
 }
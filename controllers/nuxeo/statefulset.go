@@ -0,0 +1,220 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reconcileStatefulSet converts the passed expected Deployment for the passed NodeSet to a StatefulSet and
+// reconciles the StatefulSet with the cluster, along with the headless governing Service of the StatefulSet. Since
+// the NodeSet could previously have been configured as a Deployment, any Deployment generated for the NodeSet is
+// removed.
+func (r *NuxeoReconciler) reconcileStatefulSet(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet,
+	dep *appsv1.Deployment) (reconOp, error) {
+	if err := r.removeIfPresent(instance, dep.Name, instance.Namespace, &appsv1.Deployment{}); err != nil {
+		return NA, err
+	}
+	svcName := headlessServiceName(instance, nodeSet)
+	svc := r.defaultHeadlessService(instance, svcName, nodeSet)
+	if _, err := r.addOrUpdate(instance, svcName, instance.Namespace, svc, &corev1.Service{},
+		util.ServiceComparer); err != nil {
+		return NA, err
+	}
+	expected := r.statefulSetFromDeployment(instance, nodeSet, dep)
+	found := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: expected.Name, Namespace: instance.Namespace},
+		found); err == nil {
+		if change := claimTemplateChange(expected, found); change != "" {
+			return NA, withCondition(v1alpha1.ConditionStorageBound, "ClaimTemplateChangeRefused",
+				fmt.Errorf("refusing to change the volume claim templates of existing StatefulSet '%v': %v. The "+
+					"volume claim templates of a StatefulSet cannot be updated - delete the StatefulSet without "+
+					"deleting its Pods ('kubectl delete statefulset %v --cascade=false') to have the Operator "+
+					"re-create it. Existing PVCs are not changed", expected.Name, change, expected.Name))
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return NA, err
+	}
+	return r.addOrUpdate(instance, expected.Name, instance.Namespace, expected, &appsv1.StatefulSet{},
+		util.StatefulSetComparer)
+}
+
+// claimTemplateChange compares the volume claim templates of the passed expected and found StatefulSets. Since
+// the volume claim templates of an existing StatefulSet cannot be updated, a description of the first difference
+// is returned so that it can be reported rather than silently ignored. An empty string is returned if there is no
+// difference. The templates are compared like PVCs, so fields that the API server defaults are not differences.
+func claimTemplateChange(expected *appsv1.StatefulSet, found *appsv1.StatefulSet) string {
+	if len(expected.Spec.VolumeClaimTemplates) != len(found.Spec.VolumeClaimTemplates) {
+		return fmt.Sprintf("the number of volume claim templates cannot be changed from %v to %v",
+			len(found.Spec.VolumeClaimTemplates), len(expected.Spec.VolumeClaimTemplates))
+	}
+	for i := range expected.Spec.VolumeClaimTemplates {
+		exp, fnd := &expected.Spec.VolumeClaimTemplates[i], &found.Spec.VolumeClaimTemplates[i]
+		if exp.Name != fnd.Name {
+			return fmt.Sprintf("volume claim template '%v' cannot be replaced by '%v'", fnd.Name, exp.Name)
+		}
+		if incompatibility, grow := comparePvcs(exp, fnd); incompatibility != "" {
+			return fmt.Sprintf("volume claim template '%v': %v", exp.Name, incompatibility)
+		} else if grow {
+			return fmt.Sprintf("volume claim template '%v': the storage request cannot be increased in the "+
+				"template. Expand the PVCs created from the template instead", exp.Name)
+		}
+	}
+	return ""
+}
+
+// statefulSetFromDeployment generates a StatefulSet from the passed Deployment, which has already been fully
+// configured from the passed NodeSet. The Pod template, selector, replicas, labels and annotations are carried over.
+// Each NodeSet storage that would be backed by a PVC is instead defined as a volume claim template, so the
+// StatefulSet controller creates one PVC per Pod, and the corresponding Pod volume is removed. The volume mounts
+// are left as is since the claim templates have the same names as the volumes they replace.
+func (r *NuxeoReconciler) statefulSetFromDeployment(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet,
+	dep *appsv1.Deployment) *appsv1.StatefulSet {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        dep.Name,
+			Namespace:   dep.Namespace,
+			Labels:      dep.Labels,
+			Annotations: dep.Annotations,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:            dep.Spec.Replicas,
+			Selector:            dep.Spec.Selector,
+			Template:            *dep.Spec.Template.DeepCopy(),
+			ServiceName:         headlessServiceName(instance, nodeSet),
+			PodManagementPolicy: appsv1.OrderedReadyPodManagement,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{
+					Partition: util.Int32Ptr(0),
+				},
+			},
+			RevisionHistoryLimit: dep.Spec.RevisionHistoryLimit,
+		},
+	}
+	for _, storage := range nodeSet.Storage {
+		if !storageUsesClaimTemplate(storage) {
+			continue
+		}
+		claimTemplate := claimTemplateForStorage(storage)
+		sts.Spec.VolumeClaimTemplates = append(sts.Spec.VolumeClaimTemplates, claimTemplate)
+		volumes := sts.Spec.Template.Spec.Volumes[:0]
+		for _, vol := range sts.Spec.Template.Spec.Volumes {
+			if vol.Name != claimTemplate.Name {
+				volumes = append(volumes, vol)
+			}
+		}
+		sts.Spec.Template.Spec.Volumes = volumes
+	}
+	_ = controllerutil.SetControllerReference(instance, sts, r.Scheme)
+	return sts
+}
+
+// claimTemplateForStorage generates a StatefulSet volume claim template for the passed storage. The template is
+// named like the volume that would otherwise be generated for the storage. If the storage defines an explicit PVC
+// template, then its spec, labels, and annotations are used. Otherwise, the spec is the same as the default PVC
+// that the Operator generates for a Deployment.
+func claimTemplateForStorage(storage v1alpha1.NuxeoStorageSpec) corev1.PersistentVolumeClaim {
+	claimTemplate := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: volumeNameForStorage(storage.StorageType),
+		},
+	}
+	if !reflect.DeepEqual(storage.VolumeClaimTemplate, corev1.PersistentVolumeClaim{}) {
+		claimTemplate.Labels = storage.VolumeClaimTemplate.Labels
+		claimTemplate.Annotations = storage.VolumeClaimTemplate.Annotations
+		storage.VolumeClaimTemplate.Spec.DeepCopyInto(&claimTemplate.Spec)
+	} else {
+		claimTemplate.Spec = defaultPvcSpec(storage)
+	}
+	return claimTemplate
+}
+
+// storageUsesClaimTemplate returns true if the passed storage in a StatefulSet NodeSet is provided by a volume
+// claim template. This is the case unless the storage defines an explicit volume source.
+func storageUsesClaimTemplate(storage v1alpha1.NuxeoStorageSpec) bool {
+	return !reflect.DeepEqual(storage.VolumeClaimTemplate, corev1.PersistentVolumeClaim{}) ||
+		storage.VolumeSource == (corev1.VolumeSource{})
+}
+
+// defaultHeadlessService generates the headless governing Service for the StatefulSet of the passed NodeSet. The
+// Service gives each StatefulSet Pod a stable DNS name. It selects only the Pods of the NodeSet.
+func (r *NuxeoReconciler) defaultHeadlessService(instance *v1alpha1.Nuxeo, svcName string,
+	nodeSet v1alpha1.NodeSet) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svcName,
+			Namespace: instance.Namespace,
+			Labels:    nodeSetLabels(instance, nodeSet),
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Ports: []corev1.ServicePort{{
+				Name:       "web",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       8080,
+				TargetPort: intstr.FromInt(8080),
+			}},
+			Selector: nodeSetSelector(instance, nodeSet),
+			Type:     corev1.ServiceTypeClusterIP,
+		},
+	}
+	_ = controllerutil.SetControllerReference(instance, svc, r.Scheme)
+	return svc
+}
+
+// headlessServiceName generates the name of the headless Service for the passed NodeSet. The generated name
+// consists of the StatefulSet name + dash + 'headless'. E.g.: 'my-nuxeo-cluster-headless'.
+func headlessServiceName(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) string {
+	return deploymentName(instance, nodeSet) + "-headless"
+}
+
+// isStatefulSet returns true if the Operator generates a StatefulSet from the passed NodeSet, else false
+func isStatefulSet(nodeSet v1alpha1.NodeSet) bool {
+	return nodeSet.WorkloadType == v1alpha1.WorkloadStatefulSet
+}
+
+// workloadKind returns the kind of the workload that the Operator generates from the passed NodeSet
+func workloadKind(nodeSet v1alpha1.NodeSet) string {
+	if isStatefulSet(nodeSet) {
+		return "StatefulSet"
+	}
+	return "Deployment"
+}
+
+// clusterNodeIdSource returns the name of the environment variable that holds the Nuxeo cluster node id for the
+// passed NodeSet, and the downward API field path that the variable is populated from. For a Deployment, this is
+// the Pod UID. For a StatefulSet, this is the Pod name, which ends with the Pod ordinal, and which is therefore
+// stable across Pod restarts.
+func clusterNodeIdSource(nodeSet v1alpha1.NodeSet) (string, string) {
+	if isStatefulSet(nodeSet) {
+		return "POD_NAME", "metadata.name"
+	}
+	return "POD_UID", "metadata.uid"
+}
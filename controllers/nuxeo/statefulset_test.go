@@ -0,0 +1,222 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TestStatefulSetCreation tests that a StatefulSet NodeSet generates a StatefulSet with a volume claim template
+// in place of the storage volume, a headless governing Service, and no Operator-managed PVC
+func (suite *statefulSetSuite) TestStatefulSetCreation() {
+	nux := suite.statefulSetSuiteNewNuxeo()
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	sts := appsv1.StatefulSet{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, &sts)
+	require.Nil(suite.T(), err, "StatefulSet was not created")
+	require.Equal(suite.T(), headlessServiceName(nux, nux.Spec.NodeSets[0]), sts.Spec.ServiceName)
+	require.Equal(suite.T(), 1, len(sts.Spec.VolumeClaimTemplates))
+	require.Equal(suite.T(), "data", sts.Spec.VolumeClaimTemplates[0].Name)
+	for _, vol := range sts.Spec.Template.Spec.Volumes {
+		require.NotEqual(suite.T(), "data", vol.Name, "Claim template volume should not be in the Pod spec")
+	}
+	svc := corev1.Service{}
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: sts.Spec.ServiceName,
+		Namespace: suite.namespace}, &svc)
+	require.Nil(suite.T(), err, "Headless Service was not created")
+	require.Equal(suite.T(), corev1.ClusterIPNone, svc.Spec.ClusterIP)
+	require.Equal(suite.T(), nodeSetSelector(nux, nux.Spec.NodeSets[0]), svc.Spec.Selector)
+	require.Nil(suite.T(), suite.r.reconcilePvc(nux))
+	pvcs := corev1.PersistentVolumeClaimList{}
+	_ = suite.r.List(context.TODO(), &pvcs)
+	require.Equal(suite.T(), 0, len(pvcs.Items), "PVCs should be created by the StatefulSet controller")
+}
+
+// TestStatefulSetClustering tests that a clustered StatefulSet NodeSet uses the Pod name as the cluster node id
+func (suite *statefulSetSuite) TestStatefulSetClustering() {
+	nux := suite.statefulSetSuiteNewNuxeo()
+	nux.Spec.NodeSets[0].ClusterEnabled = true
+	nux.Spec.NodeSets[0].Storage = append(nux.Spec.NodeSets[0].Storage, v1alpha1.NuxeoStorageSpec{
+		StorageType: v1alpha1.NuxeoStorageBinaries,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "shared-binaries"},
+		},
+	})
+	require.Equal(suite.T(), 0, len(validateNuxeo(nux)))
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	sts := appsv1.StatefulSet{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, &sts)
+	require.Equal(suite.T(), 1, len(sts.Spec.VolumeClaimTemplates), "Shared binaries should not be a claim template")
+	found := false
+	for _, envVar := range sts.Spec.Template.Spec.Containers[0].Env {
+		if envVar.Name == "POD_NAME" && envVar.ValueFrom.FieldRef.FieldPath == "metadata.name" {
+			found = true
+		}
+	}
+	require.True(suite.T(), found, "POD_NAME environment variable not defined")
+	cm := corev1.ConfigMap{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: nuxeoConfCMName(nux, nux.Spec.NodeSets[0].Name),
+		Namespace: suite.namespace}, &cm)
+	require.Contains(suite.T(), cm.Data["nuxeo.conf"], "nuxeo.cluster.nodeid=${env:POD_NAME}\n")
+	nux.Spec.NodeSets[0].Storage[1].VolumeSource = corev1.VolumeSource{}
+	nux.Spec.NodeSets[0].Storage[1].Size = "10Gi"
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 1, len(errs))
+	require.Equal(suite.T(), "spec.nodeSets[0].storage[1].volumeSource", errs[0].Field)
+}
+
+// TestClaimTemplateChangeRefused tests that a change to the storage of a StatefulSet NodeSet, which would change
+// the immutable volume claim templates of the StatefulSet, is reported with a StorageBound condition rather than
+// silently ignored, and that the StatefulSet is left unchanged
+func (suite *statefulSetSuite) TestClaimTemplateChangeRefused() {
+	nux := suite.statefulSetSuiteNewNuxeo()
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	nux.Spec.NodeSets[0].Storage[0].Size = "5Gi"
+	_, err = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.NotNil(suite.T(), err, "Claim template change should have been refused")
+	var condErr *conditionError
+	require.True(suite.T(), errors.As(err, &condErr))
+	require.Equal(suite.T(), v1alpha1.ConditionStorageBound, condErr.condType)
+	require.Equal(suite.T(), "ClaimTemplateChangeRefused", condErr.reason)
+	sts := appsv1.StatefulSet{}
+	_ = suite.r.Get(context.TODO(), types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, &sts)
+	size := sts.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests[corev1.ResourceStorage]
+	require.Equal(suite.T(), "2Gi", size.String())
+	nux.Spec.NodeSets[0].Storage[0].Size = "2Gi"
+	_, err = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+}
+
+// TestWorkloadTypeChange tests that changing the workload type of a NodeSet removes the previous workload
+func (suite *statefulSetSuite) TestWorkloadTypeChange() {
+	nux := suite.statefulSetSuiteNewNuxeo()
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	nux.Spec.NodeSets[0].WorkloadType = v1alpha1.WorkloadDeployment
+	_, err := suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	require.Nil(suite.T(), err)
+	name := types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]), Namespace: suite.namespace}
+	err = suite.r.Get(context.TODO(), name, &appsv1.StatefulSet{})
+	require.True(suite.T(), apierrors.IsNotFound(err), "StatefulSet should have been removed")
+	err = suite.r.Get(context.TODO(), types.NamespacedName{Name: headlessServiceName(nux, nux.Spec.NodeSets[0]),
+		Namespace: suite.namespace}, &corev1.Service{})
+	require.True(suite.T(), apierrors.IsNotFound(err), "Headless Service should have been removed")
+	err = suite.r.Get(context.TODO(), name, &appsv1.Deployment{})
+	require.Nil(suite.T(), err, "Deployment was not created")
+}
+
+// TestStatefulSetStatus tests that the NodeSet status is obtained from the StatefulSet
+func (suite *statefulSetSuite) TestStatefulSetStatus() {
+	nux := suite.statefulSetSuiteNewNuxeo()
+	_, _ = suite.r.reconcileNodeSet(nux.Spec.NodeSets[0], nux)
+	sts := appsv1.StatefulSet{}
+	name := types.NamespacedName{Name: deploymentName(nux, nux.Spec.NodeSets[0]), Namespace: suite.namespace}
+	_ = suite.r.Get(context.TODO(), name, &sts)
+	sts.Status = appsv1.StatefulSetStatus{
+		Replicas:        2,
+		ReadyReplicas:   2,
+		UpdatedReplicas: 2,
+		CurrentRevision: "rev1",
+		UpdateRevision:  "rev1",
+	}
+	require.Nil(suite.T(), suite.r.Update(context.TODO(), &sts))
+	nodeSetStatus, err := suite.r.nodeSetStatus(nux, nux.Spec.NodeSets[0])
+	require.Nil(suite.T(), err)
+	require.Equal(suite.T(), v1alpha1.WorkloadStatefulSet, nodeSetStatus.WorkloadType)
+	require.Equal(suite.T(), int32(2), nodeSetStatus.AvailableReplicas)
+	require.Equal(suite.T(), v1alpha1.StatusHealthy, nodeSetStatus.Status)
+	require.Equal(suite.T(), v1alpha1.RolloutComplete, nodeSetStatus.Rollout)
+	sts.Status.UpdateRevision = "rev2"
+	sts.Status.ReadyReplicas = 1
+	require.Nil(suite.T(), suite.r.Update(context.TODO(), &sts))
+	nodeSetStatus, _ = suite.r.nodeSetStatus(nux, nux.Spec.NodeSets[0])
+	require.Equal(suite.T(), v1alpha1.StatusDegraded, nodeSetStatus.Status)
+	require.Equal(suite.T(), v1alpha1.RolloutProgressing, nodeSetStatus.Rollout)
+}
+
+// statefulSetSuite is the StatefulSet test suite structure
+type statefulSetSuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *statefulSetSuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *statefulSetSuite) AfterTest(_, _ string) {
+	obj := appsv1.StatefulSet{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &obj)
+	objDep := appsv1.Deployment{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &objDep)
+	objSvc := corev1.Service{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &objSvc)
+	objCm := corev1.ConfigMap{}
+	_ = suite.r.DeleteAllOf(context.TODO(), &objCm)
+}
+
+// This function runs the StatefulSet unit test suite. It is called by 'go test' and will call every
+// function in this file with a statefulSetSuite receiver that begins with "Test..."
+func TestStatefulSetUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(statefulSetSuite))
+}
+
+// statefulSetSuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
+func (suite *statefulSetSuite) statefulSetSuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+			// the fake client doesn't assign a UID - and the owner UID is needed to remove the workload
+			UID: "12345678-1234-1234-1234-123456789012",
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:         "cluster",
+				Replicas:     2,
+				Interactive:  true,
+				WorkloadType: v1alpha1.WorkloadStatefulSet,
+				Storage: []v1alpha1.NuxeoStorageSpec{{
+					StorageType: v1alpha1.NuxeoStorageData,
+					Size:        "2Gi",
+				}},
+			}},
+		},
+	}
+}
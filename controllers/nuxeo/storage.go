@@ -28,12 +28,13 @@ import (
 // configureStorage supports the ability to define persistent storage for certain types of Nuxeo storage. For example,
 // Nuxeo stores document attachments as binary blobs on the file system. This function and the underlying configuration
 // structures allow these blobs to be stored persistently.
-func configureStorage(dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet) error {
+func (r *NuxeoReconciler) configureStorage(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment,
+	nodeSet v1alpha1.NodeSet) error {
 	if nuxeoContainer, err := GetNuxeoContainer(dep); err != nil {
 		return err
 	} else {
 		for _, storage := range nodeSet.Storage {
-			if volume, err := createVolumeForStorage(storage); err != nil {
+			if volume, err := r.createVolumeForStorage(instance, storage); err != nil {
 				return err
 			} else {
 				volMnt := createVolumeMountForStorage(storage.StorageType, volume.Name)
@@ -118,7 +119,8 @@ func getMountPathForStorageType(storageType v1alpha1.NuxeoStorage) string {
 // defines an explicit PVC template, then that is used. Else if the VolumeSource in the passed storage is
 // explicitly defined, then that is used. Otherwise, a PVC volume source is generated with
 // hard-coded defaults, based on the storage type. Caller must add the Volume to the Pod Spec.
-func createVolumeForStorage(storage v1alpha1.NuxeoStorageSpec) (corev1.Volume, error) {
+func (r *NuxeoReconciler) createVolumeForStorage(instance *v1alpha1.Nuxeo,
+	storage v1alpha1.NuxeoStorageSpec) (corev1.Volume, error) {
 	volName := volumeNameForStorage(storage.StorageType)
 	var volSrc corev1.VolumeSource
 
@@ -135,9 +137,13 @@ func createVolumeForStorage(storage v1alpha1.NuxeoStorageSpec) (corev1.Volume, e
 		volSrc = storage.VolumeSource
 	} else {
 		// default: create a PVC volume source and generate the pvc name from the volume name
+		claimName, err := r.pvcName(instance, storage.StorageType)
+		if err != nil {
+			return corev1.Volume{}, err
+		}
 		volSrc = corev1.VolumeSource{
 			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-				ClaimName: volName + "-pvc",
+				ClaimName: claimName,
 				ReadOnly:  false,
 			},
 		}
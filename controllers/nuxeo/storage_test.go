@@ -34,7 +34,7 @@ import (
 func (suite *nuxeoStorageSpecSuite) TestBasicNuxeoStorage() {
 	nux := suite.nuxeoStorageSpecSuiteNewNuxeo()
 	dep := genTestDeploymentForStorageSuite()
-	err := configureStorage(&dep, nux.Spec.NodeSets[0])
+	err := suite.r.configureStorage(nux, &dep, nux.Spec.NodeSets[0])
 	require.Nil(suite.T(), err, "configureStorage failed")
 	require.Equal(suite.T(), 5, len(dep.Spec.Template.Spec.Volumes))
 	require.Equal(suite.T(), 5, len(dep.Spec.Template.Spec.Containers[0].VolumeMounts),
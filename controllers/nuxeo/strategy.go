@@ -0,0 +1,69 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// configureStrategy sets the update strategy and progress deadline of the passed Deployment from the strategy
+// resolved for the passed NodeSet
+func configureStrategy(instance *v1alpha1.Nuxeo, dep *appsv1.Deployment, nodeSet v1alpha1.NodeSet) {
+	strategy := resolveStrategy(instance, nodeSet)
+	dep.Spec.ProgressDeadlineSeconds = strategy.ProgressDeadlineSeconds
+	dep.Spec.Strategy = appsv1.DeploymentStrategy{Type: strategy.Type}
+	if strategy.Type == appsv1.RollingUpdateDeploymentStrategyType {
+		dep.Spec.Strategy.RollingUpdate = &appsv1.RollingUpdateDeployment{
+			MaxUnavailable: strategy.MaxUnavailable,
+			MaxSurge:       strategy.MaxSurge,
+		}
+	}
+}
+
+// resolveStrategy returns a fully populated StrategySpec for the passed NodeSet. Each field is taken from the
+// NodeSet strategy if specified there, otherwise from the Nuxeo CR strategy if specified there, otherwise from the
+// Operator defaults: RollingUpdate, 25% max surge, 25% max unavailable, and a 600 second progress deadline.
+func resolveStrategy(instance *v1alpha1.Nuxeo, nodeSet v1alpha1.NodeSet) v1alpha1.StrategySpec {
+	defaultPct := intstr.FromString("25%")
+	resolved := v1alpha1.StrategySpec{
+		Type:                    appsv1.RollingUpdateDeploymentStrategyType,
+		MaxSurge:                &defaultPct,
+		MaxUnavailable:          &defaultPct,
+		ProgressDeadlineSeconds: util.Int32Ptr(600),
+	}
+	for _, strategy := range []*v1alpha1.StrategySpec{instance.Spec.Strategy, nodeSet.Strategy} {
+		if strategy == nil {
+			continue
+		}
+		if strategy.Type != "" {
+			resolved.Type = strategy.Type
+		}
+		if strategy.MaxSurge != nil {
+			resolved.MaxSurge = strategy.MaxSurge
+		}
+		if strategy.MaxUnavailable != nil {
+			resolved.MaxUnavailable = strategy.MaxUnavailable
+		}
+		if strategy.ProgressDeadlineSeconds != nil {
+			resolved.ProgressDeadlineSeconds = strategy.ProgressDeadlineSeconds
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2020 Eric Ace.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nuxeo
+
+import (
+	"testing"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	"github.com/aceeric/nuxeo-operator/controllers/util"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// TestDefaultStrategy tests that the Operator defaults are used if neither the CR nor the NodeSet has a strategy
+func (suite *strategySuite) TestDefaultStrategy() {
+	nux := suite.strategySuiteNewNuxeo()
+	dep := appsv1.Deployment{}
+	configureStrategy(nux, &dep, nux.Spec.NodeSets[0])
+	require.Equal(suite.T(), appsv1.RollingUpdateDeploymentStrategyType, dep.Spec.Strategy.Type)
+	require.Equal(suite.T(), intstr.FromString("25%"), *dep.Spec.Strategy.RollingUpdate.MaxSurge)
+	require.Equal(suite.T(), intstr.FromString("25%"), *dep.Spec.Strategy.RollingUpdate.MaxUnavailable)
+	require.Equal(suite.T(), int32(600), *dep.Spec.ProgressDeadlineSeconds)
+}
+
+// TestStrategyPrecedence tests that NodeSet strategy fields override CR strategy fields, which override the
+// Operator defaults, and that a Recreate strategy has no rolling update parameters
+func (suite *strategySuite) TestStrategyPrecedence() {
+	nux := suite.strategySuiteNewNuxeo()
+	maxSurge := intstr.FromInt(1)
+	maxUnavailable := intstr.FromInt(0)
+	nux.Spec.Strategy = &v1alpha1.StrategySpec{
+		MaxSurge:                &maxSurge,
+		ProgressDeadlineSeconds: util.Int32Ptr(1200),
+	}
+	nux.Spec.NodeSets[0].Strategy = &v1alpha1.StrategySpec{
+		MaxUnavailable: &maxUnavailable,
+	}
+	dep := appsv1.Deployment{}
+	configureStrategy(nux, &dep, nux.Spec.NodeSets[0])
+	require.Equal(suite.T(), maxSurge, *dep.Spec.Strategy.RollingUpdate.MaxSurge)
+	require.Equal(suite.T(), maxUnavailable, *dep.Spec.Strategy.RollingUpdate.MaxUnavailable)
+	require.Equal(suite.T(), int32(1200), *dep.Spec.ProgressDeadlineSeconds)
+	nux.Spec.NodeSets[0].Strategy.Type = appsv1.RecreateDeploymentStrategyType
+	configureStrategy(nux, &dep, nux.Spec.NodeSets[0])
+	require.Equal(suite.T(), appsv1.RecreateDeploymentStrategyType, dep.Spec.Strategy.Type)
+	require.Nil(suite.T(), dep.Spec.Strategy.RollingUpdate)
+}
+
+// TestStrategyValidation tests that a rolling update with zero max surge and zero max unavailable is rejected
+func (suite *strategySuite) TestStrategyValidation() {
+	nux := suite.strategySuiteNewNuxeo()
+	zero := intstr.FromInt(0)
+	zeroPct := intstr.FromString("0%")
+	nux.Spec.NodeSets[0].Strategy = &v1alpha1.StrategySpec{
+		MaxSurge:       &zero,
+		MaxUnavailable: &zeroPct,
+	}
+	errs := validateNuxeo(nux)
+	require.Equal(suite.T(), 1, len(errs))
+	require.Equal(suite.T(), "spec.nodeSets[0].strategy.maxUnavailable", errs[0].Field)
+}
+
+// strategySuite is the update strategy test suite structure
+type strategySuite struct {
+	suite.Suite
+	r         NuxeoReconciler
+	nuxeoName string
+	namespace string
+}
+
+// SetupSuite initializes the Fake client, a NuxeoReconciler struct, and various test suite constants
+func (suite *strategySuite) SetupSuite() {
+	suite.r = initUnitTestReconcile()
+	suite.nuxeoName = "testnux"
+	suite.namespace = "testns"
+}
+
+// AfterTest removes objects of the type being tested in this suite after each test
+func (suite *strategySuite) AfterTest(_, _ string) {
+	// nop
+}
+
+// This function runs the update strategy unit test suite. It is called by 'go test' and will call every
+// function in this file with a strategySuite receiver that begins with "Test..."
+func TestStrategyUnitTestSuite(t *testing.T) {
+	suite.Run(t, new(strategySuite))
+}
+
+// strategySuiteNewNuxeo creates a test Nuxeo struct suitable for the test cases in this suite.
+func (suite *strategySuite) strategySuiteNewNuxeo() *v1alpha1.Nuxeo {
+	return &v1alpha1.Nuxeo{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      suite.nuxeoName,
+			Namespace: suite.namespace,
+		},
+		Spec: v1alpha1.NuxeoSpec{
+			NodeSets: []v1alpha1.NodeSet{{
+				Name:        "cluster",
+				Replicas:    1,
+				Interactive: true,
+			}},
+		},
+	}
+}
@@ -23,6 +23,8 @@ import (
 	v12 "k8s.io/api/core/v1"
 )
 
+// NuxeoServiceAccountName is the name of the service account that prior versions of the Operator generated for
+// every Nuxeo CR in a namespace. See serviceAccountName for the current name.
 var NuxeoServiceAccountName = "nuxeo"
 
 // GetNuxeoContainer walks the container array in the passed deployment and returns a ref to the container
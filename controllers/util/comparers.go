@@ -18,11 +18,15 @@ package util
 
 import (
 	"reflect"
+	"strings"
 
+	"github.com/aceeric/nuxeo-operator/controllers/common"
 	routev1 "github.com/openshift/api/route/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/api/networking/v1beta1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -97,20 +101,95 @@ func RouteComparer(expected runtime.Object, found runtime.Object) bool {
 	return true
 }
 
-// Deployment comparer
+// Deployment comparer. If expected is annotated to indicate that its replicas are managed outside of the
+// Operator (e.g. by kubectl scale or an HPA) then the replicas in found are retained
 func DeploymentComparer(expected runtime.Object, found runtime.Object) bool {
 	exp := expected.(*appsv1.Deployment)
 	fnd := found.(*appsv1.Deployment)
-	annotationsChanged := false
+	if _, ok := exp.Annotations[common.ExternalReplicasAnnotation]; ok && fnd.Spec.Replicas != nil {
+		exp.Spec.Replicas = fnd.Spec.Replicas
+	}
+	metaAnnotationsChanged, annotationsChanged := false, false
+	podAnnotationsPruned := prunePodAnnotations(exp.Spec.Template.Annotations, fnd.Spec.Template.Annotations)
+	exp.Annotations, metaAnnotationsChanged = syncAnnotations(exp.Annotations, fnd.Annotations)
+	exp.Spec.Template.Annotations, annotationsChanged = syncAnnotations(exp.Spec.Template.Annotations,
+		fnd.Spec.Template.Annotations)
+	if podAnnotationsPruned || metaAnnotationsChanged || annotationsChanged || !reflect.DeepEqual(exp.Spec, fnd.Spec) {
+		fnd.Annotations = exp.Annotations
+		exp.Spec.DeepCopyInto(&fnd.Spec)
+		return false
+	}
+	return true
+}
+
+// StatefulSet comparer. Works like the Deployment comparer except that the volume claim templates are not compared,
+// because they cannot be updated in an existing StatefulSet. The reconciler reports a change to the volume claim
+// templates before the comparer is called.
+func StatefulSetComparer(expected runtime.Object, found runtime.Object) bool {
+	exp := expected.(*appsv1.StatefulSet)
+	fnd := found.(*appsv1.StatefulSet)
+	if _, ok := exp.Annotations[common.ExternalReplicasAnnotation]; ok && fnd.Spec.Replicas != nil {
+		exp.Spec.Replicas = fnd.Spec.Replicas
+	}
+	exp.Spec.VolumeClaimTemplates = fnd.Spec.VolumeClaimTemplates
+	metaAnnotationsChanged, annotationsChanged := false, false
+	podAnnotationsPruned := prunePodAnnotations(exp.Spec.Template.Annotations, fnd.Spec.Template.Annotations)
+	exp.Annotations, metaAnnotationsChanged = syncAnnotations(exp.Annotations, fnd.Annotations)
 	exp.Spec.Template.Annotations, annotationsChanged = syncAnnotations(exp.Spec.Template.Annotations,
 		fnd.Spec.Template.Annotations)
-	if annotationsChanged || !reflect.DeepEqual(exp.Spec, fnd.Spec) {
+	if podAnnotationsPruned || metaAnnotationsChanged || annotationsChanged || !reflect.DeepEqual(exp.Spec, fnd.Spec) {
+		fnd.Annotations = exp.Annotations
+		exp.Spec.DeepCopyInto(&fnd.Spec)
+		return false
+	}
+	return true
+}
+
+// HorizontalPodAutoscaler comparer. Only the fields generated by the Operator are compared
+func HpaComparer(expected runtime.Object, found runtime.Object) bool {
+	exp := expected.(*autoscalingv2beta2.HorizontalPodAutoscaler)
+	fnd := found.(*autoscalingv2beta2.HorizontalPodAutoscaler)
+	if !reflect.DeepEqual(exp.Spec.ScaleTargetRef, fnd.Spec.ScaleTargetRef) ||
+		!reflect.DeepEqual(exp.Spec.MinReplicas, fnd.Spec.MinReplicas) ||
+		exp.Spec.MaxReplicas != fnd.Spec.MaxReplicas ||
+		!reflect.DeepEqual(exp.Spec.Metrics, fnd.Spec.Metrics) {
+		fnd.Spec.ScaleTargetRef = exp.Spec.ScaleTargetRef
+		fnd.Spec.MinReplicas = exp.Spec.MinReplicas
+		fnd.Spec.MaxReplicas = exp.Spec.MaxReplicas
+		fnd.Spec.Metrics = exp.Spec.Metrics
+		return false
+	}
+	return true
+}
+
+// PodDisruptionBudget comparer
+func PdbComparer(expected runtime.Object, found runtime.Object) bool {
+	exp := expected.(*policyv1beta1.PodDisruptionBudget)
+	fnd := found.(*policyv1beta1.PodDisruptionBudget)
+	if !reflect.DeepEqual(exp.Spec, fnd.Spec) {
 		exp.Spec.DeepCopyInto(&fnd.Spec)
 		return false
 	}
 	return true
 }
 
+// prunePodAnnotations removes the Pod annotations that the Operator applied from the Nuxeo CR - as recorded in
+// the pod annotations annotation - from the passed found Pod template annotations if they are not in the passed
+// expected Pod template annotations, because they were removed from the Nuxeo CR. Otherwise syncAnnotations would
+// keep them as annotations that the Operator doesn't originate. Returns true if any annotations were removed.
+func prunePodAnnotations(exp map[string]string, fnd map[string]string) bool {
+	pruned := false
+	for _, key := range strings.Split(fnd[common.PodAnnotationsAnnotation], ",") {
+		if _, ok := exp[key]; !ok && key != "" {
+			if _, ok := fnd[key]; ok {
+				delete(fnd, key)
+				pruned = true
+			}
+		}
+	}
+	return pruned
+}
+
 // syncAnnotations compares expected annotations with found. Expected has the correct values for those annotations
 // originated by the Operator. However, the actual cluster resource might also have some annotations (from
 // Kubernetes or applied manually) that the Operator doesn't originate. So merge those into expected and
@@ -143,42 +222,84 @@ func syncAnnotations(exp map[string]string, fnd map[string]string) (map[string]s
 				if _, ok := exp[fk]; !ok {
 					exp[fk] = fv
 				}
-			} else if exp != nil {
+			} else if _, ok := exp[fk]; !ok {
 				// if 'found' has a Nuxeo annotation that is not present in expected, then that means it was
 				// there and was removed this reconciliation cycle
-				if _, ok := exp[fk]; !ok {
-					annotationsChanged = true
-				}
+				annotationsChanged = true
 			}
 		}
 	}
 	return exp, annotationsChanged
 }
 
-// ConfigMap comparer
+// ConfigMap comparer. The Operator may annotate the nuxeo.conf ConfigMap with nuxeo.conf conflicts, so the
+// Nuxeo annotations are reconciled along with the data
 func ConfigMapComparer(expected runtime.Object, found runtime.Object) bool {
-	if !reflect.DeepEqual(expected.(*corev1.ConfigMap).Data, found.(*corev1.ConfigMap).Data) {
-		found.(*corev1.ConfigMap).Data = expected.(*corev1.ConfigMap).Data
+	exp := expected.(*corev1.ConfigMap)
+	fnd := found.(*corev1.ConfigMap)
+	annotations, annotationsChanged := syncAnnotations(exp.Annotations, fnd.Annotations)
+	if !reflect.DeepEqual(exp.Data, fnd.Data) || annotationsChanged {
+		fnd.Data = exp.Data
+		fnd.Annotations = annotations
 		return false
 	}
 	return true
 }
 
-// PersistentVolumeClaim comparer
-func PvcComparer(expected runtime.Object, found runtime.Object) bool {
-	exp := expected.(*corev1.PersistentVolumeClaim)
-	fnd := found.(*corev1.PersistentVolumeClaim)
-	if !reflect.DeepEqual(exp.Spec.AccessModes, fnd.Spec.AccessModes) ||
-		!reflect.DeepEqual(exp.Spec.Resources, fnd.Spec.Resources) ||
-		(exp.Spec.VolumeMode != nil && exp.Spec.VolumeMode != fnd.Spec.VolumeMode) {
-		fnd.Spec.AccessModes = exp.Spec.AccessModes
-		fnd.Spec.Resources = exp.Spec.Resources
-		fnd.Spec.AccessModes = exp.Spec.AccessModes
+// ServiceAccount comparer. Kubernetes distributions may add image pull secrets to a service account - e.g.
+// OpenShift adds a dockercfg secret - so only the image pull secrets that the Operator added are reconciled. These
+// are recorded in an annotation on the service account, so that an image pull secret that is removed from the
+// Nuxeo CR can be removed from the service account without removing the others.
+func ServiceAccountComparer(expected runtime.Object, found runtime.Object) bool {
+	exp := expected.(*corev1.ServiceAccount)
+	fnd := found.(*corev1.ServiceAccount)
+	var pullSecrets []corev1.LocalObjectReference
+	for _, pullSecret := range fnd.ImagePullSecrets {
+		if !containsPullSecret(exp.ImagePullSecrets, pullSecret.Name) &&
+			containsPullSecret(pullSecretRefs(fnd.Annotations[common.ImagePullSecretsAnnotation]), pullSecret.Name) {
+			// added by the Operator and since removed from the Nuxeo CR
+			continue
+		}
+		pullSecrets = append(pullSecrets, pullSecret)
+	}
+	for _, pullSecret := range exp.ImagePullSecrets {
+		if !containsPullSecret(pullSecrets, pullSecret.Name) {
+			pullSecrets = append(pullSecrets, pullSecret)
+		}
+	}
+	annotationsChanged := false
+	exp.Annotations, annotationsChanged = syncAnnotations(exp.Annotations, fnd.Annotations)
+	pullSecretsChanged := len(pullSecrets) != len(fnd.ImagePullSecrets) ||
+		(len(pullSecrets) != 0 && !reflect.DeepEqual(pullSecrets, fnd.ImagePullSecrets))
+	if annotationsChanged || pullSecretsChanged {
+		fnd.Annotations = exp.Annotations
+		fnd.ImagePullSecrets = pullSecrets
 		return false
 	}
 	return true
 }
 
+// pullSecretRefs parses the comma-separated image pull secret names in the passed annotation value
+func pullSecretRefs(annotation string) []corev1.LocalObjectReference {
+	var refs []corev1.LocalObjectReference
+	for _, name := range strings.Split(annotation, ",") {
+		if name != "" {
+			refs = append(refs, corev1.LocalObjectReference{Name: name})
+		}
+	}
+	return refs
+}
+
+// containsPullSecret returns true if the passed image pull secrets contain the passed name
+func containsPullSecret(pullSecrets []corev1.LocalObjectReference, name string) bool {
+	for _, pullSecret := range pullSecrets {
+		if pullSecret.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // objects are always the same
 func NopComparer(runtime.Object, runtime.Object) bool {
 	return true
@@ -19,6 +19,8 @@ package util
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"strings"
@@ -161,6 +163,24 @@ func OnlyAddEnvVar(container *corev1.Container, env corev1.EnvVar) error {
 	return nil
 }
 
+// Adds the passed environment variable to the passed container ahead of the named environment variable if not
+// present, otherwise errors. If the named environment variable is not present then the passed environment variable
+// is appended. Since Kubernetes only expands a $(VAR) reference to a variable defined earlier in the container env
+// var array, this supports defining a variable that another variable references.
+func OnlyAddEnvVarBefore(container *corev1.Container, env corev1.EnvVar, before string) error {
+	if existingEnv := GetEnv(container, env.Name); existingEnv != nil {
+		return fmt.Errorf("duplicate environment variable: %v", env.Name)
+	}
+	for i := 0; i < len(container.Env); i++ {
+		if container.Env[i].Name == before {
+			container.Env = append(container.Env[:i], append([]corev1.EnvVar{env}, container.Env[i:]...)...)
+			return nil
+		}
+	}
+	container.Env = append(container.Env, env)
+	return nil
+}
+
 // Adds the passed volume mount to the passed container if not present in the container, otherwise errors
 func OnlyAddVolMnt(container *corev1.Container, mnt corev1.VolumeMount) error {
 	if existingMnt := getVolMnt(container, mnt.Name); existingMnt != nil {
@@ -234,6 +254,11 @@ func Int64Ptr(i int64) *int64 {
 	return &i
 }
 
+// Returns a pointer to the passed value
+func BoolPtr(b bool) *bool {
+	return &b
+}
+
 // set v = thenVal if v == ifVal
 func SetInt32If(v *int32, ifVal int32, thenVal int32) {
 	if *v == ifVal {
@@ -260,6 +285,13 @@ func CRCBytes(val []byte) string {
 	return fmt.Sprintf("%x", crc32.Checksum(val, crc32q))
 }
 
+// Generates a hex-encoded SHA-256 hash of the passed value. Used rather than a CRC for hashes that are exposed in
+// annotations when the hashed content may hold credentials, so the content cannot be recovered by brute force
+func SHA256(val []byte) string {
+	sum := sha256.Sum256(val)
+	return hex.EncodeToString(sum[:])
+}
+
 // Annotates the passed deployment.spec.template.annotations
 func AnnotateTemplate(dep *appsv1.Deployment, key, val string) {
 	if dep.Spec.Template.Annotations == nil {
@@ -92,13 +92,22 @@ func main() {
 		os.Exit(1)
 	}
 	if err = (&nuxeo.NuxeoReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("nuxeo-operator"),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("nuxeo-operator"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("nuxeo-operator"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "nuxeo-operator")
 		os.Exit(1)
 	}
+	if err := configureImages(); err != nil {
+		setupLog.Error(err, "invalid image configuration")
+		os.Exit(1)
+	}
+	if webhooksEnabled() {
+		nuxeo.SetupWebhooksWithManager(mgr)
+		setupLog.Info("admission webhooks are enabled")
+	}
 	if watchNamespace == "" {
 		setupLog.Info("nuxeo operator version " + version + " is watching all namespaces")
 	} else {
@@ -122,3 +131,35 @@ func getWatchNamespace() string {
 	}
 	return ns
 }
+
+// configureImages configures the images in the Pods that the Operator generates from environment variables:
+// RELATED_IMAGE_NUXEO and RELATED_IMAGE_NGINX are the default Nuxeo and Nginx images - which is the OLM
+// convention for images that are pinned to a digest so they can be mirrored into a disconnected cluster.
+// IMAGE_REGISTRY_REWRITES is a comma-separated list of 'from=to' registry prefix rewrites, and if
+// REWRITE_CR_IMAGES is "true" then the rewrites also apply to the containers and init containers in Nuxeo CRs.
+// A default image that is not pinned to a digest is logged, since it can change under the Nuxeo CRs that use it.
+func configureImages() error {
+	rewrites, err := nuxeo.ParseRegistryRewrites(os.Getenv("IMAGE_REGISTRY_REWRITES"))
+	if err != nil {
+		return err
+	}
+	nuxeo.ConfigureImages(nuxeo.ImageConfig{
+		NuxeoImage:       os.Getenv("RELATED_IMAGE_NUXEO"),
+		NginxImage:       os.Getenv("RELATED_IMAGE_NGINX"),
+		RegistryRewrites: rewrites,
+		RewriteCrImages:  os.Getenv("REWRITE_CR_IMAGES") == "true",
+	})
+	for _, env := range []string{"RELATED_IMAGE_NUXEO", "RELATED_IMAGE_NGINX"} {
+		if !nuxeo.DigestPinned(os.Getenv(env)) {
+			setupLog.Info("default image is not pinned to a digest", "env", env, "image", os.Getenv(env))
+		}
+	}
+	return nil
+}
+
+// webhooksEnabled returns true if the ENABLE_WEBHOOKS env var is set to "true". Webhooks are opt-in because
+// the webhook server requires a serving certificate which is only provisioned by the kustomize configuration
+// in config/default. This allows the operator to be run locally via 'make operator-run' without a certificate.
+func webhooksEnabled() bool {
+	return os.Getenv("ENABLE_WEBHOOKS") == "true"
+}
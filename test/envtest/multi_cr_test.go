@@ -0,0 +1,75 @@
+package envtest
+
+import (
+	"context"
+	"time"
+
+	"github.com/aceeric/nuxeo-operator/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Multiple Nuxeo CRs", func() {
+
+	Context("Two Nuxeo CRs in one namespace", func() {
+		It("Should each get their own resources", func() {
+			By("Create two Nuxeo CRs")
+			var nuxeos []*v1alpha1.Nuxeo
+			for _, name := range []string{"nuxeo-one", "nuxeo-two"} {
+				nuxeo := &v1alpha1.Nuxeo{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      name,
+						Namespace: "default",
+					},
+					Spec: v1alpha1.NuxeoSpec{
+						Clid: "test--clid",
+						NodeSets: []v1alpha1.NodeSet{{
+							Name:     "cluster",
+							Replicas: 1,
+							Storage: []v1alpha1.NuxeoStorageSpec{{
+								StorageType: v1alpha1.NuxeoStorageBinaries,
+								Size:        "10M",
+							}},
+						}},
+						// the test tools require these even though nil is fine in-cluster
+						Volumes:        []corev1.Volume{},
+						Containers:     []corev1.Container{},
+						InitContainers: []corev1.Container{},
+					},
+				}
+				Expect(k8sClient.Create(context.Background(), nuxeo)).Should(Succeed())
+				nuxeos = append(nuxeos, nuxeo)
+			}
+
+			defer func() {
+				for _, nuxeo := range nuxeos {
+					Expect(k8sClient.Delete(context.Background(), nuxeo)).Should(Succeed())
+				}
+			}()
+
+			for _, nuxeo := range nuxeos {
+				By("Expect the resources of " + nuxeo.Name + " to be created by the operator")
+				expected := map[string]runtime.Object{
+					nuxeo.Name + "-cluster":        &appsv1.Deployment{},
+					nuxeo.Name + "-clid":           &corev1.ConfigMap{},
+					nuxeo.Name + "-serviceaccount": &corev1.ServiceAccount{},
+					nuxeo.Name + "-binaries-pvc":   &corev1.PersistentVolumeClaim{},
+				}
+				for name, obj := range expected {
+					name, obj := name, obj
+					Eventually(func() error {
+						return k8sClient.Get(context.Background(), types.NamespacedName{
+							Name:      name,
+							Namespace: "default",
+						}, obj)
+					}, time.Second*5, time.Second*1).Should(BeNil())
+				}
+			}
+		})
+	})
+})
@@ -93,9 +93,10 @@ var _ = BeforeSuite(func(done Done) {
 	Expect(err).ToNot(HaveOccurred())
 
 	r := &nuxeo.NuxeoReconciler{
-		Client: k8sManager.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("nuxeo-operator"),
-		Scheme: k8sManager.GetScheme(),
+		Client:   k8sManager.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("nuxeo-operator"),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("nuxeo-operator"),
 	}
 	err = r.SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())